@@ -10,6 +10,7 @@ import { prisma } from './lib/prisma';
 import { authMiddleware } from './middleware/auth';
 import authRoutes from './routes/auth';
 import cameraRoutes from './routes/camera';
+import alertRoutes from './routes/alert';
 
 // Load environment variables
 config();
@@ -43,6 +44,7 @@ app.onError((err: ApiError, c) => {
 app.route('/auth', authRoutes);
 app.use('/api/*', authMiddleware);
 app.route('/api/cameras', cameraRoutes);
+app.route('/api/alerts', alertRoutes);
 app.use('/snapshots/*', serveStatic({ root: './' } as any));
 
 
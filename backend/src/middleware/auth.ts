@@ -5,7 +5,7 @@ export const authMiddleware = async (c: any, next: () => Promise<void>) => {
   if (!auth) return c.json({ error: 'Missing token' }, 401);
   const token = auth.replace('Bearer ', '');
   const payload = verifyJwt(token);
-  if (!payload) return c.json({ error: 'Invalid token' }, 401);
+  if (!payload || !payload.userId) return c.json({ error: 'Invalid token' }, 401);
   c.set('userId', payload.userId);
   await next();
 };
@@ -1,5 +1,96 @@
 import { Hono } from 'hono';
 import type { Context } from 'hono';
 import { prisma } from '../lib/prisma';
-import { cameraSchema, idSchema, type CameraData } from '../schemas/camera.schema'
-import { validateBody } from '../middleware/validation.middleware';
\ No newline at end of file
+import { alertSchema, alertEventSchema, type AlertData, type AlertEventData } from '../schemas/alert.schema';
+import { validateBody } from '../middleware/validation.middleware';
+
+type CustomContext = Context & {
+  get(key: 'userId'): string;
+  get(key: 'validatedBody'): unknown;
+}
+
+type Db = Pick<typeof prisma, 'camera' | 'alert'>;
+
+// createAlertRoutes builds the alert routes on a database client; tests pass a fake one
+export const createAlertRoutes = (db: Db = prisma) => {
+  const alert = new Hono();
+
+  // findCamera returns the camera if it belongs to the caller
+  const findCamera = (cameraId: string, userId: string) =>
+    db.camera.findFirst({ where: { id: cameraId, userId } });
+
+  // conflictingAlert reports whether the ID is already used by an alert of another camera
+  const conflictingAlert = async (id: string, cameraId: string) => {
+    const existing = await db.alert.findUnique({ where: { id } });
+    return existing !== null && existing.cameraId !== cameraId;
+  };
+
+  // Point alert from the worker, one per detection. The worker's alert ID is
+  // the record ID, so a retried delivery doesn't create a duplicate.
+  alert.post('/', validateBody(alertSchema), async (c: CustomContext) => {
+    try {
+      const userId = c.get('userId');
+      const { alertId, cameraId, detectedAt, description, snapshotUrl, metadata, ...extra } = c.get('validatedBody') as AlertData;
+
+      const cam = await findCamera(cameraId, userId);
+      if (!cam) {
+        return c.json({ error: 'Camera not found' }, 404);
+      }
+      if (await conflictingAlert(alertId, cameraId)) {
+        return c.json({ error: 'Alert belongs to another camera' }, 409);
+      }
+
+      const faceCount = Number(metadata?.face_count ?? 1);
+      const data = {
+        detectedFaces: Number.isFinite(faceCount) ? faceCount : 1,
+        description: description || null,
+        snapshotUrl: snapshotUrl || null,
+        metadata: { ...metadata, ...extra } as any,
+      };
+      const saved = await db.alert.upsert({
+        where: { id: alertId },
+        create: { id: alertId, cameraId, detectedAt: new Date(detectedAt), ...data },
+        update: data,
+      });
+      return c.json(saved);
+    } catch (error) {
+      return c.json({ error: 'Failed to save alert' }, 500);
+    }
+  });
+
+  // Presence event from the worker. started, updated and ended messages of one
+  // event share its ID and update the same alert.
+  alert.post('/events', validateBody(alertEventSchema), async (c: CustomContext) => {
+    try {
+      const userId = c.get('userId');
+      const { eventId, cameraId, startedAt, peakFaceCount, description, snapshotUrl, metadata, ...extra } = c.get('validatedBody') as AlertEventData;
+
+      const cam = await findCamera(cameraId, userId);
+      if (!cam) {
+        return c.json({ error: 'Camera not found' }, 404);
+      }
+      if (await conflictingAlert(eventId, cameraId)) {
+        return c.json({ error: 'Event belongs to another camera' }, 409);
+      }
+
+      const data = {
+        detectedFaces: peakFaceCount,
+        description: description || null,
+        metadata: { ...metadata, ...extra, eventId, startedAt, peakFaceCount } as any,
+      };
+      const saved = await db.alert.upsert({
+        where: { id: eventId },
+        create: { id: eventId, cameraId, detectedAt: new Date(startedAt), snapshotUrl: snapshotUrl || null, ...data },
+        // Keep the last snapshot when a message comes without one
+        update: { ...data, snapshotUrl: snapshotUrl || undefined },
+      });
+      return c.json(saved);
+    } catch (error) {
+      return c.json({ error: 'Failed to save event' }, 500);
+    }
+  });
+
+  return alert;
+};
+
+export default createAlertRoutes();
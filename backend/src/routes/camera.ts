@@ -4,6 +4,7 @@ import { prisma } from '../lib/prisma';
 import { cameraSchema, idSchema, type CameraData } from '../schemas/camera.schema'
 import { validateBody } from '../middleware/validation.middleware';
 import axios from 'axios';
+import { signWorkerJwt } from '../utils/jwt';
 
 type CustomContext = Context & {
   get(key: 'userId'): string;
@@ -14,6 +15,9 @@ const camera = new Hono();
 
 const WORKER_URL = process.env.WORKER_URL || 'http://localhost:8080';
 
+// Stream control on the worker needs a token once its routes are protected
+const workerAuth = () => ({ headers: { Authorization: `Bearer ${signWorkerJwt()}` } });
+
 // Get all cameras for user
 camera.get('/', async (c) => {
   const userId = (c.get as any)('userId');
@@ -91,7 +95,7 @@ camera.post('/:id/start', async (c) => {
       rtsp_url: cam.rtspUrl,
       location: cam.location ?? '',
       enabled: true,
-    });
+    }, workerAuth());
 
     const updated = await prisma.camera.update({
       where: { id },
@@ -119,7 +123,7 @@ camera.post('/:id/stop', async (c) => {
       return c.json({ error: 'Camera not found' }, 404);
     }
 
-    await axios.post(`${WORKER_URL}/stream/stop/${id}`);
+    await axios.post(`${WORKER_URL}/stream/stop/${id}`, undefined, workerAuth());
 
     const updated = await prisma.camera.update({
       where: { id },
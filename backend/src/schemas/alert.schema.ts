@@ -0,0 +1,50 @@
+import Joi from 'joi';
+
+export interface AlertData {
+  alertId: string;
+  cameraId: string;
+  detectedAt: string;
+  description?: string;
+  snapshotUrl?: string;
+  metadata?: Record<string, unknown>;
+  [key: string]: unknown;
+}
+
+export interface AlertEventData {
+  eventId: string;
+  status: 'started' | 'updated' | 'ended';
+  cameraId: string;
+  startedAt: string;
+  endedAt?: string;
+  durationSeconds: number;
+  faceCount: number;
+  peakFaceCount: number;
+  description?: string;
+  snapshotUrl?: string;
+  metadata?: Record<string, unknown>;
+  [key: string]: unknown;
+}
+
+// Extra fields from the worker (thumbnails, face crops, clips) are kept in metadata
+export const alertSchema = Joi.object({
+  alertId: Joi.string().required().guid(),
+  cameraId: Joi.string().required(),
+  detectedAt: Joi.date().iso().required(),
+  description: Joi.string().allow(''),
+  snapshotUrl: Joi.string().allow(''),
+  metadata: Joi.object().allow(null)
+}).unknown(true);
+
+export const alertEventSchema = Joi.object({
+  eventId: Joi.string().required().guid(),
+  status: Joi.string().required().valid('started', 'updated', 'ended'),
+  cameraId: Joi.string().required(),
+  startedAt: Joi.date().iso().required(),
+  endedAt: Joi.date().iso(),
+  durationSeconds: Joi.number().min(0).required(),
+  faceCount: Joi.number().integer().min(0).required(),
+  peakFaceCount: Joi.number().integer().min(0).required(),
+  description: Joi.string().allow(''),
+  snapshotUrl: Joi.string().allow(''),
+  metadata: Joi.object().allow(null)
+}).unknown(true);
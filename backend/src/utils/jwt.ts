@@ -3,6 +3,9 @@ import jwt from 'jsonwebtoken';
 const SECRET = process.env.JWT_SECRET || 'supersecret';
 
 export const signJwt = (payload: object) => jwt.sign(payload, SECRET, { expiresIn: '7d' });
+// Short-lived token for the worker's protected routes, which accept JWTs
+// signed with this secret (its backend_auth.jwt_secret) and aud "media"
+export const signWorkerJwt = () => jwt.sign({ sub: 'backend' }, SECRET, { audience: 'media', expiresIn: '5m' });
 export const verifyJwt = (token: string) => {
   try {
     return jwt.verify(token, SECRET) as any;
@@ -0,0 +1,105 @@
+import { test } from 'node:test';
+import assert from 'node:assert/strict';
+import { Hono } from 'hono';
+import { createAlertRoutes } from '../src/routes/alert';
+
+type Row = Record<string, any>;
+
+// fakeDb keeps cameras and alerts in memory, answering the queries the routes make
+const fakeDb = (cameras: Row[], alerts: Map<string, Row>) => ({
+  camera: {
+    findFirst: async ({ where }: Row) =>
+      cameras.find((cam) => cam.id === where.id && cam.userId === where.userId) ?? null,
+  },
+  alert: {
+    findUnique: async ({ where }: Row) => alerts.get(where.id) ?? null,
+    upsert: async ({ where, create, update }: Row) => {
+      const existing = alerts.get(where.id);
+      const saved = existing ? { ...existing, ...update } : create;
+      alerts.set(where.id, saved);
+      return saved;
+    },
+  },
+});
+
+const cameras = [
+  { id: 'cam-a', userId: 'alice' },
+  { id: 'cam-b', userId: 'alice' },
+  { id: 'cam-c', userId: 'bob' },
+];
+
+const appFor = (userId: string, alerts: Map<string, Row>) => {
+  const app = new Hono<{ Variables: { userId: string } }>();
+  app.use('*', async (c, next) => {
+    c.set('userId', userId);
+    await next();
+  });
+  app.route('/api/alerts', createAlertRoutes(fakeDb(cameras, alerts) as any));
+  return app;
+};
+
+const post = (app: Hono<any>, path: string, body: Row) =>
+  app.request(path, {
+    method: 'POST',
+    headers: { 'content-type': 'application/json' },
+    body: JSON.stringify(body),
+  });
+
+const alertId = '0b0c6a5e-58c4-4f8e-9a57-3d1f1c2b9a10';
+const pointAlert = (cameraId: string) => ({
+  alertId,
+  cameraId,
+  detectedAt: '2024-05-01T12:00:00Z',
+  description: 'Face detected',
+  metadata: { face_count: 2 },
+});
+const presenceEvent = (cameraId: string) => ({
+  eventId: alertId,
+  status: 'updated',
+  cameraId,
+  startedAt: '2024-05-01T12:00:00Z',
+  durationSeconds: 4,
+  faceCount: 1,
+  peakFaceCount: 2,
+});
+
+test('an alert for your own camera is saved', async () => {
+  const alerts = new Map<string, Row>();
+  const res = await post(appFor('alice', alerts), '/api/alerts', pointAlert('cam-a'));
+  assert.equal(res.status, 200);
+  assert.equal(alerts.get(alertId)?.cameraId, 'cam-a');
+  assert.equal(alerts.get(alertId)?.detectedFaces, 2);
+});
+
+test("an alert for another user's camera is refused", async () => {
+  const alerts = new Map<string, Row>();
+  for (const [path, body] of [
+    ['/api/alerts', pointAlert('cam-c')],
+    ['/api/alerts/events', presenceEvent('cam-c')],
+  ] as const) {
+    const res = await post(appFor('alice', alerts), path, body);
+    assert.equal(res.status, 404, path);
+  }
+  assert.equal(alerts.size, 0);
+});
+
+test('an update that moves an alert to another camera is refused', async () => {
+  for (const [path, body] of [
+    ['/api/alerts', pointAlert('cam-b')],
+    ['/api/alerts/events', presenceEvent('cam-b')],
+  ] as const) {
+    const stored = { id: alertId, cameraId: 'cam-a', detectedFaces: 1 };
+    const alerts = new Map<string, Row>([[alertId, stored]]);
+    const res = await post(appFor('alice', alerts), path, body);
+    assert.equal(res.status, 409, path);
+    assert.deepEqual(alerts.get(alertId), stored);
+  }
+});
+
+test('a repeated delivery updates the same alert', async () => {
+  const alerts = new Map<string, Row>([[alertId, { id: alertId, cameraId: 'cam-a', detectedFaces: 1 }]]);
+  const res = await post(appFor('alice', alerts), '/api/alerts/events', presenceEvent('cam-a'));
+  assert.equal(res.status, 200);
+  assert.equal(alerts.size, 1);
+  assert.equal(alerts.get(alertId)?.detectedFaces, 2);
+});
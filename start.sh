@@ -113,7 +113,7 @@ sleep 5
 # Start worker service
 echo "🤖 Starting worker service..."
 cd worker
-go run main.go &
+go run . &
 WORKER_PID=$!
 cd ..
 
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Rules that produce a snapshot, recorded in its sidecar
+const (
+	SnapshotRulePoint = "face_detected"
+	SnapshotRuleEvent = "face_presence"
+)
+
+// Archive layout: <camera>/<YYYY-MM-DD>/<HHMMSS>_<random>.<ext> in UTC. Related
+// files share the stem: _annotated.<ext>, _thumb.jpg, _alert.json, _face<N>.jpg, .mp4 and the .json sidecar.
+const archiveDateLayout = "2006-01-02"
+
+// SnapshotInfo is the JSON sidecar stored next to each snapshot
+type SnapshotInfo struct {
+	Key          string    `json:"key"`
+	URL          string    `json:"url,omitempty"`
+	CameraID     string    `json:"camera_id"`
+	CameraName   string    `json:"camera_name"`
+	CapturedAt   time.Time `json:"captured_at"`
+	AlertID      string    `json:"alert_id"`
+	Rule         string    `json:"rule"`
+	Detector     string    `json:"detector"`
+	Format       string    `json:"format"`
+	Variant      string    `json:"variant"`
+	AnnotatedKey string    `json:"annotated_key,omitempty"`
+	AnnotatedURL string    `json:"annotated_url,omitempty"`
+	Width        int       `json:"width"`
+	Height       int       `json:"height"`
+	Boxes        []FaceBox `json:"boxes"`
+	ThumbnailKey string    `json:"thumbnail_key,omitempty"`
+	ThumbnailURL string    `json:"thumbnail_url,omitempty"`
+	FaceCropKeys []string  `json:"face_crop_keys,omitempty"`
+	FaceCropURLs []string  `json:"face_crop_urls,omitempty"`
+}
+
+// newSnapshotBase returns a unique key stem for a snapshot taken at the given time
+func newSnapshotBase(cameraID string, at time.Time) string {
+	at = at.UTC()
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%s/%s/%s_%d", cameraID, at.Format(archiveDateLayout), at.Format("150405"), at.UnixNano())
+	}
+	return fmt.Sprintf("%s/%s/%s_%s", cameraID, at.Format(archiveDateLayout), at.Format("150405"), hex.EncodeToString(b))
+}
+
+// sidecarKey returns the key of the JSON sidecar of a snapshot
+func sidecarKey(snapshotKey string) string {
+	return snapshotBase(snapshotKey) + ".json"
+}
+
+// writeSidecar stores the metadata of a snapshot next to it
+func (sm *StreamManager) writeSidecar(info SnapshotInfo) error {
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = sm.store.Save(sidecarKey(info.Key), data, "application/json")
+	return err
+}
+
+// parseArchiveKey returns the camera and capture time encoded in a sidecar key
+func parseArchiveKey(key string) (string, time.Time, bool) {
+	// Alert records are JSON too but not sidecars
+	if path.Ext(key) != ".json" || snapshotBase(key) != strings.TrimSuffix(key, ".json") {
+		return "", time.Time{}, false
+	}
+	parts := strings.Split(key, "/")
+	if len(parts) != 3 {
+		return "", time.Time{}, false
+	}
+	stem := strings.TrimSuffix(parts[2], ".json")
+	if i := strings.Index(stem, "_"); i > 0 {
+		stem = stem[:i]
+	}
+	at, err := time.Parse(archiveDateLayout+"/150405", parts[1]+"/"+stem)
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	return parts[0], at, true
+}
+
+// archivePrefixes returns the storage prefixes that can hold snapshots of a
+// camera in [from, to], so a query doesn't list the whole store
+func archivePrefixes(camera string, from, to time.Time) []string {
+	if camera == "" {
+		return []string{""}
+	}
+	if from.IsZero() || to.IsZero() || to.Sub(from) > 31*24*time.Hour {
+		return []string{camera + "/"}
+	}
+
+	var prefixes []string
+	day := from.UTC().Truncate(24 * time.Hour)
+	for !day.After(to.UTC()) {
+		prefixes = append(prefixes, camera+"/"+day.Format(archiveDateLayout)+"/")
+		day = day.Add(24 * time.Hour)
+	}
+	return prefixes
+}
+
+// archiveEntry is a sidecar found in the archive
+type archiveEntry struct {
+	key string
+	at  time.Time
+}
+
+// findSidecars returns the sidecars of snapshots taken in [from, to], newest
+// first. An empty camera or zero times leave that filter open.
+func (sm *StreamManager) findSidecars(camera string, from, to time.Time) ([]archiveEntry, error) {
+	var entries []archiveEntry
+	for _, prefix := range archivePrefixes(camera, from, to) {
+		objects, err := sm.store.List(prefix)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range objects {
+			cam, at, ok := parseArchiveKey(obj.Key)
+			if !ok || (camera != "" && cam != camera) {
+				continue
+			}
+			// Keys have second precision
+			if (!from.IsZero() && at.Before(from.Truncate(time.Second))) || (!to.IsZero() && at.After(to)) {
+				continue
+			}
+			entries = append(entries, archiveEntry{key: obj.Key, at: at})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if !entries[i].at.Equal(entries[j].at) {
+			return entries[i].at.After(entries[j].at)
+		}
+		return entries[i].key > entries[j].key
+	})
+	return entries, nil
+}
+
+// loadSidecar reads and parses a sidecar
+func (sm *StreamManager) loadSidecar(key string) (*SnapshotInfo, error) {
+	data, err := sm.store.Load(key)
+	if err != nil {
+		return nil, err
+	}
+	var info SnapshotInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// alertRecordKey returns the key of the alert or event JSON stored with a snapshot
+func alertRecordKey(snapshotKey string) string {
+	return snapshotBase(snapshotKey) + "_alert.json"
+}
+
+// saveAlertRecord stores the alert or event message that references a
+// snapshot next to it, so exports can include what was sent to the backend
+func (sm *StreamManager) saveAlertRecord(snap *Snapshot, record interface{}) {
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		log.Printf("Failed to encode alert record for %s: %v", snap.Key, err)
+		return
+	}
+	if _, err := sm.store.Save(alertRecordKey(snap.Key), data, "application/json"); err != nil {
+		log.Printf("Failed to store alert record for %s: %v", snap.Key, err)
+	}
+}
+
+// handleListSnapshots lists archived snapshots, newest first, filtered by
+// camera and time range: GET /archive/snapshots?camera=&from=&to=&limit=&offset=
+func (sm *StreamManager) handleListSnapshots(c *gin.Context) {
+	camera := c.Query("camera")
+
+	var from, to time.Time
+	if v := c.Query("from"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "from must be an RFC 3339 time"})
+			return
+		}
+		from = t
+	}
+	if v := c.Query("to"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "to must be an RFC 3339 time"})
+			return
+		}
+		to = t
+	}
+
+	limit := 50
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be a positive number"})
+			return
+		}
+		if n > 500 {
+			n = 500
+		}
+		limit = n
+	}
+	offset := 0
+	if v := c.Query("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "offset must be zero or more"})
+			return
+		}
+		offset = n
+	}
+
+	entries, err := sm.findSidecars(camera, from, to)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	total := len(entries)
+	if offset > total {
+		offset = total
+	}
+	end := offset + limit
+	if end > total {
+		end = total
+	}
+
+	items := make([]SnapshotInfo, 0, end-offset)
+	for _, e := range entries[offset:end] {
+		info, err := sm.loadSidecar(e.key)
+		if err != nil {
+			log.Printf("Skipping sidecar %s: %v", e.key, err)
+			continue
+		}
+		sm.fillSnapshotURLs(info)
+		items = append(items, *info)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"total":  total,
+		"offset": offset,
+		"limit":  limit,
+		"items":  items,
+	})
+}
+
+// fillSnapshotURLs sets the URLs of a sidecar from its keys. URLs are not
+// stored because presigned ones expire.
+func (sm *StreamManager) fillSnapshotURLs(info *SnapshotInfo) {
+	info.URL, _ = sm.store.URL(info.Key)
+	if info.AnnotatedKey != "" {
+		info.AnnotatedURL, _ = sm.store.URL(info.AnnotatedKey)
+	}
+	if info.ThumbnailKey != "" {
+		info.ThumbnailURL, _ = sm.store.URL(info.ThumbnailKey)
+	}
+	info.FaceCropURLs = nil
+	for _, key := range info.FaceCropKeys {
+		u, _ := sm.store.URL(key)
+		info.FaceCropURLs = append(info.FaceCropURLs, u)
+	}
+}
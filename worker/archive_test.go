@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestParseArchiveKey(t *testing.T) {
+	tests := []struct {
+		key    string
+		camera string
+		at     time.Time
+		ok     bool
+	}{
+		{"cam-1/2024-05-01/143000_ab12.json", "cam-1", time.Date(2024, 5, 1, 14, 30, 0, 0, time.UTC), true},
+		{"cam-1/2024-05-01/235959_1714607999000000000.json", "cam-1", time.Date(2024, 5, 1, 23, 59, 59, 0, time.UTC), true},
+		// Alert records and media are not sidecars
+		{"cam-1/2024-05-01/143000_ab12_alert.json", "", time.Time{}, false},
+		{"cam-1/2024-05-01/143000_ab12.jpg", "", time.Time{}, false},
+		{"cam-1/143000_ab12.json", "", time.Time{}, false},
+		{"cam-1/2024-13-01/143000_ab12.json", "", time.Time{}, false},
+		{"cam-1/2024-05-01/noon_ab12.json", "", time.Time{}, false},
+	}
+	for _, tt := range tests {
+		camera, at, ok := parseArchiveKey(tt.key)
+		if camera != tt.camera || !at.Equal(tt.at) || ok != tt.ok {
+			t.Errorf("parseArchiveKey(%q) = %q, %v, %v; want %q, %v, %v", tt.key, camera, at, ok, tt.camera, tt.at, tt.ok)
+		}
+	}
+}
+
+func TestHandleListSnapshots(t *testing.T) {
+	store, err := NewLocalStore(t.TempDir(), "http://worker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm := &StreamManager{store: store}
+	for _, key := range []string{
+		"cam-1/2024-05-01/090000_a.jpg",
+		"cam-1/2024-05-01/120000_b.jpg",
+		"cam-1/2024-05-02/080000_c.jpg",
+		"cam-2/2024-05-01/100000_d.jpg",
+	} {
+		info := SnapshotInfo{Key: key, CameraID: key[:5], ThumbnailKey: snapshotBase(key) + "_thumb.jpg"}
+		if err := sm.writeSidecar(info); err != nil {
+			t.Fatal(err)
+		}
+		// Media next to the sidecars must not be listed
+		if _, err := store.Save(key, []byte("jpeg"), "image/jpeg"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A sidecar that can't be parsed still counts but is skipped
+	if _, err := store.Save("cam-2/2024-05-03/070000_e.json", []byte("{"), "application/json"); err != nil {
+		t.Fatal(err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/archive/snapshots", sm.handleListSnapshots)
+
+	tests := []struct {
+		query  string
+		status int
+		total  int
+		keys   []string
+	}{
+		{"", http.StatusOK, 5, []string{"cam-1/2024-05-02/080000_c.jpg", "cam-1/2024-05-01/120000_b.jpg", "cam-2/2024-05-01/100000_d.jpg", "cam-1/2024-05-01/090000_a.jpg"}},
+		{"?camera=cam-1", http.StatusOK, 3, []string{"cam-1/2024-05-02/080000_c.jpg", "cam-1/2024-05-01/120000_b.jpg", "cam-1/2024-05-01/090000_a.jpg"}},
+		{"?camera=cam-1&limit=1&offset=1", http.StatusOK, 3, []string{"cam-1/2024-05-01/120000_b.jpg"}},
+		{"?camera=cam-1&offset=10", http.StatusOK, 3, []string{}},
+		{"?camera=cam-1&from=2024-05-01T10:00:00Z&to=2024-05-02T08:00:00Z", http.StatusOK, 2, []string{"cam-1/2024-05-02/080000_c.jpg", "cam-1/2024-05-01/120000_b.jpg"}},
+		{"?from=2024-05-01T09:30:00Z&to=2024-05-01T12:00:00Z", http.StatusOK, 2, []string{"cam-1/2024-05-01/120000_b.jpg", "cam-2/2024-05-01/100000_d.jpg"}},
+		{"?from=yesterday", http.StatusBadRequest, 0, nil},
+		{"?limit=0", http.StatusBadRequest, 0, nil},
+		{"?offset=-1", http.StatusBadRequest, 0, nil},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/archive/snapshots"+tt.query, nil))
+		if w.Code != tt.status {
+			t.Errorf("GET %s: status %d, want %d", tt.query, w.Code, tt.status)
+			continue
+		}
+		if tt.status != http.StatusOK {
+			continue
+		}
+		var resp struct {
+			Total int            `json:"total"`
+			Items []SnapshotInfo `json:"items"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("GET %s: %v", tt.query, err)
+		}
+		keys := []string{}
+		for _, item := range resp.Items {
+			keys = append(keys, item.Key)
+			if want := "http://worker/snapshots/" + item.Key; item.URL != want {
+				t.Errorf("GET %s: url %q, want %q", tt.query, item.URL, want)
+			}
+			if want := "http://worker/snapshots/" + item.ThumbnailKey; item.ThumbnailURL != want {
+				t.Errorf("GET %s: thumbnail_url %q, want %q", tt.query, item.ThumbnailURL, want)
+			}
+		}
+		if resp.Total != tt.total || !reflect.DeepEqual(keys, tt.keys) {
+			t.Errorf("GET %s = %d %v, want %d %v", tt.query, resp.Total, keys, tt.total, tt.keys)
+		}
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-resty/resty/v2"
+)
+
+// Backend authentication modes. The backend only accepts JWTs carrying a
+// userId, so BackendAuthToken is recognised only to be rejected.
+const (
+	BackendAuthNone  = "none"
+	BackendAuthToken = "token"
+	BackendAuthJWT   = "jwt"
+)
+
+// defaultServiceUser is the sub claim of the worker's JWTs
+const defaultServiceUser = "face-detection-worker"
+
+// errBackendAuth marks delivery failures caused by service credentials
+var errBackendAuth = errors.New("backend authentication failed")
+
+// BackendAuthConfig configures how the worker authenticates to the backend
+type BackendAuthConfig struct {
+	Mode          string                 `yaml:"mode"`
+	Token         string                 `yaml:"token"` // unsupported by the backend, rejected at startup
+	JWTSecret     string                 `yaml:"jwt_secret"`
+	JWTTTLSeconds int                    `yaml:"jwt_ttl_seconds"`
+	JWTClaims     map[string]interface{} `yaml:"jwt_claims"`
+	UserID        string                 `yaml:"user_id"` // userId claim: the backend user who owns the cameras
+	ClientCert    string                 `yaml:"client_cert"`
+	ClientKey     string                 `yaml:"client_key"`
+	CAFile        string                 `yaml:"ca_file"`
+}
+
+// serviceCredentials produces the Authorization header for backend requests,
+// re-signing the JWT before it expires
+type serviceCredentials struct {
+	config  BackendAuthConfig
+	token   string
+	expires time.Time
+	mutex   sync.Mutex
+}
+
+// header returns the Authorization header value, or "" when auth is disabled
+func (c *serviceCredentials) header() (string, error) {
+	switch c.config.Mode {
+	case BackendAuthJWT:
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+
+		ttl := time.Duration(c.config.JWTTTLSeconds) * time.Second
+		if c.token == "" || time.Until(c.expires) < ttl/10 {
+			now := time.Now()
+			token, err := signJWT(c.config.JWTSecret, c.config.JWTClaims, now, now.Add(ttl))
+			if err != nil {
+				return "", err
+			}
+			c.token = token
+			c.expires = now.Add(ttl)
+		}
+		return "Bearer " + c.token, nil
+	default:
+		return "", nil
+	}
+}
+
+// invalidate forces a new JWT on the next request, e.g. after the backend rejected it
+func (c *serviceCredentials) invalidate() {
+	c.mutex.Lock()
+	c.token = ""
+	c.mutex.Unlock()
+}
+
+// signJWT creates an HS256 token with the given claims plus iat and exp
+func signJWT(secret string, claims map[string]interface{}, issuedAt, expires time.Time) (string, error) {
+	payload := make(map[string]interface{}, len(claims)+2)
+	for k, v := range claims {
+		payload[k] = v
+	}
+	payload["iat"] = issuedAt.Unix()
+	payload["exp"] = expires.Unix()
+
+	header, err := json.Marshal(map[string]string{"alg": "HS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode JWT claims: %v", err)
+	}
+
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString(header) + "." + enc.EncodeToString(body)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + enc.EncodeToString(mac.Sum(nil)), nil
+}
+
+// newBackendClient creates the resty client used for every backend call,
+// with service credentials and optional mutual TLS
+func newBackendClient(config Config) (*resty.Client, *serviceCredentials, error) {
+	auth := config.BackendAuth
+	if auth.Mode == "" {
+		switch {
+		case auth.Token != "":
+			auth.Mode = BackendAuthToken
+		case auth.JWTSecret != "":
+			auth.Mode = BackendAuthJWT
+		default:
+			auth.Mode = BackendAuthNone
+		}
+	}
+
+	switch auth.Mode {
+	case BackendAuthNone:
+	case BackendAuthToken:
+		// The backend's auth middleware verifies a JWT and reads userId from it,
+		// so a static token would be rejected on every delivery
+		return nil, nil, fmt.Errorf("backend auth mode %q is not supported by the backend, use %q with jwt_secret and user_id", auth.Mode, BackendAuthJWT)
+	case BackendAuthJWT:
+		if auth.JWTSecret == "" {
+			return nil, nil, fmt.Errorf("backend auth mode %q requires a jwt_secret", auth.Mode)
+		}
+		if auth.JWTTTLSeconds <= 0 {
+			auth.JWTTTLSeconds = 3600
+		}
+		claims := map[string]interface{}{"sub": defaultServiceUser, "role": "service"}
+		if len(auth.JWTClaims) > 0 {
+			claims = make(map[string]interface{}, len(auth.JWTClaims)+1)
+			for k, v := range auth.JWTClaims {
+				claims[k] = v
+			}
+		}
+		// The backend takes the caller from userId and only shows it the
+		// cameras that user owns, so it must be a real user ID
+		if _, ok := claims["userId"]; !ok {
+			if auth.UserID == "" {
+				return nil, nil, fmt.Errorf("backend auth mode %q requires user_id, the backend user who owns the cameras", auth.Mode)
+			}
+			claims["userId"] = auth.UserID
+		}
+		// A media audience would let the service token fetch media
+		if hasAudience(claims["aud"], mediaAudience) {
+			return nil, nil, fmt.Errorf("backend_auth.jwt_claims must not set aud %q", mediaAudience)
+		}
+		auth.JWTClaims = claims
+	default:
+		return nil, nil, fmt.Errorf("unknown backend auth mode %q", auth.Mode)
+	}
+
+	client := resty.New()
+	client.SetBaseURL(config.BackendURL)
+	client.SetTimeout(30 * time.Second)
+
+	tlsConfig, err := backendTLSConfig(auth)
+	if err != nil {
+		return nil, nil, err
+	}
+	if tlsConfig != nil {
+		client.SetTLSClientConfig(tlsConfig)
+	}
+
+	creds := &serviceCredentials{config: auth}
+	client.OnBeforeRequest(func(_ *resty.Client, req *resty.Request) error {
+		header, err := creds.header()
+		if err != nil {
+			return fmt.Errorf("%w: %v", errBackendAuth, err)
+		}
+		if header != "" {
+			req.SetHeader("Authorization", header)
+		}
+		return nil
+	})
+
+	log.Printf("Backend client configured: auth=%s, client_cert=%t, ca_file=%t", auth.Mode, auth.ClientCert != "", auth.CAFile != "")
+	return client, creds, nil
+}
+
+// backendTLSConfig loads the client certificate and CA bundle, if configured
+func backendTLSConfig(auth BackendAuthConfig) (*tls.Config, error) {
+	if auth.ClientCert == "" && auth.CAFile == "" {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if auth.ClientCert != "" {
+		if auth.ClientKey == "" {
+			return nil, fmt.Errorf("client_key is required with client_cert")
+		}
+		cert, err := tls.LoadX509KeyPair(auth.ClientCert, auth.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if auth.CAFile != "" {
+		pem, err := os.ReadFile(auth.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle %s: %v", auth.CAFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", auth.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	return tlsConfig, nil
+}
+
+// deliveryStats tracks the outcome of backend deliveries
+type deliveryStats struct {
+	Sent            int64      `json:"sent"`
+	Failed          int64      `json:"failed"`
+	AuthFailures    int64      `json:"auth_failures"`
+	LastSuccessAt   *time.Time `json:"last_success_at,omitempty"`
+	LastError       string     `json:"last_error,omitempty"`
+	LastErrorAt     *time.Time `json:"last_error_at,omitempty"`
+	LastAuthError   string     `json:"last_auth_error,omitempty"`
+	LastAuthErrorAt *time.Time `json:"last_auth_error_at,omitempty"`
+	mutex           sync.Mutex
+}
+
+// post sends a JSON body to the backend and records the outcome. kind is
+// used in logs and metrics ("alert", "event", ...).
+func (sm *StreamManager) post(kind, path string, body interface{}) error {
+	resp, err := sm.client.R().
+		SetHeader("Content-Type", "application/json").
+		SetBody(body).
+		Post(path)
+
+	if err != nil {
+		if errors.Is(err, errBackendAuth) {
+			return sm.recordDelivery(kind, err, true)
+		}
+		return sm.recordDelivery(kind, fmt.Errorf("failed to send HTTP request: %v", err), false)
+	}
+
+	switch resp.StatusCode() {
+	case http.StatusOK, http.StatusCreated:
+		return sm.recordDelivery(kind, nil, false)
+	case http.StatusUnauthorized, http.StatusForbidden:
+		sm.credentials.invalidate()
+		err := fmt.Errorf("%w: API returned status %d: %s", errBackendAuth, resp.StatusCode(), resp.String())
+		return sm.recordDelivery(kind, err, true)
+	default:
+		return sm.recordDelivery(kind, fmt.Errorf("API returned status %d: %s", resp.StatusCode(), resp.String()), false)
+	}
+}
+
+// recordDelivery updates delivery stats and metrics and returns err unchanged
+func (sm *StreamManager) recordDelivery(kind string, err error, authFailure bool) error {
+	now := time.Now()
+	stats := sm.delivery
+
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+
+	switch {
+	case err == nil:
+		stats.Sent++
+		stats.LastSuccessAt = &now
+		sm.metrics.Inc("worker_backend_requests_total", "kind", kind, "result", "ok")
+	case authFailure:
+		stats.Failed++
+		stats.AuthFailures++
+		stats.LastAuthError = err.Error()
+		stats.LastAuthErrorAt = &now
+		stats.LastError = err.Error()
+		stats.LastErrorAt = &now
+		sm.metrics.Inc("worker_backend_requests_total", "kind", kind, "result", "auth_error")
+		log.Printf("Backend rejected worker credentials for %s: %v", kind, err)
+	default:
+		stats.Failed++
+		stats.LastError = err.Error()
+		stats.LastErrorAt = &now
+		sm.metrics.Inc("worker_backend_requests_total", "kind", kind, "result", "error")
+	}
+
+	return err
+}
+
+// handleBackendStatus reports the backend auth mode and delivery stats
+func (sm *StreamManager) handleBackendStatus(c *gin.Context) {
+	stats := sm.delivery
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+
+	c.JSON(http.StatusOK, gin.H{
+		"backend_url": sm.config.BackendURL,
+		"auth_mode":   sm.credentials.config.Mode,
+		"delivery":    stats,
+	})
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignVerifyJWT(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	token, err := signJWT("secret", map[string]interface{}{"sub": "worker"}, now, now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(token, ".")
+	tampered := parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"admin"}`)) + "." + parts[2]
+	none := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." + parts[1] + "."
+
+	tests := []struct {
+		name   string
+		secret string
+		token  string
+		now    time.Time
+		ok     bool
+	}{
+		{"valid", "secret", token, now, true},
+		{"just before expiry", "secret", token, now.Add(time.Hour - time.Second), true},
+		{"expired", "secret", token, now.Add(time.Hour), false},
+		{"wrong secret", "other", token, now, false},
+		{"tampered claims", "secret", tampered, now, false},
+		{"alg none", "secret", none, now, false},
+		{"malformed", "secret", "abc.def", now, false},
+	}
+	for _, tt := range tests {
+		err := verifyJWT(tt.secret, tt.token, tt.now, "")
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: verifyJWT() = %v, want ok=%v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestBackendJWTClaims(t *testing.T) {
+	tests := []struct {
+		name   string
+		auth   BackendAuthConfig
+		claims map[string]interface{}
+	}{
+		{
+			"user_id",
+			BackendAuthConfig{Mode: BackendAuthJWT, JWTSecret: "secret", UserID: "svc-42"},
+			map[string]interface{}{"sub": defaultServiceUser, "role": "service", "userId": "svc-42"},
+		},
+		{
+			"custom claims keep their userId",
+			BackendAuthConfig{Mode: BackendAuthJWT, JWTSecret: "secret", UserID: "svc-42", JWTClaims: map[string]interface{}{"userId": "from-claims", "tenant": "a"}},
+			map[string]interface{}{"userId": "from-claims", "tenant": "a"},
+		},
+	}
+	for _, tt := range tests {
+		_, creds, err := newBackendClient(Config{BackendURL: "http://backend", BackendAuth: tt.auth})
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		header, err := creds.header()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		token := strings.TrimPrefix(header, "Bearer ")
+		if err := verifyJWT("secret", token, time.Now(), ""); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		body, _ := base64.RawURLEncoding.DecodeString(strings.Split(token, ".")[1])
+		var got map[string]interface{}
+		if err := json.Unmarshal(body, &got); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		delete(got, "iat")
+		delete(got, "exp")
+		if len(got) != len(tt.claims) {
+			t.Errorf("%s: claims %v, want %v", tt.name, got, tt.claims)
+			continue
+		}
+		for k, v := range tt.claims {
+			if got[k] != v {
+				t.Errorf("%s: claim %s = %v, want %v", tt.name, k, got[k], v)
+			}
+		}
+	}
+}
+
+func TestBackendAuthConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		auth BackendAuthConfig
+		mode string
+		ok   bool
+	}{
+		{"no credentials", BackendAuthConfig{}, BackendAuthNone, true},
+		{"inferred jwt", BackendAuthConfig{JWTSecret: "secret", UserID: "user-1"}, BackendAuthJWT, true},
+		{"userId from jwt_claims", BackendAuthConfig{Mode: BackendAuthJWT, JWTSecret: "secret", JWTClaims: map[string]interface{}{"userId": "user-1"}}, BackendAuthJWT, true},
+		// The backend scopes cameras to userId, so there is no default
+		{"jwt without user_id", BackendAuthConfig{Mode: BackendAuthJWT, JWTSecret: "secret"}, "", false},
+		{"jwt without secret", BackendAuthConfig{Mode: BackendAuthJWT, UserID: "user-1"}, "", false},
+		// The backend only accepts JWTs
+		{"static token", BackendAuthConfig{Mode: BackendAuthToken, Token: "t"}, "", false},
+		{"inferred static token", BackendAuthConfig{Token: "t"}, "", false},
+		{"unknown mode", BackendAuthConfig{Mode: "basic"}, "", false},
+		// The service token must not open media routes
+		{"media audience", BackendAuthConfig{JWTSecret: "secret", UserID: "user-1", JWTClaims: map[string]interface{}{"aud": mediaAudience}}, "", false},
+	}
+	for _, tt := range tests {
+		_, creds, err := newBackendClient(Config{BackendURL: "http://backend", BackendAuth: tt.auth})
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: newBackendClient() error = %v, want ok=%v", tt.name, err, tt.ok)
+			continue
+		}
+		if tt.ok && creds.config.Mode != tt.mode {
+			t.Errorf("%s: mode %q, want %q", tt.name, creds.config.Mode, tt.mode)
+		}
+	}
+}
+
+func TestPostInvalidatesRejectedToken(t *testing.T) {
+	tests := []struct {
+		status      int
+		ok          bool
+		authFailure bool
+	}{
+		{http.StatusOK, true, false},
+		{http.StatusCreated, true, false},
+		{http.StatusUnauthorized, false, true},
+		{http.StatusForbidden, false, true},
+		{http.StatusInternalServerError, false, false},
+	}
+	for _, tt := range tests {
+		var tokens []string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tokens = append(tokens, r.Header.Get("Authorization"))
+			w.WriteHeader(tt.status)
+		}))
+
+		client, creds, err := newBackendClient(Config{BackendURL: server.URL, BackendAuth: BackendAuthConfig{Mode: BackendAuthJWT, JWTSecret: "secret", UserID: "user-1"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sm := &StreamManager{client: client, credentials: creds, delivery: &deliveryStats{}, metrics: NewMetrics()}
+
+		err = sm.post("alert", "/api/alerts", map[string]string{"alertId": "a"})
+		server.Close()
+		if (err == nil) != tt.ok {
+			t.Errorf("status %d: post() = %v, want ok=%v", tt.status, err, tt.ok)
+		}
+		if errors.Is(err, errBackendAuth) != tt.authFailure {
+			t.Errorf("status %d: auth failure = %v, want %v", tt.status, errors.Is(err, errBackendAuth), tt.authFailure)
+		}
+		if len(tokens) != 1 || !strings.HasPrefix(tokens[0], "Bearer ") {
+			t.Errorf("status %d: sent Authorization %q", tt.status, tokens)
+		}
+		// A rejected token is signed again for the next request
+		if invalidated := creds.token == ""; invalidated != tt.authFailure {
+			t.Errorf("status %d: token invalidated = %v, want %v", tt.status, invalidated, tt.authFailure)
+		}
+		if tt.authFailure && sm.delivery.AuthFailures != 1 {
+			t.Errorf("status %d: %d auth failures recorded", tt.status, sm.delivery.AuthFailures)
+		}
+		if tt.ok && sm.delivery.Sent != 1 {
+			t.Errorf("status %d: %d deliveries recorded", tt.status, sm.delivery.Sent)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ClipConfig controls pre/post-event clip recording. It is set globally in
+// config.yaml and can be overridden per camera in the start request.
+type ClipConfig struct {
+	Enabled     bool `yaml:"enabled" json:"enabled"`
+	PreSeconds  int  `yaml:"pre_seconds" json:"pre_seconds"`
+	PostSeconds int  `yaml:"post_seconds" json:"post_seconds"`
+	MaxSeconds  int  `yaml:"max_seconds" json:"max_seconds"`
+}
+
+// bufferedFrame is a JPEG-encoded frame with its capture time
+type bufferedFrame struct {
+	at   time.Time
+	jpeg []byte
+}
+
+// clipRecording collects frames for one clip until its end time passes
+type clipRecording struct {
+	cameraID string
+	store    SnapshotStore
+	key      string
+	url      string
+	start    time.Time
+	until    time.Time
+	frames   []bufferedFrame
+}
+
+// FrameRing keeps the last few seconds of a stream's frames and feeds
+// recordings that are waiting for post-event frames
+type FrameRing struct {
+	config     ClipConfig
+	frames     []bufferedFrame
+	recordings []*clipRecording
+	mutex      sync.Mutex
+}
+
+// NewFrameRing creates a ring buffer for the given clip settings
+func NewFrameRing(config ClipConfig) *FrameRing {
+	return &FrameRing{config: config}
+}
+
+// Push adds a frame, drops frames older than the pre-event window and
+// finishes recordings whose post-event window has passed
+func (r *FrameRing) Push(at time.Time, jpeg []byte) {
+	frame := bufferedFrame{at: at, jpeg: jpeg}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.frames = append(r.frames, frame)
+	cutoff := at.Add(-time.Duration(r.config.PreSeconds) * time.Second)
+	drop := 0
+	for drop < len(r.frames) && r.frames[drop].at.Before(cutoff) {
+		drop++
+	}
+	if drop > 0 {
+		r.frames = append(r.frames[:0:0], r.frames[drop:]...)
+	}
+
+	active := r.recordings[:0]
+	for _, rec := range r.recordings {
+		if at.After(rec.until) {
+			go rec.encode()
+			continue
+		}
+		rec.frames = append(rec.frames, frame)
+		active = append(active, rec)
+	}
+	r.recordings = active
+}
+
+// StartClip begins a clip for an event at the given time and returns its URL.
+// If a clip is already recording, it is extended instead (up to the maximum
+// clip length) and its URL is returned.
+func (r *FrameRing) StartClip(cameraID string, at time.Time, store SnapshotStore, key, url string) string {
+	post := time.Duration(r.config.PostSeconds) * time.Second
+	max := time.Duration(r.config.MaxSeconds) * time.Second
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	// Extend the clip in progress if it can still cover this event
+	if n := len(r.recordings); n > 0 {
+		rec := r.recordings[n-1]
+		until := at.Add(post)
+		if max > 0 && until.Sub(rec.start) > max {
+			until = rec.start.Add(max)
+		}
+		if !until.Before(at) {
+			if until.After(rec.until) {
+				rec.until = until
+			}
+			return rec.url
+		}
+	}
+
+	rec := &clipRecording{
+		cameraID: cameraID,
+		store:    store,
+		key:      key,
+		url:      url,
+		until:    at.Add(post),
+		frames:   append([]bufferedFrame(nil), r.frames...),
+	}
+	rec.start = at
+	if len(rec.frames) > 0 {
+		rec.start = rec.frames[0].at
+	}
+	if max > 0 && rec.until.Sub(rec.start) > max {
+		rec.until = rec.start.Add(max)
+	}
+
+	r.recordings = append(r.recordings, rec)
+	return rec.url
+}
+
+// Flush encodes recordings that are still collecting frames, e.g. when the
+// stream stops before the post-event window has passed
+func (r *FrameRing) Flush() {
+	r.mutex.Lock()
+	recordings := r.recordings
+	r.recordings = nil
+	r.mutex.Unlock()
+
+	for _, rec := range recordings {
+		go rec.encode()
+	}
+}
+
+// encode writes the collected frames to an MP4 file with ffmpeg and moves it into the store
+func (rec *clipRecording) encode() {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Panic in clip encode for camera %s: %v", rec.cameraID, r)
+		}
+	}()
+
+	if len(rec.frames) < 2 {
+		log.Printf("Not enough frames for clip %s (camera %s)", rec.key, rec.cameraID)
+		return
+	}
+
+	tmp, err := os.CreateTemp("", "clip-*.mp4")
+	if err != nil {
+		log.Printf("Failed to create temporary clip file for camera %s: %v", rec.cameraID, err)
+		return
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	// Use the measured frame rate so the clip plays back in real time
+	span := rec.frames[len(rec.frames)-1].at.Sub(rec.frames[0].at).Seconds()
+	fps := 25.0
+	if span > 0 {
+		fps = float64(len(rec.frames)-1) / span
+	}
+
+	args := []string{
+		"-y",
+		"-f", "image2pipe",
+		"-c:v", "mjpeg",
+		"-framerate", fmt.Sprintf("%.3f", fps),
+		"-i", "-",
+		"-c:v", "libx264",
+		"-preset", "veryfast",
+		"-pix_fmt", "yuv420p",
+		"-movflags", "+faststart",
+		tmp.Name(),
+	}
+
+	cmd := exec.Command("ffmpeg", args...)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		log.Printf("Failed to get ffmpeg stdin for clip of camera %s: %v", rec.cameraID, err)
+		return
+	}
+	if err := cmd.Start(); err != nil {
+		stdin.Close()
+		log.Printf("Failed to start ffmpeg for clip of camera %s: %v", rec.cameraID, err)
+		return
+	}
+
+	for _, frame := range rec.frames {
+		if _, err := stdin.Write(frame.jpeg); err != nil {
+			log.Printf("Failed to write clip frame for camera %s: %v", rec.cameraID, err)
+			break
+		}
+	}
+	stdin.Close()
+
+	if err := cmd.Wait(); err != nil {
+		log.Printf("ffmpeg failed for clip %s (camera %s): %v: %s", rec.key, rec.cameraID, err, lastLine(stderr.String()))
+		return
+	}
+
+	if _, err := rec.store.SaveFile(rec.key, tmp.Name(), "video/mp4"); err != nil {
+		log.Printf("Failed to store clip %s for camera %s: %v", rec.key, rec.cameraID, err)
+		return
+	}
+
+	log.Printf("Saved clip %s for camera %s (%d frames, %.1fs)", rec.key, rec.cameraID, len(rec.frames), span)
+}
+
+// clipConfig returns the clip settings for a camera: the global settings with
+// the durations the camera sets
+func (sm *StreamManager) clipConfig(camera Camera) ClipConfig {
+	config := sm.config.Clips
+	if camera.Clip != nil {
+		config.Enabled = camera.Clip.Enabled
+		if camera.Clip.PreSeconds > 0 {
+			config.PreSeconds = camera.Clip.PreSeconds
+		}
+		if camera.Clip.PostSeconds > 0 {
+			config.PostSeconds = camera.Clip.PostSeconds
+		}
+		if camera.Clip.MaxSeconds > 0 {
+			config.MaxSeconds = camera.Clip.MaxSeconds
+		}
+	}
+	if config.MaxSeconds > 0 && config.PreSeconds > config.MaxSeconds {
+		config.PreSeconds = config.MaxSeconds
+	}
+	return config
+}
+
+// startClip starts a clip for an alert whose snapshot is stored under
+// snapshotKey and returns the clip URL. The clip is stored next to the
+// snapshot once the post-event frames have been collected.
+func (sm *StreamManager) startClip(stream *CameraStream, at time.Time, snapshotKey string) string {
+	if stream.ring == nil || snapshotKey == "" {
+		return ""
+	}
+
+	key := snapshotBase(snapshotKey) + ".mp4"
+	url, err := sm.store.URL(key)
+	if err != nil {
+		log.Printf("Failed to get clip URL for camera %s: %v", stream.Camera.ID, err)
+		return ""
+	}
+
+	return stream.ring.StartClip(stream.Camera.ID, at, sm.store, key, url)
+}
+
+// lastLine returns the last non-empty line of s
+func lastLine(s string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
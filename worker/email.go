@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/smtp"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EmailConfig holds the SMTP notifier configuration
+type EmailConfig struct {
+	Enabled            bool                `yaml:"enabled"`
+	Host               string              `yaml:"host"`
+	Port               int                 `yaml:"port"`
+	Username           string              `yaml:"username"`
+	Password           string              `yaml:"password"`
+	From               string              `yaml:"from"`
+	To                 []string            `yaml:"to"`
+	CameraRecipients   map[string][]string `yaml:"camera_recipients"`
+	StartTLS           bool                `yaml:"starttls"`
+	GroupWindowSeconds int                 `yaml:"group_window_seconds"`
+	MaxPerHour         int                 `yaml:"max_per_hour"`
+	MaxAttachments     int                 `yaml:"max_attachments"`
+}
+
+// SMTP timeouts, so a server that stops answering can't hold up later alerts
+var (
+	smtpDialTimeout = 10 * time.Second
+	smtpTimeout     = 2 * time.Minute
+)
+
+// emailGroup collects the alerts of one camera until its window closes
+type emailGroup struct {
+	cameraName string
+	alerts     []Alert
+	timer      *time.Timer
+}
+
+// EmailNotifier emails alerts with their snapshots attached
+type EmailNotifier struct {
+	config  EmailConfig
+	store   SnapshotStore
+	metrics *Metrics
+	groups  map[string]*emailGroup
+	sent    []time.Time
+	mutex   sync.Mutex
+}
+
+// NewEmailNotifier creates an SMTP notifier from the email configuration
+func NewEmailNotifier(config EmailConfig, store SnapshotStore, metrics *Metrics) (*EmailNotifier, error) {
+	if config.Host == "" {
+		return nil, fmt.Errorf("SMTP host is required")
+	}
+	if config.From == "" {
+		return nil, fmt.Errorf("sender address is required")
+	}
+	// net/smtp refuses to send credentials over an unencrypted connection,
+	// except to localhost
+	if config.Username != "" && !config.StartTLS && !isLocalhost(config.Host) {
+		return nil, fmt.Errorf("SMTP credentials need starttls: true (plain SMTP only works without a username, or to localhost)")
+	}
+	if config.Port == 0 {
+		config.Port = 587
+	}
+	if config.MaxAttachments <= 0 {
+		config.MaxAttachments = 5
+	}
+
+	return &EmailNotifier{
+		config:  config,
+		store:   store,
+		metrics: metrics,
+		groups:  make(map[string]*emailGroup),
+	}, nil
+}
+
+// isLocalhost reports whether net/smtp treats a host as local
+func isLocalhost(host string) bool {
+	return host == "localhost" || host == "127.0.0.1" || host == "::1"
+}
+
+// recipients returns the recipient list for a camera, falling back to the default list
+func (n *EmailNotifier) recipients(cameraID string) []string {
+	if to, ok := n.config.CameraRecipients[cameraID]; ok {
+		return to
+	}
+	return n.config.To
+}
+
+// Notify queues an alert. Alerts for the same camera that arrive within the
+// group window are sent together in one message.
+func (n *EmailNotifier) Notify(alert Alert, cameraName string) {
+	if len(n.recipients(alert.CameraID)) == 0 {
+		return
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if group, exists := n.groups[alert.CameraID]; exists {
+		group.alerts = append(group.alerts, alert)
+		return
+	}
+
+	group := &emailGroup{cameraName: cameraName, alerts: []Alert{alert}}
+	n.groups[alert.CameraID] = group
+
+	window := time.Duration(n.config.GroupWindowSeconds) * time.Second
+	group.timer = time.AfterFunc(window, func() {
+		n.flush(alert.CameraID)
+	})
+}
+
+// flush sends the pending group for a camera
+func (n *EmailNotifier) flush(cameraID string) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Panic in email flush for camera %s: %v", cameraID, r)
+		}
+	}()
+
+	n.mutex.Lock()
+	group, exists := n.groups[cameraID]
+	if !exists {
+		n.mutex.Unlock()
+		return
+	}
+	delete(n.groups, cameraID)
+	allowed := n.allowSend(time.Now())
+	n.mutex.Unlock()
+
+	if !allowed {
+		log.Printf("Email rate limit reached, dropping %d alert(s) for camera %s", len(group.alerts), cameraID)
+		n.metrics.Add("worker_email_dropped_total", float64(len(group.alerts)), "camera", cameraID, "reason", "rate_limit")
+		return
+	}
+
+	if err := n.send(cameraID, group); err != nil {
+		log.Printf("Failed to send alert email for camera %s: %v", cameraID, err)
+		n.metrics.Add("worker_email_dropped_total", float64(len(group.alerts)), "camera", cameraID, "reason", "error")
+		return
+	}
+	log.Printf("Alert email sent for camera %s (%d alert(s))", cameraID, len(group.alerts))
+}
+
+// allowSend records a send at now if the hourly limit permits it. Caller must
+// hold the mutex.
+func (n *EmailNotifier) allowSend(now time.Time) bool {
+	if n.config.MaxPerHour <= 0 {
+		return true
+	}
+
+	cutoff := now.Add(-time.Hour)
+	kept := n.sent[:0]
+	for _, t := range n.sent {
+		if t.After(cutoff) {
+			kept = append(kept, t)
+		}
+	}
+	n.sent = kept
+
+	if len(n.sent) >= n.config.MaxPerHour {
+		return false
+	}
+	n.sent = append(n.sent, now)
+	return true
+}
+
+// Close sends any alerts still waiting for their group window to close
+func (n *EmailNotifier) Close() {
+	n.mutex.Lock()
+	pending := make([]string, 0, len(n.groups))
+	for cameraID, group := range n.groups {
+		group.timer.Stop()
+		pending = append(pending, cameraID)
+	}
+	n.mutex.Unlock()
+
+	for _, cameraID := range pending {
+		n.flush(cameraID)
+	}
+}
+
+// send builds the MIME message for a group and delivers it over SMTP
+func (n *EmailNotifier) send(cameraID string, group *emailGroup) error {
+	to := n.recipients(cameraID)
+	msg, err := n.buildMessage(to, group)
+	if err != nil {
+		return err
+	}
+
+	addr := net.JoinHostPort(n.config.Host, strconv.Itoa(n.config.Port))
+	conn, err := net.DialTimeout("tcp", addr, smtpDialTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s: %v", addr, err)
+	}
+	// The deadline covers the whole session, attachments included
+	if err := conn.SetDeadline(time.Now().Add(smtpTimeout)); err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to set SMTP deadline: %v", err)
+	}
+	client, err := smtp.NewClient(conn, n.config.Host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("SMTP greeting from %s failed: %v", addr, err)
+	}
+	defer client.Close()
+
+	if n.config.StartTLS {
+		if err := client.StartTLS(&tls.Config{ServerName: n.config.Host}); err != nil {
+			return fmt.Errorf("STARTTLS failed: %v", err)
+		}
+	}
+
+	if n.config.Username != "" {
+		auth := smtp.PlainAuth("", n.config.Username, n.config.Password, n.config.Host)
+		if err := client.Auth(auth); err != nil {
+			return fmt.Errorf("SMTP authentication failed: %v", err)
+		}
+	}
+
+	if err := client.Mail(n.config.From); err != nil {
+		return fmt.Errorf("MAIL FROM rejected: %v", err)
+	}
+	for _, rcpt := range to {
+		if err := client.Rcpt(rcpt); err != nil {
+			return fmt.Errorf("RCPT TO %s rejected: %v", rcpt, err)
+		}
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return fmt.Errorf("DATA rejected: %v", err)
+	}
+	if _, err := w.Write(msg); err != nil {
+		return fmt.Errorf("failed to write message: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed to finish message: %v", err)
+	}
+
+	return client.Quit()
+}
+
+// buildMessage renders a multipart/mixed message with one snapshot attachment per alert
+func (n *EmailNotifier) buildMessage(to []string, group *emailGroup) ([]byte, error) {
+	boundary, err := randomBoundary()
+	if err != nil {
+		return nil, err
+	}
+
+	first := group.alerts[0]
+	subject := fmt.Sprintf("Face detected on camera %s", group.cameraName)
+	if len(group.alerts) > 1 {
+		subject = fmt.Sprintf("%d face alerts on camera %s", len(group.alerts), group.cameraName)
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", n.config.From)
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", first.DetectedAt.Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: multipart/mixed; boundary=%q\r\n\r\n", boundary)
+
+	fmt.Fprintf(&buf, "--%s\r\n", boundary)
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	for _, alert := range group.alerts {
+		fmt.Fprintf(&buf, "%s  %s", alert.DetectedAt.Format("2006-01-02 15:04:05"), alert.Description)
+		if location, ok := alert.Metadata["location"].(string); ok && location != "" {
+			fmt.Fprintf(&buf, " (%s)", location)
+		}
+		if faces, ok := alert.Metadata["face_count"].(int); ok {
+			fmt.Fprintf(&buf, ", %d face(s)", faces)
+		}
+		buf.WriteString("\r\n")
+	}
+
+	attached := 0
+	for _, alert := range group.alerts {
+		if attached >= n.config.MaxAttachments {
+			break
+		}
+		if alert.snapshot == nil {
+			continue
+		}
+		if err := alert.snapshot.Wait(); err != nil {
+			continue
+		}
+		name := path.Base(alert.snapshot.Key)
+		data, err := n.store.Load(alert.snapshot.Key)
+		if err != nil {
+			log.Printf("Skipping email attachment %s: %v", name, err)
+			continue
+		}
+
+		fmt.Fprintf(&buf, "\r\n--%s\r\n", boundary)
+		fmt.Fprintf(&buf, "Content-Type: %s\r\n", alert.snapshot.ContentType())
+		buf.WriteString("Content-Transfer-Encoding: base64\r\n")
+		fmt.Fprintf(&buf, "Content-Disposition: attachment; filename=%q\r\n\r\n", name)
+		writeBase64Lines(&buf, data)
+		attached++
+	}
+
+	fmt.Fprintf(&buf, "\r\n--%s--\r\n", boundary)
+	return buf.Bytes(), nil
+}
+
+// writeBase64Lines writes data as base64 wrapped at 76 characters per line
+func writeBase64Lines(buf *bytes.Buffer, data []byte) {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 76 {
+		buf.WriteString(encoded[:76])
+		buf.WriteString("\r\n")
+		encoded = encoded[76:]
+	}
+	buf.WriteString(encoded)
+	buf.WriteString("\r\n")
+}
+
+func randomBoundary() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate MIME boundary: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNewEmailNotifierCredentials(t *testing.T) {
+	tests := []struct {
+		host     string
+		username string
+		starttls bool
+		ok       bool
+	}{
+		{"smtp.example.com", "", false, true},
+		{"smtp.example.com", "alerts", true, true},
+		// net/smtp only sends PLAIN credentials unencrypted to localhost
+		{"smtp.example.com", "alerts", false, false},
+		{"localhost", "alerts", false, true},
+		{"127.0.0.1", "alerts", false, true},
+		{"::1", "alerts", false, true},
+		{"localhost.example.com", "alerts", false, false},
+	}
+	for _, tt := range tests {
+		config := EmailConfig{Host: tt.host, From: "worker@example.com", Username: tt.username, StartTLS: tt.starttls}
+		if _, err := NewEmailNotifier(config, nil, NewMetrics()); (err == nil) != tt.ok {
+			t.Errorf("NewEmailNotifier(host=%q, username=%q, starttls=%v) error = %v, want ok=%v", tt.host, tt.username, tt.starttls, err, tt.ok)
+		}
+	}
+}
+
+func TestAllowSend(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name  string
+		max   int
+		sent  []time.Duration // ago
+		want  bool
+		after int
+	}{
+		{"unlimited", 0, []time.Duration{time.Minute, 2 * time.Minute}, true, 2},
+		{"under the limit", 3, []time.Duration{time.Minute, 2 * time.Minute}, true, 3},
+		{"at the limit", 2, []time.Duration{time.Minute, 2 * time.Minute}, false, 2},
+		{"old sends expire", 2, []time.Duration{61 * time.Minute, 2 * time.Hour, time.Minute}, true, 2},
+		{"exactly an hour ago has expired", 1, []time.Duration{time.Hour}, true, 1},
+	}
+	for _, tt := range tests {
+		n := &EmailNotifier{config: EmailConfig{MaxPerHour: tt.max}}
+		for _, ago := range tt.sent {
+			n.sent = append(n.sent, now.Add(-ago))
+		}
+		if got := n.allowSend(now); got != tt.want {
+			t.Errorf("%s: allowSend() = %v, want %v", tt.name, got, tt.want)
+		}
+		if len(n.sent) != tt.after {
+			t.Errorf("%s: %d sends remembered, want %d", tt.name, len(n.sent), tt.after)
+		}
+	}
+}
+
+func TestNotifyGroupsByCamera(t *testing.T) {
+	config := EmailConfig{
+		Host:               "localhost",
+		From:               "worker@example.com",
+		To:                 []string{"ops@example.com"},
+		CameraRecipients:   map[string][]string{"muted": {}},
+		GroupWindowSeconds: 3600,
+	}
+	n, err := NewEmailNotifier(config, nil, NewMetrics())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		for _, group := range n.groups {
+			group.timer.Stop()
+		}
+	}()
+
+	for _, id := range []string{"cam-1", "cam-2", "cam-1", "muted", "cam-1"} {
+		n.Notify(Alert{CameraID: id}, id)
+	}
+
+	want := map[string]int{"cam-1": 3, "cam-2": 1}
+	if len(n.groups) != len(want) {
+		t.Fatalf("got %d groups, want %d", len(n.groups), len(want))
+	}
+	for id, count := range want {
+		if group := n.groups[id]; group == nil || len(group.alerts) != count {
+			t.Errorf("camera %s: group %+v, want %d alerts", id, group, count)
+		}
+	}
+}
+
+func TestSendTimesOut(t *testing.T) {
+	// A server that accepts connections but never greets
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	saved := smtpTimeout
+	smtpTimeout = 100 * time.Millisecond
+	defer func() { smtpTimeout = saved }()
+
+	config := EmailConfig{
+		Host: "127.0.0.1",
+		Port: ln.Addr().(*net.TCPAddr).Port,
+		From: "worker@example.com",
+		To:   []string{"ops@example.com"},
+	}
+	n, err := NewEmailNotifier(config, nil, NewMetrics())
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- n.send("cam-1", &emailGroup{cameraName: "cam-1", alerts: []Alert{{CameraID: "cam-1"}}})
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("send() to a silent server succeeded")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("send() to a silent server did not time out")
+	}
+}
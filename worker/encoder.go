@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// defaultCodec encodes the annotated stream when no profile sets a codec
+const defaultCodec = "libx264"
+
+// EncoderProfile sets how a camera's annotated frames are encoded. Zero
+// fields keep the value of the profile below it, and in the end the defaults:
+// libx264, veryfast, zerolatency, 2 second keyframes at the camera's size and
+// rate.
+type EncoderProfile struct {
+	Codec           string  `yaml:"codec" json:"codec,omitempty"`
+	Preset          string  `yaml:"preset" json:"preset,omitempty"`
+	Tune            string  `yaml:"tune" json:"tune,omitempty"`
+	CRF             int     `yaml:"crf" json:"crf,omitempty"`
+	Bitrate         string  `yaml:"bitrate" json:"bitrate,omitempty"` // e.g. "500k"; with crf it caps the rate
+	MaxWidth        int     `yaml:"max_width" json:"max_width,omitempty"`
+	MaxHeight       int     `yaml:"max_height" json:"max_height,omitempty"`
+	KeyframeSeconds float64 `yaml:"keyframe_seconds" json:"keyframe_seconds,omitempty"`
+	FPS             float64 `yaml:"fps" json:"fps,omitempty"`
+}
+
+// x264Presets are the presets of libx264 and libx265
+var x264Presets = []string{"ultrafast", "superfast", "veryfast", "faster", "fast", "medium", "slow", "slower", "veryslow", "placebo"}
+
+// merge overrides the fields of a profile that are set in another
+func (e EncoderProfile) merge(o EncoderProfile) EncoderProfile {
+	if o.Codec != "" {
+		e.Codec = o.Codec
+	}
+	if o.Preset != "" {
+		e.Preset = o.Preset
+	}
+	if o.Tune != "" {
+		e.Tune = o.Tune
+	}
+	if o.CRF != 0 {
+		e.CRF = o.CRF
+	}
+	if o.Bitrate != "" {
+		e.Bitrate = o.Bitrate
+	}
+	if o.MaxWidth != 0 {
+		e.MaxWidth = o.MaxWidth
+	}
+	if o.MaxHeight != 0 {
+		e.MaxHeight = o.MaxHeight
+	}
+	if o.KeyframeSeconds != 0 {
+		e.KeyframeSeconds = o.KeyframeSeconds
+	}
+	if o.FPS != 0 {
+		e.FPS = o.FPS
+	}
+	return e
+}
+
+// withDefaults fills in the codec and, for x264 and x265, the preset and tune
+func (e EncoderProfile) withDefaults() EncoderProfile {
+	if e.Codec == "" {
+		e.Codec = defaultCodec
+	}
+	if e.KeyframeSeconds == 0 {
+		e.KeyframeSeconds = 2
+	}
+	if e.Codec == "libx264" || e.Codec == "libx265" {
+		if e.Preset == "" {
+			e.Preset = "veryfast"
+		}
+		if e.Tune == "" {
+			e.Tune = "zerolatency"
+		}
+	}
+	return e
+}
+
+// encoderProfile resolves the encoder settings of a camera: the global
+// encoder, then the named profile, then the camera's own settings
+func (sm *StreamManager) encoderProfile(camera Camera) (EncoderProfile, error) {
+	profile := sm.config.Publisher.Encoder
+	name := sm.config.Publisher.Profile
+	if camera.Publish != nil && camera.Publish.Profile != "" {
+		name = camera.Publish.Profile
+	}
+	if name != "" {
+		named, ok := sm.config.Publisher.Profiles[name]
+		if !ok {
+			return EncoderProfile{}, fmt.Errorf("unknown encoder profile %q", name)
+		}
+		profile = profile.merge(named)
+	}
+	if camera.Publish != nil && camera.Publish.Encoder != nil {
+		profile = profile.merge(*camera.Publish.Encoder)
+	}
+	profile = profile.withDefaults()
+	if err := validateEncoder(profile); err != nil {
+		return EncoderProfile{}, fmt.Errorf("invalid encoder settings: %v", err)
+	}
+	return profile, nil
+}
+
+// validateEncoder checks a profile's values and that the local ffmpeg has
+// its codec
+func validateEncoder(e EncoderProfile) error {
+	x26x := e.Codec == "libx264" || e.Codec == "libx265"
+	switch {
+	case e.CRF < 0 || e.CRF > 63:
+		return fmt.Errorf("crf must be between 0 and 63")
+	case x26x && e.CRF > 51:
+		return fmt.Errorf("crf of %s must be between 0 and 51", e.Codec)
+	case e.MaxWidth < 0 || e.MaxHeight < 0:
+		return fmt.Errorf("max_width and max_height must not be negative")
+	case e.KeyframeSeconds < 0:
+		return fmt.Errorf("keyframe_seconds must not be negative")
+	case e.FPS < 0:
+		return fmt.Errorf("fps must not be negative")
+	}
+	if e.Bitrate != "" {
+		if _, err := parseBitrate(e.Bitrate); err != nil {
+			return err
+		}
+	}
+	if x26x && !containsString(x264Presets, e.Preset) {
+		return fmt.Errorf("preset %q is not one of %s", e.Preset, strings.Join(x264Presets, ", "))
+	}
+
+	// Without the list publishing fails with its own error; don't refuse the
+	// stream for it
+	encoders, err := localEncoders()
+	if err == nil && !encoders[e.Codec] {
+		return fmt.Errorf("codec %q is not a video encoder of the local ffmpeg", e.Codec)
+	}
+	return nil
+}
+
+// parseBitrate parses a bitrate in bits per second with an optional k or M
+// suffix
+func parseBitrate(s string) (int64, error) {
+	multiplier := 1.0
+	switch {
+	case strings.HasSuffix(s, "k") || strings.HasSuffix(s, "K"):
+		multiplier, s = 1e3, s[:len(s)-1]
+	case strings.HasSuffix(s, "M") || strings.HasSuffix(s, "m"):
+		multiplier, s = 1e6, s[:len(s)-1]
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("bitrate must be a positive number of bits per second, e.g. 500k or 2M")
+	}
+	return int64(n * multiplier), nil
+}
+
+// containsString reports whether a list holds a string
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// ffmpegEncoders caches the video encoders of the local ffmpeg
+var ffmpegEncoders struct {
+	once  sync.Once
+	names map[string]bool
+	err   error
+}
+
+// localEncoders returns the names of the video encoders the local ffmpeg
+// was built with, asking it once
+func localEncoders() (map[string]bool, error) {
+	ffmpegEncoders.once.Do(func() {
+		out, err := exec.Command("ffmpeg", "-hide_banner", "-encoders").Output()
+		if err != nil {
+			ffmpegEncoders.err = fmt.Errorf("ffmpeg -encoders failed: %v", err)
+			log.Printf("Could not list ffmpeg encoders, codecs are not checked: %v", err)
+			return
+		}
+		ffmpegEncoders.names = parseEncoders(out)
+	})
+	return ffmpegEncoders.names, ffmpegEncoders.err
+}
+
+// parseEncoders reads the video encoders from `ffmpeg -encoders`, whose
+// lines after the "------" separator are "<flags> <name> <description>"
+// with V as the first flag of video encoders
+func parseEncoders(out []byte) map[string]bool {
+	names := make(map[string]bool)
+	listing := false
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if !listing {
+			listing = strings.HasPrefix(fields[0], "---")
+			continue
+		}
+		if len(fields) >= 2 && strings.HasPrefix(fields[0], "V") {
+			names[fields[1]] = true
+		}
+	}
+	return names
+}
+
+// ffmpegVersion caches the release of the local ffmpeg
+var ffmpegVersion struct {
+	once         sync.Once
+	major, minor int
+	known        bool
+}
+
+// fpsModeArgs returns the option that keeps the input timestamps. ffmpeg 5.1
+// replaced -vsync with -fps_mode; older releases only know -vsync.
+func fpsModeArgs() []string {
+	ffmpegVersion.once.Do(func() {
+		out, err := exec.Command("ffmpeg", "-hide_banner", "-version").Output()
+		if err != nil {
+			log.Printf("Could not read the ffmpeg version, assuming 5.1 or later: %v", err)
+			return
+		}
+		ffmpegVersion.major, ffmpegVersion.minor, ffmpegVersion.known = parseFFmpegVersion(out)
+	})
+	major, minor := ffmpegVersion.major, ffmpegVersion.minor
+	if ffmpegVersion.known && (major < 5 || (major == 5 && minor < 1)) {
+		return []string{"-vsync", "passthrough"}
+	}
+	return []string{"-fps_mode", "passthrough"}
+}
+
+// parseFFmpegVersion reads the release from the first line of
+// `ffmpeg -version`, e.g. "ffmpeg version 4.4.2-0ubuntu0.22.04.1" or
+// "ffmpeg version n6.0". Git builds ("N-112345-g...") are not releases and
+// report false.
+func parseFFmpegVersion(out []byte) (int, int, bool) {
+	line, _, _ := bytes.Cut(out, []byte("\n"))
+	fields := strings.Fields(string(line))
+	if len(fields) < 3 || fields[0] != "ffmpeg" || fields[1] != "version" {
+		return 0, 0, false
+	}
+	version := strings.TrimPrefix(fields[2], "n")
+	parts := strings.SplitN(version, ".", 3)
+	if len(parts) < 2 {
+		return 0, 0, false
+	}
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, false
+	}
+	// The minor part may carry a suffix, as in "1-0ubuntu"
+	minor := strings.IndexFunc(parts[1], func(r rune) bool { return r < '0' || r > '9' })
+	if minor == 0 {
+		return 0, 0, false
+	}
+	if minor > 0 {
+		parts[1] = parts[1][:minor]
+	}
+	n, _ := strconv.Atoi(parts[1])
+	return major, n, true
+}
+
+// encoderArgs returns the ffmpeg encoding arguments of a profile for input
+// frames of the given size and rate
+func encoderArgs(e EncoderProfile, width, height int, fps float64) []string {
+	var filters []string
+	if e.FPS > 0 && e.FPS < fps {
+		fps = e.FPS
+		filters = append(filters, "fps="+strconv.FormatFloat(fps, 'f', 2, 64))
+	}
+	if size, ok := fitWithin(width, height, e.MaxWidth, e.MaxHeight); ok {
+		// 4:2:0 needs even dimensions
+		w, h := size.X&^1, size.Y&^1
+		if w < 2 {
+			w = 2
+		}
+		if h < 2 {
+			h = 2
+		}
+		filters = append(filters, fmt.Sprintf("scale=%d:%d", w, h))
+	}
+
+	gop := int(fps*e.KeyframeSeconds + 0.5)
+	if gop < 1 {
+		gop = 1
+	}
+	args := []string{"-c:v", e.Codec}
+	if e.Preset != "" {
+		args = append(args, "-preset", e.Preset)
+	}
+	if e.Tune != "" {
+		args = append(args, "-tune", e.Tune)
+	}
+	if len(filters) > 0 {
+		args = append(args, "-vf", strings.Join(filters, ","))
+	}
+	args = append(args, "-pix_fmt", "yuv420p", "-g", strconv.Itoa(gop))
+
+	if e.CRF > 0 {
+		args = append(args, "-crf", strconv.Itoa(e.CRF))
+	}
+	if e.Bitrate != "" {
+		// Validated when the stream started
+		bitrate, _ := parseBitrate(e.Bitrate)
+		rate := strconv.FormatInt(bitrate, 10)
+		if e.CRF == 0 {
+			args = append(args, "-b:v", rate)
+		}
+		// A two second buffer keeps the rate close to the cap on thin uplinks
+		args = append(args, "-maxrate", rate, "-bufsize", strconv.FormatInt(bitrate*2, 10))
+	}
+	return args
+}
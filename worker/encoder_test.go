@@ -0,0 +1,49 @@
+package main
+
+import "testing"
+
+func TestParseBitrate(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+		ok   bool
+	}{
+		{"800000", 800000, true},
+		{"500k", 500000, true},
+		{"500K", 500000, true},
+		{"2M", 2000000, true},
+		{"1.5m", 1500000, true},
+		{"", 0, false},
+		{"0", 0, false},
+		{"-1M", 0, false},
+		{"fast", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := parseBitrate(tt.in)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseBitrate(%q) = %d, %v; want %d, ok=%v", tt.in, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestParseFFmpegVersion(t *testing.T) {
+	tests := []struct {
+		in           string
+		major, minor int
+		ok           bool
+	}{
+		{"ffmpeg version 4.4.2-0ubuntu0.22.04.1 Copyright (c) 2000-2021", 4, 4, true},
+		{"ffmpeg version 5.1-static https://johnvansickle.com/ffmpeg/", 5, 1, true},
+		{"ffmpeg version n6.0 Copyright (c) 2000-2023\nbuilt with gcc", 6, 0, true},
+		{"ffmpeg version 7.1.1 Copyright (c) 2000-2025", 7, 1, true},
+		{"ffmpeg version N-112345-g0123456789 Copyright", 0, 0, false},
+		{"avconv version 9.20", 0, 0, false},
+		{"", 0, 0, false},
+	}
+	for _, tt := range tests {
+		major, minor, ok := parseFFmpegVersion([]byte(tt.in))
+		if major != tt.major || minor != tt.minor || ok != tt.ok {
+			t.Errorf("parseFFmpegVersion(%q) = %d, %d, %v; want %d, %d, %v", tt.in, major, minor, ok, tt.major, tt.minor, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,491 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/fs"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// encryptedMagic starts every encrypted object:
+// magic | key ID length (1 byte) | key ID | nonce (12 bytes) | AES-GCM ciphertext
+var encryptedMagic = []byte("FDWENC1")
+
+// EncryptionConfig enables AES-256-GCM encryption of stored media. Keys are
+// read from key_file (or ENCRYPTION_KEYS), one "<id> <base64 key>" per line;
+// the first key encrypts new objects and all keys can decrypt.
+type EncryptionConfig struct {
+	Enabled     bool   `yaml:"enabled"`
+	KeyFile     string `yaml:"key_file"`
+	AccessToken string `yaml:"access_token"`
+}
+
+// encryptionKey is one named AES-256 key
+type encryptionKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+// loadEncryptionKeys reads keys from the ENCRYPTION_KEYS environment variable
+// ("id:base64,id:base64") or from the key file
+func loadEncryptionKeys(config EncryptionConfig) ([]encryptionKey, error) {
+	var entries [][2]string
+	if env := os.Getenv("ENCRYPTION_KEYS"); env != "" {
+		for _, item := range strings.Split(env, ",") {
+			parts := strings.SplitN(strings.TrimSpace(item), ":", 2)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("ENCRYPTION_KEYS entries must be <id>:<base64 key>")
+			}
+			entries = append(entries, [2]string{parts[0], parts[1]})
+		}
+	} else {
+		if config.KeyFile == "" {
+			return nil, fmt.Errorf("encryption requires key_file or ENCRYPTION_KEYS")
+		}
+		file, err := os.Open(config.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open key file: %v", err)
+		}
+		defer file.Close()
+
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			fields := strings.Fields(line)
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("key file lines must be <id> <base64 key>")
+			}
+			entries = append(entries, [2]string{fields[0], fields[1]})
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read key file: %v", err)
+		}
+	}
+
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("no encryption keys configured")
+	}
+
+	keys := make([]encryptionKey, 0, len(entries))
+	seen := make(map[string]bool)
+	for _, entry := range entries {
+		id, encoded := entry[0], entry[1]
+		if id == "" || len(id) > 255 || seen[id] {
+			return nil, fmt.Errorf("invalid or duplicate key ID %q", id)
+		}
+		seen[id] = true
+
+		raw, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(raw) != 32 {
+			return nil, fmt.Errorf("key %s must be 32 bytes, base64 encoded", id)
+		}
+		block, err := aes.NewCipher(raw)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, encryptionKey{id: id, aead: aead})
+	}
+	return keys, nil
+}
+
+// EncryptedStore encrypts objects before they reach the wrapped store and
+// decrypts them on load. URLs point at the worker's authorized /media endpoint.
+type EncryptedStore struct {
+	inner     SnapshotStore
+	keys      []encryptionKey
+	publicURL string
+	// Writes of an object are serialized with its re-encryption, so a
+	// rotation never puts back an older version of e.g. an alert record
+	locks [64]sync.Mutex
+}
+
+// lock locks the writes of one object key
+func (s *EncryptedStore) lock(key string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	m := &s.locks[h.Sum32()%uint32(len(s.locks))]
+	m.Lock()
+	return m
+}
+
+// NewEncryptedStore wraps a store with the configured keys
+func NewEncryptedStore(inner SnapshotStore, config EncryptionConfig, publicURL string) (*EncryptedStore, error) {
+	keys, err := loadEncryptionKeys(config)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Encrypting stored media with key %s (%d key(s) loaded)", keys[0].id, len(keys))
+	return &EncryptedStore{inner: inner, keys: keys, publicURL: strings.TrimSuffix(publicURL, "/")}, nil
+}
+
+// encrypt seals data with the active key. The object key is authenticated so
+// a ciphertext can't be swapped for another object's.
+func (s *EncryptedStore) encrypt(key string, data []byte) ([]byte, error) {
+	active := s.keys[0]
+	nonce := make([]byte, active.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %v", err)
+	}
+
+	out := make([]byte, 0, len(encryptedMagic)+1+len(active.id)+len(nonce)+len(data)+active.aead.Overhead())
+	out = append(out, encryptedMagic...)
+	out = append(out, byte(len(active.id)))
+	out = append(out, active.id...)
+	out = append(out, nonce...)
+	return active.aead.Seal(out, nonce, data, []byte(key)), nil
+}
+
+// decrypt opens data sealed by encrypt. Objects stored before encryption was
+// enabled are returned as they are.
+func (s *EncryptedStore) decrypt(key string, data []byte) ([]byte, string, error) {
+	if !bytes.HasPrefix(data, encryptedMagic) {
+		return data, "", nil
+	}
+	rest := data[len(encryptedMagic):]
+	if len(rest) < 1 || len(rest) < 1+int(rest[0]) {
+		return nil, "", fmt.Errorf("%s: truncated header", key)
+	}
+	id := string(rest[1 : 1+int(rest[0])])
+	rest = rest[1+int(rest[0]):]
+
+	for _, k := range s.keys {
+		if k.id != id {
+			continue
+		}
+		if len(rest) < k.aead.NonceSize() {
+			return nil, id, fmt.Errorf("%s: truncated nonce", key)
+		}
+		nonce, sealed := rest[:k.aead.NonceSize()], rest[k.aead.NonceSize():]
+		plain, err := k.aead.Open(nil, nonce, sealed, []byte(key))
+		if err != nil {
+			return nil, id, fmt.Errorf("%s: decryption failed: %v", key, err)
+		}
+		return plain, id, nil
+	}
+	return nil, id, fmt.Errorf("%s: encrypted with unknown key %s", key, id)
+}
+
+func (s *EncryptedStore) Save(key string, data []byte, contentType string) (string, error) {
+	defer s.lock(key).Unlock()
+	return s.save(key, data)
+}
+
+// save encrypts and stores an object. Caller must hold its lock.
+func (s *EncryptedStore) save(key string, data []byte) (string, error) {
+	sealed, err := s.encrypt(key, data)
+	if err != nil {
+		return "", err
+	}
+	// Stored as opaque bytes so the backend never serves plaintext types
+	if _, err := s.inner.Save(key, sealed, "application/octet-stream"); err != nil {
+		return "", err
+	}
+	return s.URL(key)
+}
+
+func (s *EncryptedStore) SaveFile(key string, localPath string, contentType string) (string, error) {
+	data, err := os.ReadFile(localPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %v", localPath, err)
+	}
+	defer os.Remove(localPath)
+	return s.Save(key, data, contentType)
+}
+
+func (s *EncryptedStore) Load(key string) ([]byte, error) {
+	data, err := s.inner.Load(key)
+	if err != nil {
+		return nil, err
+	}
+	plain, _, err := s.decrypt(key, data)
+	return plain, err
+}
+
+func (s *EncryptedStore) Delete(key string) error {
+	return s.inner.Delete(key)
+}
+
+func (s *EncryptedStore) URL(key string) (string, error) {
+	return s.publicURL + "/media/" + strings.TrimPrefix(key, "/"), nil
+}
+
+func (s *EncryptedStore) List(prefix string) ([]StoredObject, error) {
+	return s.inner.List(prefix)
+}
+
+// Rotate re-encrypts every object that isn't sealed with the active key,
+// including objects stored before encryption was enabled. It returns the
+// number of objects rewritten.
+func (s *EncryptedStore) Rotate() (int, error) {
+	objects, err := s.inner.List("")
+	if err != nil {
+		return 0, err
+	}
+
+	rewritten := 0
+	for _, obj := range objects {
+		if s.rotateObject(obj.Key) {
+			rewritten++
+		}
+	}
+	return rewritten, nil
+}
+
+// rotateObject re-encrypts one object with the active key if needed and
+// reports whether it was rewritten
+func (s *EncryptedStore) rotateObject(key string) bool {
+	defer s.lock(key).Unlock()
+
+	data, err := s.inner.Load(key)
+	if err != nil {
+		// Deleted since the listing, e.g. by retention
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("Key rotation: failed to load %s: %v", key, err)
+		}
+		return false
+	}
+	plain, id, err := s.decrypt(key, data)
+	if err != nil {
+		log.Printf("Key rotation: %v", err)
+		return false
+	}
+	if id == s.keys[0].id {
+		return false
+	}
+	if _, err := s.save(key, plain); err != nil {
+		log.Printf("Key rotation: failed to rewrite %s: %v", key, err)
+		return false
+	}
+	return true
+}
+
+// rotation tracks the background key rotation job
+type rotation struct {
+	mutex     sync.Mutex
+	running   bool
+	started   time.Time
+	finished  time.Time
+	rewritten int
+	err       string
+}
+
+// authRequired reports whether media, archive, export and event routes need a
+// token: always when media is encrypted, and whenever a token or JWT secret is
+// configured
+func (c Config) authRequired() bool {
+	return c.Storage.Encryption.Enabled || c.Storage.Encryption.AccessToken != "" || c.BackendAuth.JWTSecret != ""
+}
+
+// mediaAudience is the aud claim a JWT needs for media routes. The worker's
+// own service tokens don't carry it, so they can't be used to fetch media.
+const mediaAudience = "media"
+
+// validateMediaAuth refuses encryption at rest without an access token or a
+// JWT secret, which would leave every media request unauthorized
+func (c Config) validateMediaAuth() error {
+	if c.Storage.Encryption.Enabled && c.Storage.Encryption.AccessToken == "" && c.BackendAuth.JWTSecret == "" {
+		return fmt.Errorf("encryption at rest needs storage.encryption.access_token or backend_auth.jwt_secret to serve media")
+	}
+	return nil
+}
+
+// mediaAuth checks the bearer token (or ?token=) of media requests. It accepts
+// the configured access token or an HS256 JWT signed with the backend JWT
+// secret whose aud is "media".
+func (sm *StreamManager) mediaAuth(c *gin.Context) {
+	token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if token == "" {
+		token = c.Query("token")
+	}
+
+	access := sm.config.Storage.Encryption.AccessToken
+	switch {
+	case token == "":
+	case access != "" && subtle.ConstantTimeCompare([]byte(token), []byte(access)) == 1:
+		c.Next()
+		return
+	case sm.config.BackendAuth.JWTSecret != "" && verifyJWT(sm.config.BackendAuth.JWTSecret, token, time.Now(), mediaAudience) == nil:
+		c.Next()
+		return
+	}
+
+	c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+}
+
+// handleMedia serves a stored object, decrypted
+func (sm *StreamManager) handleMedia(c *gin.Context) {
+	key := strings.TrimPrefix(c.Param("key"), "/")
+	if key == "" || strings.Contains(key, "..") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid key"})
+		return
+	}
+
+	data, err := sm.store.Load(key)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+			return
+		}
+		log.Printf("Failed to serve %s: %v", key, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load media"})
+		return
+	}
+
+	contentType := mime.TypeByExtension(path.Ext(key))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	c.Header("Cache-Control", "private, no-store")
+	c.Data(http.StatusOK, contentType, data)
+}
+
+// handleRotateKeys starts re-encrypting stored media with the active key
+func (sm *StreamManager) handleRotateKeys(c *gin.Context) {
+	store, ok := sm.store.(*EncryptedStore)
+	if !ok {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "encryption is not enabled"})
+		return
+	}
+
+	sm.rotation.mutex.Lock()
+	defer sm.rotation.mutex.Unlock()
+
+	if !sm.rotation.running {
+		sm.rotation.running = true
+		sm.rotation.started = time.Now()
+		sm.rotation.err = ""
+		go func() {
+			rewritten, err := store.Rotate()
+
+			sm.rotation.mutex.Lock()
+			defer sm.rotation.mutex.Unlock()
+			sm.rotation.running = false
+			sm.rotation.finished = time.Now()
+			sm.rotation.rewritten = rewritten
+			if err != nil {
+				sm.rotation.err = err.Error()
+			}
+			log.Printf("Key rotation finished: %d object(s) re-encrypted", rewritten)
+		}()
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"running":    sm.rotation.running,
+		"started_at": sm.rotation.started,
+		"active_key": store.keys[0].id,
+	})
+}
+
+// handleRotationStatus reports the last key rotation
+func (sm *StreamManager) handleRotationStatus(c *gin.Context) {
+	if _, ok := sm.store.(*EncryptedStore); !ok {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "encryption is not enabled"})
+		return
+	}
+
+	sm.rotation.mutex.Lock()
+	defer sm.rotation.mutex.Unlock()
+
+	c.JSON(http.StatusOK, gin.H{
+		"running":     sm.rotation.running,
+		"started_at":  sm.rotation.started,
+		"finished_at": sm.rotation.finished,
+		"rewritten":   sm.rotation.rewritten,
+		"error":       sm.rotation.err,
+	})
+}
+
+// verifyJWT checks the signature and expiry of an HS256 token and, unless
+// audience is empty, that its aud claim names audience
+func verifyJWT(secret, token string, now time.Time, audience string) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("malformed token")
+	}
+
+	enc := base64.RawURLEncoding
+	header, err := enc.DecodeString(parts[0])
+	if err != nil {
+		return fmt.Errorf("malformed header")
+	}
+	var h struct {
+		Alg string `json:"alg"`
+	}
+	if err := json.Unmarshal(header, &h); err != nil || h.Alg != "HS256" {
+		return fmt.Errorf("unsupported algorithm")
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	sig, err := enc.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(sig, mac.Sum(nil)) {
+		return fmt.Errorf("invalid signature")
+	}
+
+	body, err := enc.DecodeString(parts[1])
+	if err != nil {
+		return fmt.Errorf("malformed claims")
+	}
+	var claims struct {
+		Exp int64       `json:"exp"`
+		Aud interface{} `json:"aud"`
+	}
+	if err := json.Unmarshal(body, &claims); err != nil {
+		return fmt.Errorf("malformed claims")
+	}
+	if claims.Exp != 0 && now.Unix() >= claims.Exp {
+		return fmt.Errorf("token expired")
+	}
+	if audience != "" && !hasAudience(claims.Aud, audience) {
+		return fmt.Errorf("token is not for %s", audience)
+	}
+	return nil
+}
+
+// hasAudience reports whether an aud claim (a string or a list) names audience
+func hasAudience(aud interface{}, audience string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == audience
+	case []interface{}:
+		for _, a := range v {
+			if a == audience {
+				return true
+			}
+		}
+	case []string:
+		for _, a := range v {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
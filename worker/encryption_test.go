@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// testEncryptedStore returns a store with the given "id:base64" keys
+func testEncryptedStore(t *testing.T, keys string) *EncryptedStore {
+	t.Helper()
+	t.Setenv("ENCRYPTION_KEYS", keys)
+	s, err := NewEncryptedStore(nil, EncryptionConfig{Enabled: true}, "http://worker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	key1 := "k1:" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	key2 := "k2:" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 32))
+	old := testEncryptedStore(t, key1)
+	rotated := testEncryptedStore(t, key2+","+key1)
+	other := testEncryptedStore(t, key2)
+
+	plain := []byte("snapshot bytes")
+	sealed, err := old.encrypt("cam/2024-05-01/a.jpg", plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(sealed, append(append([]byte{}, encryptedMagic...), 2, 'k', '1')) {
+		t.Fatalf("header %q does not record key k1", sealed[:len(encryptedMagic)+3])
+	}
+	tampered := append([]byte(nil), sealed...)
+	tampered[len(tampered)-1] ^= 1
+
+	tests := []struct {
+		name  string
+		store *EncryptedStore
+		key   string
+		data  []byte
+		want  []byte
+		keyID string
+		ok    bool
+	}{
+		{"same key", old, "cam/2024-05-01/a.jpg", sealed, plain, "k1", true},
+		{"old key after rotation", rotated, "cam/2024-05-01/a.jpg", sealed, plain, "k1", true},
+		{"unknown key", other, "cam/2024-05-01/a.jpg", sealed, nil, "k1", false},
+		// The object key is authenticated
+		{"other object key", old, "cam/2024-05-01/b.jpg", sealed, nil, "k1", false},
+		{"tampered", old, "cam/2024-05-01/a.jpg", tampered, nil, "k1", false},
+		{"truncated header", old, "cam/2024-05-01/a.jpg", append(append([]byte{}, encryptedMagic...), 9, 'k'), nil, "", false},
+		{"stored before encryption", old, "cam/2024-05-01/a.jpg", plain, plain, "", true},
+	}
+	for _, tt := range tests {
+		got, keyID, err := tt.store.decrypt(tt.key, tt.data)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: decrypt() error = %v, want ok=%v", tt.name, err, tt.ok)
+			continue
+		}
+		if !bytes.Equal(got, tt.want) || keyID != tt.keyID {
+			t.Errorf("%s: decrypt() = %q, %q; want %q, %q", tt.name, got, keyID, tt.want, tt.keyID)
+		}
+	}
+
+	// New objects are sealed with the first key
+	resealed, err := rotated.encrypt("cam/2024-05-01/a.jpg", plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, keyID, err := rotated.decrypt("cam/2024-05-01/a.jpg", resealed); err != nil || keyID != "k2" {
+		t.Errorf("rotated store sealed with %q (%v), want k2", keyID, err)
+	}
+}
+
+func TestLoadEncryptionKeys(t *testing.T) {
+	valid := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	tests := []struct {
+		env string
+		ok  bool
+	}{
+		{"k1:" + valid, true},
+		{"k1:" + valid + ", k2:" + valid, true},
+		{"k1:" + valid + ",k1:" + valid, false},
+		{"k1:" + base64.StdEncoding.EncodeToString([]byte("short")), false},
+		{"k1:not base64", false},
+		{valid, false},
+	}
+	for _, tt := range tests {
+		t.Setenv("ENCRYPTION_KEYS", tt.env)
+		if _, err := loadEncryptionKeys(EncryptionConfig{}); (err == nil) != tt.ok {
+			t.Errorf("loadEncryptionKeys(%q) error = %v, want ok=%v", tt.env, err, tt.ok)
+		}
+	}
+}
+
+func TestMediaAuth(t *testing.T) {
+	key1 := "k1:" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	t.Setenv("ENCRYPTION_KEYS", key1)
+	inner, err := NewLocalStore(t.TempDir(), "http://worker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewEncryptedStore(inner, EncryptionConfig{Enabled: true}, "http://worker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Save("cam-1/2024-05-01/a.jpg", []byte("snapshot bytes"), "image/jpeg"); err != nil {
+		t.Fatal(err)
+	}
+
+	sm := &StreamManager{store: store}
+	sm.config.Storage.Encryption = EncryptionConfig{Enabled: true, AccessToken: "media-token"}
+	sm.config.BackendAuth.JWTSecret = "secret"
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	auth := router.Group("/")
+	auth.Use(sm.mediaAuth)
+	auth.GET("/media/*key", sm.handleMedia)
+
+	now := time.Now()
+	media := map[string]interface{}{"sub": "backend", "aud": mediaAudience}
+	valid, _ := signJWT("secret", media, now, now.Add(time.Hour))
+	listed, _ := signJWT("secret", map[string]interface{}{"aud": []string{"api", mediaAudience}}, now, now.Add(time.Hour))
+	expired, _ := signJWT("secret", media, now.Add(-2*time.Hour), now.Add(-time.Hour))
+	forged, _ := signJWT("other", media, now, now.Add(time.Hour))
+	other, _ := signJWT("secret", map[string]interface{}{"sub": "backend", "aud": "api"}, now, now.Add(time.Hour))
+
+	// The worker's own service token is signed with the same secret
+	_, creds, err := newBackendClient(Config{BackendURL: "http://backend", BackendAuth: BackendAuthConfig{JWTSecret: "secret", UserID: "user-1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	service, err := creds.header()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		path   string
+		header string
+		status int
+	}{
+		{"no token", "/media/cam-1/2024-05-01/a.jpg", "", http.StatusUnauthorized},
+		{"access token", "/media/cam-1/2024-05-01/a.jpg", "Bearer media-token", http.StatusOK},
+		{"access token in query", "/media/cam-1/2024-05-01/a.jpg?token=media-token", "", http.StatusOK},
+		{"wrong token", "/media/cam-1/2024-05-01/a.jpg", "Bearer guess", http.StatusUnauthorized},
+		{"jwt", "/media/cam-1/2024-05-01/a.jpg", "Bearer " + valid, http.StatusOK},
+		{"jwt with an audience list", "/media/cam-1/2024-05-01/a.jpg", "Bearer " + listed, http.StatusOK},
+		{"jwt for another audience", "/media/cam-1/2024-05-01/a.jpg", "Bearer " + other, http.StatusUnauthorized},
+		{"worker service token", "/media/cam-1/2024-05-01/a.jpg", service, http.StatusUnauthorized},
+		{"expired jwt", "/media/cam-1/2024-05-01/a.jpg", "Bearer " + expired, http.StatusUnauthorized},
+		{"jwt with another secret", "/media/cam-1/2024-05-01/a.jpg", "Bearer " + forged, http.StatusUnauthorized},
+		{"missing object", "/media/cam-1/2024-05-01/b.jpg", "Bearer media-token", http.StatusNotFound},
+		{"unauthorized missing object", "/media/cam-1/2024-05-01/b.jpg", "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		if tt.header != "" {
+			req.Header.Set("Authorization", tt.header)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.status)
+			continue
+		}
+		if tt.status == http.StatusOK {
+			if got := w.Body.String(); got != "snapshot bytes" {
+				t.Errorf("%s: body %q, want the decrypted snapshot", tt.name, got)
+			}
+			if got := w.Header().Get("Content-Type"); got != "image/jpeg" {
+				t.Errorf("%s: content type %q, want image/jpeg", tt.name, got)
+			}
+		}
+	}
+}
+
+func TestValidateMediaAuth(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+		ok     bool
+	}{
+		{"no encryption", Config{}, true},
+		{"access token", Config{Storage: StorageConfig{Encryption: EncryptionConfig{Enabled: true, AccessToken: "t"}}}, true},
+		{"jwt secret", Config{Storage: StorageConfig{Encryption: EncryptionConfig{Enabled: true}}, BackendAuth: BackendAuthConfig{JWTSecret: "s"}}, true},
+		// Every /media request would be refused
+		{"no credentials", Config{Storage: StorageConfig{Encryption: EncryptionConfig{Enabled: true}}}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.config.validateMediaAuth(); (err == nil) != tt.ok {
+			t.Errorf("%s: validateMediaAuth() error = %v, want ok=%v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestRotate(t *testing.T) {
+	key1 := "k1:" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	key2 := "k2:" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 32))
+	inner, err := NewLocalStore(t.TempDir(), "http://worker")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("ENCRYPTION_KEYS", key1)
+	old, err := NewEncryptedStore(inner, EncryptionConfig{Enabled: true}, "http://worker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	objects := map[string]string{
+		"cam-1/2024-05-01/a.jpg": "sealed with k1",
+		"cam-1/2024-05-01/b.jpg": "stored before encryption",
+		"cam-1/2024-05-01/c.jpg": "sealed with k2",
+	}
+	if _, err := old.Save("cam-1/2024-05-01/a.jpg", []byte(objects["cam-1/2024-05-01/a.jpg"]), "image/jpeg"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := inner.Save("cam-1/2024-05-01/b.jpg", []byte(objects["cam-1/2024-05-01/b.jpg"]), "image/jpeg"); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("ENCRYPTION_KEYS", key2+","+key1)
+	rotated, err := NewEncryptedStore(inner, EncryptionConfig{Enabled: true}, "http://worker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rotated.Save("cam-1/2024-05-01/c.jpg", []byte(objects["cam-1/2024-05-01/c.jpg"]), "image/jpeg"); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := rotated.Rotate(); err != nil || n != 2 {
+		t.Fatalf("Rotate() = %d, %v; want 2 objects rewritten", n, err)
+	}
+	if n, err := rotated.Rotate(); err != nil || n != 0 {
+		t.Errorf("second Rotate() = %d, %v; want nothing left to rewrite", n, err)
+	}
+	for key, want := range objects {
+		data, err := inner.Load(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plain, keyID, err := rotated.decrypt(key, data)
+		if err != nil || string(plain) != want || keyID != "k2" {
+			t.Errorf("%s after rotation = %q, %q, %v; want %q sealed with k2", key, plain, keyID, err, want)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"image"
+	"log"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+// Alert modes select how detections are reported to the backend
+const (
+	AlertModePoint  = "point"  // one alert per detection (throttled), the original behaviour
+	AlertModeEvents = "events" // started/updated/ended presence events
+	AlertModeBoth   = "both"
+)
+
+// Event lifecycle states
+const (
+	EventStarted = "started"
+	EventUpdated = "updated"
+	EventEnded   = "ended"
+)
+
+// AlertEvent describes face presence on a camera. Every message for the same
+// presence carries the same EventID.
+type AlertEvent struct {
+	EventID         string                 `json:"eventId"`
+	Status          string                 `json:"status"`
+	CameraID        string                 `json:"cameraId"`
+	StartedAt       time.Time              `json:"startedAt"`
+	EndedAt         *time.Time             `json:"endedAt,omitempty"`
+	DurationSeconds float64                `json:"durationSeconds"`
+	FaceCount       int                    `json:"faceCount"`
+	PeakFaceCount   int                    `json:"peakFaceCount"`
+	SnapshotURL     string                 `json:"snapshotUrl"`
+	AnnotatedURL    string                 `json:"annotatedSnapshotUrl,omitempty"`
+	ThumbnailURL    string                 `json:"thumbnailUrl,omitempty"`
+	FaceCrops       []FaceCrop             `json:"faceCrops,omitempty"`
+	ClipURL         string                 `json:"clipUrl,omitempty"`
+	Description     string                 `json:"description"`
+	Metadata        map[string]interface{} `json:"metadata"`
+	snapshot        *Snapshot
+}
+
+// faceEvent is the in-progress presence state of a stream
+type faceEvent struct {
+	id            string
+	startedAt     time.Time
+	lastSeen      time.Time
+	lastUpdate    time.Time
+	lastSnapshot  time.Time
+	faceCount     int
+	reportedCount int
+	peakFaceCount int
+	bestCount     int
+	bestArea      int
+	snapshot      *Snapshot
+	clipURL       string
+}
+
+// trackEvent advances the presence event of a stream with the faces found in
+// the current frame. It is called for every processed frame, with or without faces.
+func (sm *StreamManager) trackEvent(stream *CameraStream, faces []image.Rectangle, img, clean *gocv.Mat) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Panic in trackEvent for camera %s: %v", stream.Camera.ID, r)
+		}
+	}()
+
+	now := time.Now()
+	idle := time.Duration(sm.config.EventIdleSeconds) * time.Second
+
+	stream.Mutex.Lock()
+	defer stream.Mutex.Unlock()
+
+	ev := stream.event
+	if len(faces) == 0 {
+		if ev != nil && now.Sub(ev.lastSeen) >= idle {
+			sm.endEventLocked(stream, ev.lastSeen)
+		}
+		return
+	}
+
+	area := 0
+	for _, face := range faces {
+		area += face.Dx() * face.Dy()
+	}
+
+	if ev == nil {
+		ev = &faceEvent{
+			id:            newEventID(),
+			startedAt:     now,
+			lastUpdate:    now,
+			faceCount:     len(faces),
+			reportedCount: len(faces),
+			peakFaceCount: len(faces),
+			bestCount:     len(faces),
+			bestArea:      area,
+		}
+		stream.event = ev
+
+		if snap, err := sm.createSnapshot(stream, img, clean, faces, ev.id, SnapshotRuleEvent); err == nil {
+			ev.snapshot = snap
+			ev.lastSnapshot = now
+			// The clip is stored next to the first snapshot of the event
+			ev.clipURL = sm.startClip(stream, now, snap.Key)
+		} else {
+			log.Printf("Failed to create event snapshot for camera %s: %v", stream.Camera.ID, err)
+		}
+
+		ev.lastSeen = now
+		started := sm.buildEvent(stream, ev, EventStarted, now)
+		sm.queueEvent(started)
+		if sm.email != nil && sm.config.AlertMode == AlertModeEvents {
+			sm.email.Notify(eventAlert(started), stream.Camera.Name)
+		}
+		return
+	}
+
+	ev.lastSeen = now
+	ev.faceCount = len(faces)
+	if ev.faceCount > ev.peakFaceCount {
+		ev.peakFaceCount = ev.faceCount
+	}
+
+	// Keep the best frame: most faces, then largest total face area. New
+	// snapshots are limited to one every 2 seconds.
+	better := len(faces) > ev.bestCount || (len(faces) == ev.bestCount && area > ev.bestArea*5/4)
+	if better && now.Sub(ev.lastSnapshot) >= 2*time.Second {
+		if snap, err := sm.createSnapshot(stream, img, clean, faces, ev.id, SnapshotRuleEvent); err == nil {
+			ev.snapshot = snap
+			ev.lastSnapshot = now
+			ev.bestArea = area
+			ev.bestCount = len(faces)
+		}
+	}
+
+	// Report face count changes, at most once per second
+	if ev.faceCount != ev.reportedCount && now.Sub(ev.lastUpdate) >= time.Second {
+		ev.reportedCount = ev.faceCount
+		ev.lastUpdate = now
+		sm.queueEvent(sm.buildEvent(stream, ev, EventUpdated, now))
+	}
+}
+
+// endEvent ends the active presence event of a stream, if any
+func (sm *StreamManager) endEvent(stream *CameraStream) {
+	stream.Mutex.Lock()
+	defer stream.Mutex.Unlock()
+
+	if stream.event != nil {
+		sm.endEventLocked(stream, stream.event.lastSeen)
+	}
+}
+
+// endEventLocked sends the ended message and clears the event. Caller must hold stream.Mutex.
+func (sm *StreamManager) endEventLocked(stream *CameraStream, endedAt time.Time) {
+	ev := stream.event
+	stream.event = nil
+
+	ended := sm.buildEvent(stream, ev, EventEnded, endedAt)
+	ended.EndedAt = &endedAt
+	ended.FaceCount = 0
+	sm.queueEvent(ended)
+}
+
+// buildEvent renders the current state of an event as a message
+func (sm *StreamManager) buildEvent(stream *CameraStream, ev *faceEvent, status string, at time.Time) AlertEvent {
+	event := AlertEvent{
+		EventID:         ev.id,
+		Status:          status,
+		CameraID:        stream.Camera.ID,
+		StartedAt:       ev.startedAt,
+		DurationSeconds: at.Sub(ev.startedAt).Seconds(),
+		FaceCount:       ev.faceCount,
+		PeakFaceCount:   ev.peakFaceCount,
+		ClipURL:         ev.clipURL,
+		Description:     fmt.Sprintf("Face detected on camera %s", stream.Camera.Name),
+		Metadata: map[string]interface{}{
+			"camera_name": stream.Camera.Name,
+			"location":    stream.Camera.Location,
+		},
+	}
+	if ev.snapshot != nil {
+		event.SnapshotURL = ev.snapshot.URL
+		event.AnnotatedURL = ev.snapshot.AnnotatedURL
+		event.ThumbnailURL = ev.snapshot.ThumbnailURL
+		event.FaceCrops = ev.snapshot.FaceCrops
+		event.snapshot = ev.snapshot
+	}
+	return event
+}
+
+// queueEvent hands an event to the sender goroutine without blocking the frame loop
+func (sm *StreamManager) queueEvent(event AlertEvent) {
+	sm.hub.Publish(WSTypeEvent, event.CameraID, event)
+
+	sm.eventsPending.Add(1)
+	select {
+	case sm.eventQueue <- event:
+	default:
+		sm.eventsPending.Done()
+		log.Printf("Event queue full, dropping %s event %s for camera %s", event.Status, event.EventID, event.CameraID)
+	}
+}
+
+// runEventSender posts queued events to the backend in order
+func (sm *StreamManager) runEventSender() {
+	for event := range sm.eventQueue {
+		// Don't announce a snapshot before it has been stored
+		if event.snapshot != nil {
+			if err := event.snapshot.Wait(); err != nil {
+				event.SnapshotURL = ""
+				event.AnnotatedURL = ""
+				event.ThumbnailURL = ""
+				event.FaceCrops = nil
+			} else {
+				// Keep the latest state of the event with its snapshot
+				sm.saveAlertRecord(event.snapshot, event)
+			}
+		}
+		if err := sm.sendEvent(event); err != nil {
+			log.Printf("Failed to send %s event %s for camera %s: %v", event.Status, event.EventID, event.CameraID, err)
+		}
+		sm.eventsPending.Done()
+	}
+}
+
+// sendEvent sends an event to the backend API
+func (sm *StreamManager) sendEvent(event AlertEvent) error {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Panic in sendEvent for camera %s: %v", event.CameraID, r)
+		}
+	}()
+
+	if err := sm.post("event", "/api/alerts/events", event); err != nil {
+		return err
+	}
+
+	log.Printf("Event %s %s sent for camera %s", event.EventID, event.Status, event.CameraID)
+	return nil
+}
+
+// waitForEvents waits until queued events have been sent or the timeout expires
+func (sm *StreamManager) waitForEvents(timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		sm.eventsPending.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		log.Printf("Timed out waiting for pending events to be sent")
+	}
+}
+
+// eventAlert converts a started event to an Alert for notifiers that work on alerts
+func eventAlert(event AlertEvent) Alert {
+	metadata := map[string]interface{}{
+		"event_id":   event.EventID,
+		"face_count": event.FaceCount,
+	}
+	for k, v := range event.Metadata {
+		metadata[k] = v
+	}
+
+	return Alert{
+		AlertID:      event.EventID,
+		CameraID:     event.CameraID,
+		DetectedAt:   event.StartedAt,
+		Description:  event.Description,
+		SnapshotURL:  event.SnapshotURL,
+		AnnotatedURL: event.AnnotatedURL,
+		ThumbnailURL: event.ThumbnailURL,
+		FaceCrops:    event.FaceCrops,
+		snapshot:     event.snapshot,
+		Metadata:     metadata,
+	}
+}
+
+// newEventID returns a random UUID (version 4)
+func newEventID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
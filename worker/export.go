@@ -0,0 +1,426 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Export job states
+const (
+	ExportQueued  = "queued"
+	ExportRunning = "running"
+	ExportDone    = "done"
+	ExportFailed  = "failed"
+)
+
+// ExportConfig controls evidence export bundles
+type ExportConfig struct {
+	Path      string `yaml:"path"`
+	KeepHours int    `yaml:"keep_hours"`
+}
+
+// ExportJob is an evidence bundle being built in the background
+type ExportJob struct {
+	ID          string     `json:"id"`
+	Status      string     `json:"status"`
+	CameraID    string     `json:"camera_id"`
+	From        time.Time  `json:"from"`
+	To          time.Time  `json:"to"`
+	CreatedAt   time.Time  `json:"created_at"`
+	FinishedAt  *time.Time `json:"finished_at,omitempty"`
+	Snapshots   int        `json:"snapshots"`
+	Files       int        `json:"files"`
+	Size        int64      `json:"size"`
+	SHA256      string     `json:"sha256,omitempty"`
+	Error       string     `json:"error,omitempty"`
+	StatusURL   string     `json:"status_url"`
+	DownloadURL string     `json:"download_url,omitempty"`
+}
+
+// ExportManifest lists every file of a bundle with its SHA-256
+type ExportManifest struct {
+	GeneratedAt time.Time            `json:"generated_at"`
+	CameraID    string               `json:"camera_id"`
+	From        time.Time            `json:"from"`
+	To          time.Time            `json:"to"`
+	Snapshots   int                  `json:"snapshots"`
+	Files       []ExportManifestFile `json:"files"`
+}
+
+// ExportManifestFile is one file of a bundle
+type ExportManifestFile struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// exportJobs tracks the export jobs of this worker run
+type exportJobs struct {
+	mutex sync.Mutex
+	jobs  map[string]*ExportJob
+}
+
+// get returns a copy of a job
+func (e *exportJobs) get(id string) (ExportJob, bool) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	job, ok := e.jobs[id]
+	if !ok {
+		return ExportJob{}, false
+	}
+	return *job, true
+}
+
+// update changes a job under the lock
+func (e *exportJobs) update(id string, fn func(job *ExportJob)) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if job, ok := e.jobs[id]; ok {
+		fn(job)
+	}
+}
+
+// bundlePath returns the local path of the ZIP of a job
+func (sm *StreamManager) bundlePath(id string) string {
+	return filepath.Join(sm.config.Export.Path, id+".zip")
+}
+
+// startExport queues a bundle for a camera and time range and returns the job
+func (sm *StreamManager) startExport(cameraID string, from, to time.Time) ExportJob {
+	id := newEventID()
+	base := strings.TrimSuffix(sm.config.Storage.PublicURL, "/")
+	job := &ExportJob{
+		ID:        id,
+		Status:    ExportQueued,
+		CameraID:  cameraID,
+		From:      from,
+		To:        to,
+		CreatedAt: time.Now(),
+		StatusURL: base + "/export/" + id,
+	}
+
+	sm.exports.mutex.Lock()
+	if sm.exports.jobs == nil {
+		sm.exports.jobs = make(map[string]*ExportJob)
+	}
+	sm.exports.jobs[id] = job
+	queued := *job
+	sm.exports.mutex.Unlock()
+
+	go sm.runExport(id, base)
+	return queued
+}
+
+// runExport builds the bundle of a job and records the outcome
+func (sm *StreamManager) runExport(id, base string) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Panic in export %s: %v", id, r)
+			sm.exports.update(id, func(job *ExportJob) {
+				job.Status = ExportFailed
+				job.Error = fmt.Sprintf("panic: %v", r)
+				now := time.Now()
+				job.FinishedAt = &now
+			})
+		}
+	}()
+
+	var job ExportJob
+	sm.exports.update(id, func(j *ExportJob) {
+		j.Status = ExportRunning
+		job = *j
+	})
+
+	manifest, size, sum, err := sm.writeBundle(job)
+	sm.exports.update(id, func(j *ExportJob) {
+		now := time.Now()
+		j.FinishedAt = &now
+		if err != nil {
+			j.Status = ExportFailed
+			j.Error = err.Error()
+			return
+		}
+		j.Status = ExportDone
+		j.Snapshots = manifest.Snapshots
+		j.Files = len(manifest.Files)
+		j.Size = size
+		j.SHA256 = sum
+		j.DownloadURL = base + "/export/" + id + "/download"
+	})
+	if err != nil {
+		log.Printf("Export %s for camera %s failed: %v", id, job.CameraID, err)
+		return
+	}
+	log.Printf("Export %s for camera %s ready: %d snapshot(s), %d file(s), %d bytes", id, job.CameraID, manifest.Snapshots, len(manifest.Files), size)
+}
+
+// writeBundle writes the ZIP of a job. It holds every snapshot of the range
+// with its variants, sidecar, clip and alert record, plus manifest.json and
+// SHA256SUMS. It returns the manifest and the size and SHA-256 of the ZIP.
+func (sm *StreamManager) writeBundle(job ExportJob) (*ExportManifest, int64, string, error) {
+	entries, err := sm.findSidecars(job.CameraID, job.From, job.To)
+	if err != nil {
+		return nil, 0, "", fmt.Errorf("failed to search the archive: %v", err)
+	}
+	if len(entries) == 0 {
+		return nil, 0, "", fmt.Errorf("no snapshots for camera %s in that range", job.CameraID)
+	}
+	// Oldest first reads naturally in the bundle
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].at.Before(entries[j].at) })
+
+	if err := os.MkdirAll(sm.config.Export.Path, 0755); err != nil {
+		return nil, 0, "", fmt.Errorf("failed to create export directory: %v", err)
+	}
+	final := sm.bundlePath(job.ID)
+	tmp := final + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return nil, 0, "", fmt.Errorf("failed to create bundle: %v", err)
+	}
+	defer os.Remove(tmp)
+
+	zw := zip.NewWriter(f)
+	manifest := &ExportManifest{
+		GeneratedAt: time.Now().UTC(),
+		CameraID:    job.CameraID,
+		From:        job.From,
+		To:          job.To,
+	}
+	put := func(name string, data []byte) error {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: manifest.GeneratedAt})
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+	}
+	added := make(map[string]bool)
+	add := func(name string, data []byte) error {
+		if added[name] {
+			return nil
+		}
+		added[name] = true
+		if err := put(name, data); err != nil {
+			return err
+		}
+		sum := sha256.Sum256(data)
+		manifest.Files = append(manifest.Files, ExportManifestFile{Path: name, Size: int64(len(data)), SHA256: hex.EncodeToString(sum[:])})
+		return nil
+	}
+	// addKey copies a stored object if it exists
+	addKey := func(key string) error {
+		data, err := sm.store.Load(key)
+		if err != nil {
+			return nil
+		}
+		return add(key, data)
+	}
+
+	for _, e := range entries {
+		info, err := sm.loadSidecar(e.key)
+		if err != nil {
+			log.Printf("Export %s: skipping sidecar %s: %v", job.ID, e.key, err)
+			continue
+		}
+		// Snapshots removed by retention leave their sidecar until the next sweep
+		data, err := sm.store.Load(info.Key)
+		if err != nil {
+			log.Printf("Export %s: skipping snapshot %s: %v", job.ID, info.Key, err)
+			continue
+		}
+		if err := add(info.Key, data); err != nil {
+			zw.Close()
+			f.Close()
+			return nil, 0, "", err
+		}
+		keys := []string{info.AnnotatedKey, info.ThumbnailKey}
+		keys = append(keys, info.FaceCropKeys...)
+		keys = append(keys, e.key, snapshotBase(info.Key)+".mp4", alertRecordKey(info.Key))
+		for _, key := range keys {
+			if key == "" {
+				continue
+			}
+			if err := addKey(key); err != nil {
+				zw.Close()
+				f.Close()
+				return nil, 0, "", err
+			}
+		}
+		manifest.Snapshots++
+	}
+	if manifest.Snapshots == 0 {
+		zw.Close()
+		f.Close()
+		return nil, 0, "", fmt.Errorf("no stored snapshots for camera %s in that range", job.CameraID)
+	}
+
+	// The checksum list covers the evidence files; the manifest itself is
+	// covered by the SHA-256 of the whole bundle reported in the job
+	var sums strings.Builder
+	for _, file := range manifest.Files {
+		fmt.Fprintf(&sums, "%s  %s\n", file.SHA256, file.Path)
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err == nil {
+		err = put("manifest.json", data)
+	}
+	if err == nil {
+		err = put("SHA256SUMS", []byte(sums.String()))
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, 0, "", fmt.Errorf("failed to write bundle: %v", err)
+	}
+	size, sum, err := hashFile(tmp)
+	if err != nil {
+		return nil, 0, "", err
+	}
+	if err := os.Rename(tmp, final); err != nil {
+		return nil, 0, "", fmt.Errorf("failed to finish bundle: %v", err)
+	}
+	return manifest, size, sum, nil
+}
+
+// hashFile returns the size and SHA-256 of a local file
+func hashFile(path string) (int64, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return 0, "", err
+	}
+	return n, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// runExportCleaner removes the bundles of earlier runs, then finished bundles
+// after keep_hours
+func (sm *StreamManager) runExportCleaner() {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Panic in export cleaner: %v", r)
+		}
+	}()
+
+	sm.removeStaleExports()
+	for {
+		sm.cleanExports()
+		time.Sleep(10 * time.Minute)
+	}
+}
+
+// cleanExports deletes bundles older than keep_hours and forgets their jobs
+func (sm *StreamManager) cleanExports() {
+	if sm.config.Export.KeepHours <= 0 {
+		return
+	}
+	cutoff := time.Now().Add(-time.Duration(sm.config.Export.KeepHours) * time.Hour)
+
+	sm.exports.mutex.Lock()
+	for id, job := range sm.exports.jobs {
+		if job.FinishedAt != nil && job.FinishedAt.Before(cutoff) {
+			delete(sm.exports.jobs, id)
+		}
+	}
+	sm.exports.mutex.Unlock()
+
+	files, err := filepath.Glob(filepath.Join(sm.config.Export.Path, "*.zip"))
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		if st, err := os.Stat(file); err == nil && st.ModTime().Before(cutoff) {
+			if err := os.Remove(file); err != nil {
+				log.Printf("Failed to remove export %s: %v", file, err)
+			}
+		}
+	}
+}
+
+// removeStaleExports deletes the bundles left by an earlier run. Jobs are only
+// kept in memory, so nothing can download them any more, and they hold
+// decrypted media.
+func (sm *StreamManager) removeStaleExports() {
+	for _, pattern := range []string{"*.zip", "*.zip.tmp"} {
+		files, err := filepath.Glob(filepath.Join(sm.config.Export.Path, pattern))
+		if err != nil {
+			continue
+		}
+		for _, file := range files {
+			if err := os.Remove(file); err != nil {
+				log.Printf("Failed to remove export %s: %v", file, err)
+				continue
+			}
+			log.Printf("Removed export %s from an earlier run", file)
+		}
+	}
+}
+
+// handleCreateExport queues an evidence bundle for a camera and time range
+func (sm *StreamManager) handleCreateExport(c *gin.Context) {
+	var req struct {
+		CameraID string    `json:"camera_id" binding:"required"`
+		From     time.Time `json:"from" binding:"required"`
+		To       time.Time `json:"to" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !req.To.After(req.From) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "to must be after from"})
+		return
+	}
+
+	job := sm.startExport(req.CameraID, req.From, req.To)
+	c.JSON(http.StatusAccepted, job)
+}
+
+// handleExportStatus reports an export job
+func (sm *StreamManager) handleExportStatus(c *gin.Context) {
+	job, ok := sm.exports.get(c.Param("id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "export not found"})
+		return
+	}
+	c.JSON(http.StatusOK, job)
+}
+
+// handleExportDownload serves the ZIP of a finished export job
+func (sm *StreamManager) handleExportDownload(c *gin.Context) {
+	job, ok := sm.exports.get(c.Param("id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "export not found"})
+		return
+	}
+	if job.Status != ExportDone {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("export is %s", job.Status)})
+		return
+	}
+
+	name := fmt.Sprintf("evidence_%s_%s.zip", filepath.Base(job.CameraID), job.From.UTC().Format("20060102T150405Z"))
+	c.Header("Cache-Control", "private, no-store")
+	c.FileAttachment(sm.bundlePath(job.ID), name)
+}
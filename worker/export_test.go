@@ -0,0 +1,142 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteBundle(t *testing.T) {
+	store, err := NewLocalStore(t.TempDir(), "http://worker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm := &StreamManager{store: store}
+	sm.config.Export.Path = t.TempDir()
+
+	save := func(key, data string) {
+		if _, err := store.Save(key, []byte(data), "application/octet-stream"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	snapshot := func(base string, related ...string) {
+		info := SnapshotInfo{Key: base + ".jpg", CameraID: "cam-1"}
+		for _, suffix := range related {
+			switch suffix {
+			case "_thumb.jpg":
+				info.ThumbnailKey = base + suffix
+			case "_face0.jpg":
+				info.FaceCropKeys = append(info.FaceCropKeys, base+suffix)
+			}
+			save(base+suffix, "data of "+base+suffix)
+		}
+		if err := sm.writeSidecar(info); err != nil {
+			t.Fatal(err)
+		}
+	}
+	snapshot("cam-1/2024-05-01/090000_a", ".jpg", "_thumb.jpg", "_face0.jpg", "_alert.json")
+	snapshot("cam-1/2024-05-01/100000_b", ".jpg", ".mp4")
+	// Removed by retention, only the sidecar is left
+	snapshot("cam-1/2024-05-01/110000_c")
+	// Outside the range or of another camera
+	snapshot("cam-1/2024-05-02/090000_d", ".jpg")
+	save("cam-2/2024-05-01/093000_e.jpg", "other camera")
+
+	job := ExportJob{
+		ID:       "job-1",
+		CameraID: "cam-1",
+		From:     time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC),
+		To:       time.Date(2024, 5, 1, 23, 59, 59, 0, time.UTC),
+	}
+	manifest, size, sum, err := sm.writeBundle(job)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bundle, err := os.ReadFile(sm.bundlePath(job.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256(bundle)
+	if size != int64(len(bundle)) || sum != hex.EncodeToString(digest[:]) {
+		t.Errorf("writeBundle() size, sha256 = %d, %s; want %d, %x", size, sum, len(bundle), digest)
+	}
+
+	zr, err := zip.OpenReader(sm.bundlePath(job.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+	contents := make(map[string]string)
+	for _, f := range zr.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents[f.Name] = string(data)
+	}
+
+	var names []string
+	for name := range contents {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	want := []string{
+		"SHA256SUMS",
+		"cam-1/2024-05-01/090000_a.jpg",
+		"cam-1/2024-05-01/090000_a.json",
+		"cam-1/2024-05-01/090000_a_alert.json",
+		"cam-1/2024-05-01/090000_a_face0.jpg",
+		"cam-1/2024-05-01/090000_a_thumb.jpg",
+		"cam-1/2024-05-01/100000_b.jpg",
+		"cam-1/2024-05-01/100000_b.json",
+		"cam-1/2024-05-01/100000_b.mp4",
+		"manifest.json",
+	}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("bundle files = %v, want %v", names, want)
+	}
+
+	var stored ExportManifest
+	if err := json.Unmarshal([]byte(contents["manifest.json"]), &stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored.Snapshots != 2 || manifest.Snapshots != 2 || len(stored.Files) != len(want)-2 {
+		t.Errorf("manifest lists %d snapshot(s) and %d file(s), want 2 and %d", stored.Snapshots, len(stored.Files), len(want)-2)
+	}
+	var sums strings.Builder
+	for _, file := range stored.Files {
+		digest := sha256.Sum256([]byte(contents[file.Path]))
+		if file.SHA256 != hex.EncodeToString(digest[:]) || file.Size != int64(len(contents[file.Path])) {
+			t.Errorf("manifest entry %+v does not match the bundled file", file)
+		}
+		fmt.Fprintf(&sums, "%s  %s\n", file.SHA256, file.Path)
+	}
+	if contents["SHA256SUMS"] != sums.String() {
+		t.Errorf("SHA256SUMS = %q, want %q", contents["SHA256SUMS"], sums.String())
+	}
+
+	// Nothing in range
+	job.ID = "job-2"
+	job.From, job.To = job.To.Add(72*time.Hour), job.To.Add(96*time.Hour)
+	if _, _, _, err := sm.writeBundle(job); err == nil {
+		t.Error("writeBundle() of an empty range succeeded")
+	}
+	if _, err := os.Stat(sm.bundlePath(job.ID)); !os.IsNotExist(err) {
+		t.Errorf("empty export left a bundle behind: %v", err)
+	}
+}
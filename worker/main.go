@@ -1,22 +1,18 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"errors"
 	"fmt"
-	"io"
 	"image"
 	"image/color"
-	"image/jpeg"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
-	"os/exec"
 	"os/signal"
 	"runtime"
 	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -30,12 +26,26 @@ import (
 
 // Config holds the worker configuration
 type Config struct {
-	BackendURL    string `yaml:"backend_url"`
-	MediaMTXURL   string `yaml:"mediamtx_url"`
-	WorkerPort    int    `yaml:"worker_port"`
-	MaxStreams    int    `yaml:"max_streams"`
-	FaceCascade   string `yaml:"face_cascade"`
-	StoragePath   string `yaml:"storage_path"`
+	BackendURL       string            `yaml:"backend_url"`
+	MediaMTXURL      string            `yaml:"mediamtx_url"`
+	WorkerPort       int               `yaml:"worker_port"`
+	MaxStreams       int               `yaml:"max_streams"`
+	FaceCascade      string            `yaml:"face_cascade"`
+	StoragePath      string            `yaml:"storage_path"`
+	Storage          StorageConfig     `yaml:"storage"`
+	Snapshots        SnapshotConfig    `yaml:"snapshots"`
+	Retention        RetentionConfig   `yaml:"retention"`
+	BackendAuth      BackendAuthConfig `yaml:"backend_auth"`
+	AlertMode        string            `yaml:"alert_mode"`
+	EventIdleSeconds int               `yaml:"event_idle_seconds"`
+	Clips            ClipConfig        `yaml:"clips"`
+	Recording        RecordingConfig   `yaml:"recording"`
+	Timelapse        TimelapseConfig   `yaml:"timelapse"`
+	Publisher        PublisherConfig   `yaml:"publisher"`
+	Export           ExportConfig      `yaml:"export"`
+	MediaMTX         MediaMTXConfig    `yaml:"mediamtx"`
+	RTSPServer       RTSPServerConfig  `yaml:"rtsp_server"`
+	Email            EmailConfig       `yaml:"email"`
 }
 
 // Camera represents a camera configuration
@@ -44,44 +54,99 @@ type Camera struct {
 	Name     string `json:"name"`
 	RTSPURL  string `json:"rtsp_url"`
 	Location string `json:"location"`
+	Site     string `json:"site,omitempty"`
 	Enabled  bool   `json:"enabled"`
+	// Optional per-camera overrides
+	Clip *ClipConfig `json:"clip,omitempty"`
+	// Optional continuous recording override
+	Recording *RecordingConfig `json:"recording,omitempty"`
+	// Optional timelapse override
+	Timelapse *TimelapseConfig `json:"timelapse,omitempty"`
+	// Optional publish targets and path template
+	Publish *PublishSettings `json:"publish,omitempty"`
 }
 
 // Alert represents a face detection alert
 type Alert struct {
-	CameraID     string    `json:"cameraId"`
-	DetectedAt   time.Time `json:"detectedAt"`
-	Description  string    `json:"description"`
-	SnapshotURL  string    `json:"snapshotUrl"`
+	AlertID      string                 `json:"alertId"`
+	CameraID     string                 `json:"cameraId"`
+	DetectedAt   time.Time              `json:"detectedAt"`
+	Description  string                 `json:"description"`
+	SnapshotURL  string                 `json:"snapshotUrl"`
+	AnnotatedURL string                 `json:"annotatedSnapshotUrl,omitempty"`
+	ThumbnailURL string                 `json:"thumbnailUrl,omitempty"`
+	FaceCrops    []FaceCrop             `json:"faceCrops,omitempty"`
+	ClipURL      string                 `json:"clipUrl,omitempty"`
 	Metadata     map[string]interface{} `json:"metadata"`
+	// Snapshot being written, for notifiers that attach it
+	snapshot *Snapshot
 }
 
 // StreamManager manages multiple camera streams
 type StreamManager struct {
-	config      Config
-	client      *resty.Client
-	streams     map[string]*CameraStream
-	streamMutex sync.RWMutex
-	faceCascade gocv.CascadeClassifier
-	upgrader    websocket.Upgrader
+	config        Config
+	client        *resty.Client
+	streams       map[string]*CameraStream
+	streamMutex   sync.RWMutex
+	faceCascade   gocv.CascadeClassifier
+	upgrader      websocket.Upgrader
+	credentials   *serviceCredentials
+	delivery      *deliveryStats
+	metrics       *Metrics
+	store         SnapshotStore
+	snapshotQueue chan *Snapshot
+	rotation      rotation
+	exports       exportJobs
+	recordExports recordingExports
+	timelapseJobs timelapseJobs
+	retention     *RetentionManager
+	email         *EmailNotifier
+	mediamtx      *MediaMTX
+	rtsp          *RTSPServer
+	hub           *EventHub
+	eventQueue    chan AlertEvent
+	eventsPending sync.WaitGroup
 }
 
 // CameraStream represents an active camera stream
 type CameraStream struct {
-	Camera      Camera
-	Capture     *gocv.VideoCapture
-	Context     context.Context
-	Cancel      context.CancelFunc
-	IsRunning   bool
-	FrameCount  int64
-	StartTime   time.Time
-	LastAlert   time.Time
-	Mutex       sync.RWMutex
-	// Publisher fields
-	ffmpegCmd   *exec.Cmd
-	ffmpegIn    io.WriteCloser
-	publishURL  string
-	published   bool
+	Camera     Camera
+	Capture    *gocv.VideoCapture
+	Context    context.Context
+	Cancel     context.CancelFunc
+	IsRunning  bool
+	FrameCount int64
+	StartTime  time.Time
+	LastAlert  time.Time
+	Mutex      sync.RWMutex
+	faceCount  int
+	// Supervised ffmpeg publisher (nil when it could not be set up)
+	publisher *Publisher
+	// Passthrough of the camera's own video (nil unless raw publishing is on)
+	rawPublisher *Publisher
+	// Presence event in progress (nil when no faces are in view)
+	event *faceEvent
+	// Recent frames for pre/post-event clips (nil when clips are disabled)
+	ring *FrameRing
+	// Continuous recorder (nil when recording is disabled)
+	recorder *Recorder
+	// Timelapse frame sampler (nil when timelapse is disabled)
+	timelapse *timelapseSampler
+	// MJPEG viewers of the annotated frames
+	mjpeg *MJPEGHub
+	// Latest raw and annotated frames for /stream/:id/frame.jpg
+	stills *LatestFrames
+	// Both the frame loop and teardown close the capture, only the first counts
+	captureOnce sync.Once
+}
+
+// closeCapture releases the camera connection once
+func (s *CameraStream) closeCapture() {
+	s.captureOnce.Do(func() {
+		if s.Capture != nil {
+			s.Capture.Close()
+		}
+	})
 }
 
 // NewStreamManager creates a new stream manager
@@ -92,9 +157,10 @@ func NewStreamManager(config Config) (*StreamManager, error) {
 		}
 	}()
 
-	client := resty.New()
-	client.SetBaseURL(config.BackendURL)
-	client.SetTimeout(30 * time.Second)
+	client, credentials, err := newBackendClient(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure backend client: %v", err)
+	}
 
 	// Load face cascade classifier with error handling
 	faceCascade := gocv.NewCascadeClassifier()
@@ -102,33 +168,119 @@ func NewStreamManager(config Config) (*StreamManager, error) {
 		return nil, fmt.Errorf("failed to load face cascade classifier from %s", config.FaceCascade)
 	}
 
-	return &StreamManager{
-		config:      config,
-		client:      client,
-		streams:     make(map[string]*CameraStream),
-		faceCascade: faceCascade,
+	// Snapshot storage (local directory or S3-compatible bucket)
+	store, err := NewSnapshotStore(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure snapshot storage: %v", err)
+	}
+
+	metrics := NewMetrics()
+
+	// Email notifications are optional
+	var email *EmailNotifier
+	if config.Email.Enabled {
+		notifier, err := NewEmailNotifier(config.Email, store, metrics)
+		if err != nil {
+			return nil, fmt.Errorf("failed to configure email notifier: %v", err)
+		}
+		email = notifier
+	}
+
+	// The MediaMTX control API is optional
+	mediamtx, err := NewMediaMTX(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure MediaMTX API: %v", err)
+	}
+
+	// The embedded RTSP server replaces MediaMTX on small installs
+	var rtsp *RTSPServer
+	if err := config.validateRTSPServer(); err != nil {
+		return nil, err
+	}
+	if config.RTSPServer.Enabled {
+		rtsp, err = NewRTSPServer(config.RTSPServer)
+		if err != nil {
+			return nil, fmt.Errorf("failed to start embedded RTSP server: %v", err)
+		}
+	}
+
+	sm := &StreamManager{
+		config:        config,
+		client:        client,
+		credentials:   credentials,
+		delivery:      &deliveryStats{},
+		metrics:       metrics,
+		store:         store,
+		snapshotQueue: make(chan *Snapshot, config.Snapshots.QueueSize),
+		streams:       make(map[string]*CameraStream),
+		faceCascade:   faceCascade,
 		upgrader: websocket.Upgrader{
 			CheckOrigin: func(r *http.Request) bool {
 				return true
 			},
 		},
-	}, nil
+		email:      email,
+		mediamtx:   mediamtx,
+		rtsp:       rtsp,
+		hub:        NewEventHub(),
+		eventQueue: make(chan AlertEvent, 256),
+	}
+
+	registerMetrics(sm.metrics)
+
+	// Snapshots are encoded and stored off the frame loop
+	for i := 0; i < config.Snapshots.Workers; i++ {
+		go sm.runSnapshotWriter()
+	}
+
+	// Retention keeps the snapshot store within its limits
+	sm.retention = NewRetentionManager(config.Retention, store, sm.metrics)
+	if config.Retention.enabled() {
+		go sm.retention.Run()
+	}
+
+	// Presence events are posted in order by a single sender
+	go sm.runEventSender()
+	go sm.runStatsBroadcaster()
+
+	// Recording retention also covers cameras that are no longer streaming
+	go sm.runRecordingCleaner()
+
+	// Daily timelapses are built once the day is over
+	go sm.runTimelapseScheduler()
+
+	// Finished evidence bundles are removed after keep_hours
+	go sm.runExportCleaner()
+
+	// MediaMTX path status, reader counts and the data check
+	if sm.mediamtx != nil {
+		go sm.runMediaMTXMonitor()
+	}
+
+	if sm.rtsp != nil {
+		go sm.rtsp.Run()
+	}
+
+	return sm, nil
 }
 func hasQuery(u string) bool {
-    parsed, err := url.Parse(u)
-    if err != nil { return false }
-    return parsed.RawQuery != ""
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return false
+	}
+	return parsed.RawQuery != ""
 }
 
 func containsTransportParam(u string) bool {
-    parsed, err := url.Parse(u)
-    if err != nil { return false }
-    q := parsed.Query()
-    _, ok := q["rtsp_transport"]
-    return ok
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return false
+	}
+	q := parsed.Query()
+	_, ok := q["rtsp_transport"]
+	return ok
 }
 
-
 // StartStream starts processing a camera stream
 func (sm *StreamManager) StartStream(camera Camera) error {
 	defer func() {
@@ -152,17 +304,20 @@ func (sm *StreamManager) StartStream(camera Camera) error {
 	if camera.RTSPURL == "" {
 		return fmt.Errorf("RTSP URL is required for camera %s", camera.ID)
 	}
+	if err := sm.validatePublish(camera); err != nil {
+		return fmt.Errorf("camera %s: %v", camera.ID, err)
+	}
 
 	// Create context for this stream
 	ctx, cancel := context.WithCancel(context.Background())
 
-    // Open RTSP stream with retry logic - prefer TCP transport
-    var capture *gocv.VideoCapture
-	
+	// Open RTSP stream with retry logic - prefer TCP transport
+	var capture *gocv.VideoCapture
+
 	for i := 0; i < 3; i++ {
 		var err error
 		rtspURL := camera.RTSPURL
-	
+
 		// Try opening the RTSP stream directly
 		capture, err = gocv.OpenVideoCapture(rtspURL)
 		if err != nil {
@@ -174,18 +329,18 @@ func (sm *StreamManager) StartStream(camera Camera) error {
 			cancel()
 			return fmt.Errorf("failed to open RTSP stream for camera %s after 3 attempts: %v", camera.ID, err)
 		}
-	
+
 		if capture.IsOpened() {
 			break
 		}
-	
+
 		if i < 2 {
 			log.Printf("RTSP stream not opened for camera %s, retrying... (attempt %d/3)", camera.ID, i+1)
 			capture.Close()
 			time.Sleep(time.Duration(i+1) * time.Second)
 		}
 	}
-	
+
 	if capture == nil || !capture.IsOpened() {
 		cancel()
 		if capture != nil {
@@ -201,7 +356,13 @@ func (sm *StreamManager) StartStream(camera Camera) error {
 		Cancel:    cancel,
 		IsRunning: true,
 		StartTime: time.Now(),
+		mjpeg:     NewMJPEGHub(),
+		stills:    NewLatestFrames(),
 	}
+	if clipConfig := sm.clipConfig(camera); clipConfig.Enabled {
+		stream.ring = NewFrameRing(clipConfig)
+	}
+	stream.timelapse = sm.newTimelapseSampler(camera)
 
 	sm.streams[camera.ID] = stream
 
@@ -210,19 +371,20 @@ func (sm *StreamManager) StartStream(camera Camera) error {
 		log.Printf("Failed to start publisher for camera %s: %v", camera.ID, err)
 	}
 
+	// Start continuous recording if enabled
+	sm.startRecorder(stream)
+
 	// Start processing in goroutine with panic recovery
 	go func() {
 		defer func() {
 			if r := recover(); r != nil {
 				log.Printf("Panic in processStream for camera %s: %v", camera.ID, r)
-				// Clean up the stream on panic
+				sm.publishStreamState(camera.ID, StreamStateFailed, fmt.Sprintf("panic: %v", r))
+				// Clean up as StopStream would, unless the stream was
+				// already stopped or replaced
 				sm.streamMutex.Lock()
-				if stream, exists := sm.streams[camera.ID]; exists {
-					stream.Cancel()
-					if stream.Capture != nil {
-						stream.Capture.Close()
-					}
-					delete(sm.streams, camera.ID)
+				if sm.streams[camera.ID] == stream {
+					sm.teardownStreamLocked(stream)
 				}
 				sm.streamMutex.Unlock()
 			}
@@ -230,6 +392,7 @@ func (sm *StreamManager) StartStream(camera Camera) error {
 		sm.processStream(stream)
 	}()
 
+	sm.publishStreamState(camera.ID, StreamStateRunning, "")
 	log.Printf("Started stream for camera %s (%s)", camera.ID, camera.Name)
 	return nil
 }
@@ -249,18 +412,29 @@ func (sm *StreamManager) StopStream(cameraID string) error {
 	if !exists {
 		return fmt.Errorf("stream for camera %s not found", cameraID)
 	}
+	sm.teardownStreamLocked(stream)
 
+	sm.publishStreamState(cameraID, StreamStateStopped, "")
+	log.Printf("Stopped stream for camera %s", cameraID)
+	return nil
+}
+
+// teardownStreamLocked stops a stream's capture, event, clips, publisher and
+// recorder and removes it. Caller must hold sm.streamMutex.
+func (sm *StreamManager) teardownStreamLocked(stream *CameraStream) {
 	// Safely stop the stream
 	stream.Cancel()
-	if stream.Capture != nil {
-		stream.Capture.Close() // FIXED: Proper indentation
+	stream.closeCapture()
+	// End any presence event so the backend doesn't keep it open
+	sm.endEvent(stream)
+	// Write clips that were still waiting for post-event frames
+	if stream.ring != nil {
+		stream.ring.Flush()
 	}
-	// Stop publisher if running
+	// Stop publisher and recorder if running
 	sm.stopPublisher(stream)
-	delete(sm.streams, cameraID)
-
-	log.Printf("Stopped stream for camera %s", cameraID)
-	return nil
+	sm.stopRecorder(stream)
+	delete(sm.streams, stream.Camera.ID)
 }
 
 // processStream processes frames from a camera stream
@@ -269,9 +443,10 @@ func (sm *StreamManager) processStream(stream *CameraStream) {
 		if r := recover(); r != nil {
 			log.Printf("Panic in processStream for camera %s: %v", stream.Camera.ID, r)
 		}
-		if stream.Capture != nil {
-			stream.Capture.Close()
-		}
+		stream.closeCapture()
+		// End the MJPEG responses of this stream
+		stream.mjpeg.Close()
+		stream.stills.Close()
 	}()
 
 	img := gocv.NewMat()
@@ -298,12 +473,20 @@ func (sm *StreamManager) processStream(stream *CameraStream) {
 			if !ok {
 				consecutiveErrors++
 				log.Printf("Failed to read frame from camera %s (error %d/%d)", stream.Camera.ID, consecutiveErrors, maxConsecutiveErrors)
-				
+
 				if consecutiveErrors >= maxConsecutiveErrors {
 					log.Printf("Too many consecutive errors for camera %s, stopping stream", stream.Camera.ID)
+					sm.publishStreamState(stream.Camera.ID, StreamStateFailed, "too many consecutive read errors")
+					// Clean up as StopStream would, unless the stream was
+					// already stopped or replaced
+					sm.streamMutex.Lock()
+					if sm.streams[stream.Camera.ID] == stream {
+						sm.teardownStreamLocked(stream)
+					}
+					sm.streamMutex.Unlock()
 					return
 				}
-				
+
 				time.Sleep(100 * time.Millisecond)
 				continue
 			}
@@ -319,34 +502,58 @@ func (sm *StreamManager) processStream(stream *CameraStream) {
 			stream.FrameCount++
 			stream.Mutex.Unlock()
 
+			// Keep the raw and annotated frame while stills are requested
+			stream.stills.Capture(FrameRaw, &img)
+
 			// Process frame for face detection with error handling
 			if err := sm.processFrame(stream, &img, &frame); err != nil {
 				log.Printf("Error processing frame for camera %s: %v", stream.Camera.ID, err)
 			}
+			stream.stills.Capture(FrameAnnotated, &img)
+
+			// Sample a timelapse frame every interval
+			if stream.timelapse != nil {
+				now := time.Now()
+				stream.Mutex.RLock()
+				hasFaces := stream.faceCount > 0
+				stream.Mutex.RUnlock()
+				if stream.timelapse.Observe(now, hasFaces) {
+					stream.timelapse.Sample(now, &img)
+				}
+			}
 
-			// Push frame to MediaMTX via ffmpeg stdin (MJPEG pipe)
-			if stream.published && stream.ffmpegIn != nil {
+			// Push the raw frame to MediaMTX via ffmpeg stdin
+			if stream.publisher != nil {
+				start := time.Now()
+				stream.publisher.WriteFrame(&img)
+				sm.metrics.Add("worker_publish_seconds_total", time.Since(start).Seconds(), "camera", stream.Camera.ID)
+				sm.metrics.Inc("worker_publish_frames_total", "camera", stream.Camera.ID)
+			}
+
+			// Encode the processed frame once for the clip buffer and an
+			// annotated recording; MJPEG viewers reuse it at full size
+			recording := stream.recorder != nil && stream.recorder.wantsFrames()
+			var jpegBytes []byte
+			if stream.ring != nil || recording {
 				buf, encErr := gocv.IMEncode(".jpg", img)
-				if encErr == nil {
-					_, wErr := stream.ffmpegIn.Write(buf.GetBytes())
-					buf.Close()
-					if wErr != nil {
-						if !errors.Is(wErr, io.ErrClosedPipe) {
-							log.Printf("ffmpeg write error for camera %s: %v", stream.Camera.ID, wErr)
-						} else {
-							// ffmpeg has exited, stop publishing
-							stream.Mutex.Lock()
-							stream.published = false
-							stream.ffmpegIn.Close()
-							stream.ffmpegIn = nil
-							stream.Mutex.Unlock()
-						}
-					}
-				} else {
+				if encErr != nil {
 					log.Printf("JPEG encode error for camera %s: %v", stream.Camera.ID, encErr)
+				} else {
+					jpegBytes = append([]byte(nil), buf.GetBytes()...)
+					buf.Close()
+				}
+			}
+			if jpegBytes != nil {
+				if stream.ring != nil {
+					stream.ring.Push(time.Now(), jpegBytes)
+				}
+				if recording {
+					stream.recorder.WriteFrame(jpegBytes)
 				}
 			}
-			
+			if stream.mjpeg.HasViewers() {
+				stream.mjpeg.Publish(&img, jpegBytes)
+			}
 		}
 	}
 }
@@ -372,24 +579,45 @@ func (sm *StreamManager) processFrame(stream *CameraStream, img *gocv.Mat, frame
 
 	// Detect faces - this returns []image.Rectangle directly
 	faces := sm.faceCascade.DetectMultiScale(*frame)
-	
+
+	stream.Mutex.Lock()
+	stream.faceCount = len(faces)
+	stream.Mutex.Unlock()
+
+	if len(faces) > 0 {
+		sm.publishDetection(stream, faces)
+	}
+
+	// Keep the untouched frame for clean snapshots
+	var clean *gocv.Mat
+	if len(faces) > 0 && sm.config.Snapshots.needsClean() {
+		untouched := img.Clone()
+		defer untouched.Close()
+		clean = &untouched
+	}
+
 	// Draw bounding boxes on the original image
 	for _, face := range faces {
 		gocv.Rectangle(img, face, color.RGBA{0, 255, 0, 255}, 2)
 	}
-	
+
 	// Draw overlays with error handling
 	if err := sm.drawOverlays(img, stream, len(faces)); err != nil {
 		log.Printf("Error drawing overlays for camera %s: %v", stream.Camera.ID, err)
 	}
 
 	// If faces detected, create alert
-	if len(faces) > 0 {
-		if err := sm.handleFaceDetection(stream, faces, img); err != nil {
+	if len(faces) > 0 && sm.config.AlertMode != AlertModeEvents {
+		if err := sm.handleFaceDetection(stream, faces, img, clean); err != nil {
 			log.Printf("Error handling face detection for camera %s: %v", stream.Camera.ID, err)
 		}
 	}
 
+	// Track presence events (also needs frames without faces to detect the end)
+	if sm.config.AlertMode != AlertModePoint {
+		sm.trackEvent(stream, faces, img, clean)
+	}
+
 	return nil
 }
 
@@ -414,11 +642,11 @@ func (sm *StreamManager) drawOverlays(img *gocv.Mat, stream *CameraStream, faceC
 	fps := float64(frameCount) / elapsed
 
 	// Draw camera info
-	info := fmt.Sprintf("Camera: %s | FPS: %.1f | Faces: %d", 
+	info := fmt.Sprintf("Camera: %s | FPS: %.1f | Faces: %d",
 		stream.Camera.Name, fps, faceCount)
-	
+
 	// Draw text overlay
-	gocv.PutText(img, info, image.Pt(10, 30), gocv.FontHersheySimplex, 0.7, 
+	gocv.PutText(img, info, image.Pt(10, 30), gocv.FontHersheySimplex, 0.7,
 		color.RGBA{0, 255, 0, 255}, 2)
 
 	// Draw timestamp
@@ -430,7 +658,7 @@ func (sm *StreamManager) drawOverlays(img *gocv.Mat, stream *CameraStream, faceC
 }
 
 // handleFaceDetection handles face detection events
-func (sm *StreamManager) handleFaceDetection(stream *CameraStream, faces []image.Rectangle, img *gocv.Mat) error {
+func (sm *StreamManager) handleFaceDetection(stream *CameraStream, faces []image.Rectangle, img, clean *gocv.Mat) error {
 	defer func() {
 		if r := recover(); r != nil {
 			log.Printf("Panic in handleFaceDetection for camera %s: %v", stream.Camera.ID, r)
@@ -445,77 +673,58 @@ func (sm *StreamManager) handleFaceDetection(stream *CameraStream, faces []image
 	stream.LastAlert = time.Now()
 
 	// Create snapshot with error handling
-	snapshotURL, err := sm.createSnapshot(stream.Camera.ID, img)
+	alertID := newEventID()
+	snapshot, err := sm.createSnapshot(stream, img, clean, faces, alertID, SnapshotRulePoint)
 	if err != nil {
 		return fmt.Errorf("failed to create snapshot: %v", err)
 	}
 
+	// Start a pre/post-event clip if enabled for this camera
+	detectedAt := time.Now()
+	clipURL := sm.startClip(stream, detectedAt, snapshot.Key)
+
 	// Create alert
 	alert := Alert{
-		CameraID:    stream.Camera.ID,
-		DetectedAt:  time.Now(),
-		Description: fmt.Sprintf("Face detected on camera %s", stream.Camera.Name),
-		SnapshotURL: snapshotURL,
+		AlertID:      alertID,
+		CameraID:     stream.Camera.ID,
+		DetectedAt:   detectedAt,
+		Description:  fmt.Sprintf("Face detected on camera %s", stream.Camera.Name),
+		SnapshotURL:  snapshot.URL,
+		AnnotatedURL: snapshot.AnnotatedURL,
+		ThumbnailURL: snapshot.ThumbnailURL,
+		FaceCrops:    snapshot.FaceCrops,
+		ClipURL:      clipURL,
 		Metadata: map[string]interface{}{
-			"face_count": len(faces),
+			"face_count":  len(faces),
 			"camera_name": stream.Camera.Name,
 			"location":    stream.Camera.Location,
 		},
+		snapshot: snapshot,
 	}
 
-	// Send alert to backend with error handling
+	sm.hub.Publish(WSTypeAlert, alert.CameraID, alert)
+
+	// Send alert to backend once the snapshot is stored
 	go func() {
+		if err := snapshot.Wait(); err != nil {
+			alert.SnapshotURL = ""
+			alert.AnnotatedURL = ""
+			alert.ThumbnailURL = ""
+			alert.FaceCrops = nil
+		} else {
+			sm.saveAlertRecord(snapshot, alert)
+		}
 		if err := sm.sendAlert(alert); err != nil {
 			log.Printf("Failed to send alert for camera %s: %v", stream.Camera.ID, err)
 		}
 	}()
 
-	return nil
-}
-
-// createSnapshot creates a snapshot image and saves it
-func (sm *StreamManager) createSnapshot(cameraID string, img *gocv.Mat) (string, error) {
-	defer func() {
-		if r := recover(); r != nil {
-			log.Printf("Panic in createSnapshot for camera %s: %v", cameraID, r)
-		}
-	}()
-
-	if img == nil || img.Empty() {
-		return "", fmt.Errorf("image is nil or empty")
-	}
-
-	// Convert Mat to image
-	buf, err := gocv.IMEncode(".jpg", *img)
-	if err != nil {
-		return "", fmt.Errorf("failed to encode image: %v", err)
-	}
-	defer buf.Close()
-
-	// Decode to Go image
-	goImg, err := jpeg.Decode(bytes.NewReader(buf.GetBytes()))
-	if err != nil {
-		return "", fmt.Errorf("failed to decode image: %v", err)
+	// Queue email notification (grouped and rate limited by the notifier)
+	if sm.email != nil {
+		sm.email.Notify(alert, stream.Camera.Name)
 	}
 
-	// Create filename
-	filename := fmt.Sprintf("%s_%d.jpg", cameraID, time.Now().Unix())
-	filepath := fmt.Sprintf("%s/%s", sm.config.StoragePath, filename)
-
-	// Save image with error handling
-	file, err := os.Create(filepath)
-	if err != nil {
-		return "", fmt.Errorf("failed to create file %s: %v", filepath, err)
-	}
-	defer file.Close()
-
-	err = jpeg.Encode(file, goImg, &jpeg.Options{Quality: 80})
-	if err != nil {
-		return "", fmt.Errorf("failed to encode JPEG: %v", err)
-	}
-
-	// Return URL (assuming static file serving)
-	return fmt.Sprintf("/snapshots/%s", filename), nil
+	return nil
 }
 
 // sendAlert sends an alert to the backend API
@@ -526,17 +735,8 @@ func (sm *StreamManager) sendAlert(alert Alert) error {
 		}
 	}()
 
-	resp, err := sm.client.R().
-		SetHeader("Content-Type", "application/json").
-		SetBody(alert).
-		Post("/api/alerts")
-
-	if err != nil {
-		return fmt.Errorf("failed to send HTTP request: %v", err)
-	}
-
-	if resp.StatusCode() != http.StatusOK {
-		return fmt.Errorf("API returned status %d: %s", resp.StatusCode(), resp.String())
+	if err := sm.post("alert", "/api/alerts", alert); err != nil {
+		return err
 	}
 
 	log.Printf("Alert sent successfully for camera %s", alert.CameraID)
@@ -553,15 +753,36 @@ func (sm *StreamManager) GetStreamStatus() map[string]interface{} {
 		stream.Mutex.RLock()
 		elapsed := time.Since(stream.StartTime).Seconds()
 		fps := float64(stream.FrameCount) / elapsed
-		
-		status[id] = map[string]interface{}{
+
+		info := map[string]interface{}{
 			"camera_id":   id,
 			"camera_name": stream.Camera.Name,
 			"is_running":  stream.IsRunning,
 			"frame_count": stream.FrameCount,
 			"fps":         fps,
 			"uptime":      elapsed,
+			"recording":   stream.recorder != nil,
+		}
+		if stream.publisher != nil {
+			info["publisher"] = stream.publisher.Status()
 		}
+		if stream.rawPublisher != nil {
+			info["raw_publisher"] = stream.rawPublisher.Status()
+		}
+		if sm.mediamtx != nil {
+			paths, readers := sm.mediamtxStatus(stream.Camera)
+			info["mediamtx"] = paths
+			info["viewers"] = readers
+		}
+		if sm.rtsp != nil {
+			paths, readers := sm.rtspStatus(stream)
+			info["rtsp"] = paths
+			if viewers, ok := info["viewers"].(int); ok {
+				readers += viewers
+			}
+			info["viewers"] = readers
+		}
+		status[id] = info
 		stream.Mutex.RUnlock()
 	}
 
@@ -574,14 +795,14 @@ func panicRecoveryMiddleware() gin.HandlerFunc {
 		defer func() {
 			if r := recover(); r != nil {
 				log.Printf("Panic in HTTP handler: %v", r)
-				
+
 				// Log stack trace
 				buf := make([]byte, 1024)
 				n := runtime.Stack(buf, false)
 				log.Printf("Stack trace: %s", string(buf[:n]))
-				
+
 				c.JSON(http.StatusInternalServerError, gin.H{
-					"error": "Internal server error",
+					"error":   "Internal server error",
 					"message": "An unexpected error occurred",
 				})
 				c.Abort()
@@ -610,7 +831,7 @@ func (sm *StreamManager) handleStartStream(c *gin.Context) {
 
 func (sm *StreamManager) handleStopStream(c *gin.Context) {
 	cameraID := c.Param("id")
-	
+
 	err := sm.StopStream(cameraID)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
@@ -625,118 +846,6 @@ func (sm *StreamManager) handleStreamStatus(c *gin.Context) {
 	c.JSON(http.StatusOK, status)
 }
 
-// startPublisher starts an ffmpeg process that reads MJPEG frames from stdin and publishes H.264 to MediaMTX via RTSP
-func (sm *StreamManager) startPublisher(stream *CameraStream) error {
-	// Build RTSP publish URL
-	publishURL, err := sm.buildRTSPPublishURL(stream.Camera.ID)
-	if err != nil {
-		return err
-	}
-	stream.publishURL = publishURL
-
-	// FFmpeg command
-	args := []string{
-		"-y",               // overwrite
-		"-f", "mjpeg",      // input format
-		"-i", "-",          // read MJPEG from stdin
-		"-r", "25",         // frame rate
-		"-c:v", "libx264",  // H.264 encoding
-		"-preset", "veryfast",
-		"-tune", "zerolatency",
-		"-pix_fmt", "yuv420p",
-		"-f", "rtsp",
-		"-rtsp_transport", "tcp",
-		publishURL,
-	}
-
-	cmd := exec.Command("ffmpeg", args...)
-
-	// Capture stderr for debugging
-	stderrPipe, err := cmd.StderrPipe()
-	if err != nil {
-		return fmt.Errorf("failed to get ffmpeg stderr: %w", err)
-	}
-	go func() {
-		buf := make([]byte, 1024)
-		for {
-			n, err := stderrPipe.Read(buf)
-			if n > 0 {
-				log.Printf("[FFMPEG %s]: %s", stream.Camera.ID, string(buf[:n]))
-			}
-			if err != nil {
-				break
-			}
-		}
-	}()
-
-	stdin, err := cmd.StdinPipe()
-	if err != nil {
-		return fmt.Errorf("failed to get ffmpeg stdin: %w", err)
-	}
-
-	// Start ffmpeg process
-	if err := cmd.Start(); err != nil {
-		stdin.Close()
-		return fmt.Errorf("failed to start ffmpeg: %w", err)
-	}
-
-	stream.ffmpegCmd = cmd
-	stream.ffmpegIn = stdin
-	stream.published = true
-
-	log.Printf("Started publisher for camera %s -> %s", stream.Camera.ID, publishURL)
-
-	// Monitor ffmpeg process in goroutine
-	go func() {
-		err := cmd.Wait()
-		if err != nil {
-			log.Printf("FFmpeg exited for camera %s: %v", stream.Camera.ID, err)
-		} else {
-			log.Printf("FFmpeg finished for camera %s", stream.Camera.ID)
-		}
-		stream.Mutex.Lock()
-		stream.published = false
-		if stream.ffmpegIn != nil {
-			stream.ffmpegIn.Close()
-			stream.ffmpegIn = nil
-		}
-		stream.Mutex.Unlock()
-	}()
-
-	return nil
-}
-
-
-// stopPublisher stops the ffmpeg publisher for a stream if running
-func (sm *StreamManager) stopPublisher(stream *CameraStream) {
-	if stream == nil { return }
-	if stream.ffmpegIn != nil {
-		_ = stream.ffmpegIn.Close()
-		stream.ffmpegIn = nil
-	}
-	if stream.ffmpegCmd != nil {
-		// Try graceful stop
-		_ = stream.ffmpegCmd.Process.Signal(syscall.SIGINT)
-		_ = stream.ffmpegCmd.Wait()
-		stream.ffmpegCmd = nil
-	}
-	stream.published = false
-}
-
-// buildRTSPPublishURL builds an rtsp publish URL from MediaMTXURL and camera ID
-func (sm *StreamManager) buildRTSPPublishURL(cameraID string) (string, error) {
-	u, err := url.Parse(sm.config.MediaMTXURL)
-	if err != nil {
-		return "", fmt.Errorf("invalid MediaMTXURL: %w", err)
-	}
-	host := u.Hostname()
-	port := 8554
-	if host == "" {
-		host = "localhost"
-	}
-	return fmt.Sprintf("rtsp://%s:%d/%s", host, port, cameraID), nil
-}
-
 func main() {
 	defer func() {
 		if r := recover(); r != nil {
@@ -749,12 +858,61 @@ func main() {
 
 	// Load configuration with error handling
 	config := Config{
-		BackendURL:  "http://localhost:3000",
-		MediaMTXURL: "http://localhost:8888",
-		WorkerPort:  8080,
-		MaxStreams: 4,
-		FaceCascade: "haarcascade_frontalface_default.xml",
-		StoragePath: "./snapshots",
+		BackendURL:       "http://localhost:3000",
+		MediaMTXURL:      "http://localhost:8888",
+		WorkerPort:       8080,
+		MaxStreams:       4,
+		FaceCascade:      "haarcascade_frontalface_default.xml",
+		StoragePath:      "./snapshots",
+		AlertMode:        AlertModePoint,
+		EventIdleSeconds: 10,
+		Retention: RetentionConfig{
+			IntervalSeconds: 300,
+			FlagsFile:       "./retention-flags.json",
+		},
+		Clips: ClipConfig{
+			PreSeconds:  5,
+			PostSeconds: 5,
+			MaxSeconds:  30,
+		},
+		Recording: RecordingConfig{
+			Source:           RecordingSourceRaw,
+			SegmentSeconds:   300,
+			RetentionHours:   168,
+			Path:             "./recordings",
+			MaxExportMinutes: 60,
+			MaxExports:       2,
+		},
+		Timelapse: TimelapseConfig{
+			IntervalSeconds: 10,
+			FPS:             30,
+			Width:           1280,
+			ActivityPercent: 20,
+			FramesPath:      "./timelapse-frames",
+		},
+		Publisher: PublisherConfig{
+			StallSeconds:        15,
+			MaxBackoffSeconds:   30,
+			OnDemandIdleSeconds: 30,
+		},
+		Export: ExportConfig{
+			Path:      "./exports",
+			KeepHours: 72,
+		},
+		MediaMTX: MediaMTXConfig{
+			PollSeconds: 5,
+		},
+		RTSPServer: RTSPServerConfig{
+			Address: ":8554",
+			UDPPort: 8000,
+		},
+		Email: EmailConfig{
+			Port:               587,
+			StartTLS:           true,
+			GroupWindowSeconds: 60,
+			MaxPerHour:         20,
+			MaxAttachments:     5,
+		},
 	}
 
 	// Load config from environment variables first
@@ -764,6 +922,27 @@ func main() {
 	if mediamtxURL := os.Getenv("MEDIAMTX_URL"); mediamtxURL != "" {
 		config.MediaMTXURL = mediamtxURL
 	}
+	if mediamtxAPI := os.Getenv("MEDIAMTX_API_ENABLED"); mediamtxAPI != "" {
+		config.MediaMTX.Enabled = mediamtxAPI == "true"
+	}
+	if mediamtxAPIURL := os.Getenv("MEDIAMTX_API_URL"); mediamtxAPIURL != "" {
+		config.MediaMTX.APIURL = mediamtxAPIURL
+	}
+	if mediamtxAPIUser := os.Getenv("MEDIAMTX_API_USER"); mediamtxAPIUser != "" {
+		config.MediaMTX.APIUser = mediamtxAPIUser
+	}
+	if mediamtxAPIPass := os.Getenv("MEDIAMTX_API_PASS"); mediamtxAPIPass != "" {
+		config.MediaMTX.APIPass = mediamtxAPIPass
+	}
+	if rtspServer := os.Getenv("RTSP_SERVER_ENABLED"); rtspServer != "" {
+		config.RTSPServer.Enabled = rtspServer == "true"
+	}
+	if readUser := os.Getenv("RTSP_SERVER_READ_USER"); readUser != "" {
+		config.RTSPServer.ReadUser = readUser
+	}
+	if readPass := os.Getenv("RTSP_SERVER_READ_PASS"); readPass != "" {
+		config.RTSPServer.ReadPass = readPass
+	}
 	if workerPort := os.Getenv("WORKER_PORT"); workerPort != "" {
 		if port, err := strconv.Atoi(workerPort); err == nil {
 			config.WorkerPort = port
@@ -780,6 +959,119 @@ func main() {
 	if storagePath := os.Getenv("STORAGE_PATH"); storagePath != "" {
 		config.StoragePath = storagePath
 	}
+	if storageBackend := os.Getenv("STORAGE_BACKEND"); storageBackend != "" {
+		config.Storage.Backend = storageBackend
+	}
+	if publicURL := os.Getenv("STORAGE_PUBLIC_URL"); publicURL != "" {
+		config.Storage.PublicURL = publicURL
+	}
+	if s3Endpoint := os.Getenv("S3_ENDPOINT"); s3Endpoint != "" {
+		config.Storage.S3.Endpoint = s3Endpoint
+	}
+	if s3Bucket := os.Getenv("S3_BUCKET"); s3Bucket != "" {
+		config.Storage.S3.Bucket = s3Bucket
+	}
+	if s3Region := os.Getenv("S3_REGION"); s3Region != "" {
+		config.Storage.S3.Region = s3Region
+	}
+	if s3AccessKey := os.Getenv("S3_ACCESS_KEY"); s3AccessKey != "" {
+		config.Storage.S3.AccessKey = s3AccessKey
+	}
+	if s3SecretKey := os.Getenv("S3_SECRET_KEY"); s3SecretKey != "" {
+		config.Storage.S3.SecretKey = s3SecretKey
+	}
+	if encryption := os.Getenv("ENCRYPTION_ENABLED"); encryption != "" {
+		config.Storage.Encryption.Enabled = encryption == "true"
+	}
+	if keyFile := os.Getenv("ENCRYPTION_KEY_FILE"); keyFile != "" {
+		config.Storage.Encryption.KeyFile = keyFile
+	}
+	if accessToken := os.Getenv("MEDIA_ACCESS_TOKEN"); accessToken != "" {
+		config.Storage.Encryption.AccessToken = accessToken
+	}
+	if snapshotFormat := os.Getenv("SNAPSHOT_FORMAT"); snapshotFormat != "" {
+		config.Snapshots.Format = snapshotFormat
+	}
+	if snapshotVariant := os.Getenv("SNAPSHOT_VARIANT"); snapshotVariant != "" {
+		config.Snapshots.Variant = snapshotVariant
+	}
+	if recording := os.Getenv("RECORDING_ENABLED"); recording != "" {
+		config.Recording.Enabled = recording == "true"
+	}
+	if recordingSource := os.Getenv("RECORDING_SOURCE"); recordingSource != "" {
+		config.Recording.Source = recordingSource
+	}
+	if recordingPath := os.Getenv("RECORDING_PATH"); recordingPath != "" {
+		config.Recording.Path = recordingPath
+	}
+	if recordingHours := os.Getenv("RECORDING_RETENTION_HOURS"); recordingHours != "" {
+		if hours, err := strconv.Atoi(recordingHours); err == nil {
+			config.Recording.RetentionHours = hours
+		}
+	}
+	if timelapse := os.Getenv("TIMELAPSE_ENABLED"); timelapse != "" {
+		config.Timelapse.Enabled = timelapse == "true"
+	}
+	if exportPath := os.Getenv("EXPORT_PATH"); exportPath != "" {
+		config.Export.Path = exportPath
+	}
+	if maxAge := os.Getenv("RETENTION_MAX_AGE_HOURS"); maxAge != "" {
+		if hours, err := strconv.Atoi(maxAge); err == nil {
+			config.Retention.MaxAgeHours = hours
+		}
+	}
+	if maxTotal := os.Getenv("RETENTION_MAX_TOTAL_MB"); maxTotal != "" {
+		if mb, err := strconv.Atoi(maxTotal); err == nil {
+			config.Retention.MaxTotalMB = mb
+		}
+	}
+	if alertMode := os.Getenv("ALERT_MODE"); alertMode != "" {
+		config.AlertMode = alertMode
+	}
+	if eventIdle := os.Getenv("EVENT_IDLE_SECONDS"); eventIdle != "" {
+		if seconds, err := strconv.Atoi(eventIdle); err == nil {
+			config.EventIdleSeconds = seconds
+		}
+	}
+	if backendToken := os.Getenv("BACKEND_TOKEN"); backendToken != "" {
+		config.BackendAuth.Token = backendToken
+	}
+	if jwtSecret := os.Getenv("BACKEND_JWT_SECRET"); jwtSecret != "" {
+		config.BackendAuth.JWTSecret = jwtSecret
+	}
+	if userID := os.Getenv("BACKEND_USER_ID"); userID != "" {
+		config.BackendAuth.UserID = userID
+	}
+	if caFile := os.Getenv("BACKEND_CA_FILE"); caFile != "" {
+		config.BackendAuth.CAFile = caFile
+	}
+	if clientCert := os.Getenv("BACKEND_CLIENT_CERT"); clientCert != "" {
+		config.BackendAuth.ClientCert = clientCert
+	}
+	if clientKey := os.Getenv("BACKEND_CLIENT_KEY"); clientKey != "" {
+		config.BackendAuth.ClientKey = clientKey
+	}
+	if smtpHost := os.Getenv("SMTP_HOST"); smtpHost != "" {
+		config.Email.Enabled = true
+		config.Email.Host = smtpHost
+	}
+	if smtpPort := os.Getenv("SMTP_PORT"); smtpPort != "" {
+		if port, err := strconv.Atoi(smtpPort); err == nil {
+			config.Email.Port = port
+		}
+	}
+	if smtpUsername := os.Getenv("SMTP_USERNAME"); smtpUsername != "" {
+		config.Email.Username = smtpUsername
+	}
+	if smtpPassword := os.Getenv("SMTP_PASSWORD"); smtpPassword != "" {
+		config.Email.Password = smtpPassword
+	}
+	if smtpFrom := os.Getenv("SMTP_FROM"); smtpFrom != "" {
+		config.Email.From = smtpFrom
+	}
+	if smtpTo := os.Getenv("SMTP_TO"); smtpTo != "" {
+		config.Email.To = strings.Split(smtpTo, ",")
+	}
 
 	// Load config from file if exists
 	if data, err := os.ReadFile("config.yaml"); err == nil {
@@ -788,8 +1080,24 @@ func main() {
 		}
 	}
 
-	log.Printf("Configuration loaded: BackendURL=%s, WorkerPort=%d, MaxStreams=%d", 
-		config.BackendURL, config.WorkerPort, config.MaxStreams)
+	switch config.AlertMode {
+	case AlertModePoint, AlertModeEvents, AlertModeBoth:
+	default:
+		log.Fatalf("Invalid alert_mode %q (expected %s, %s or %s)", config.AlertMode, AlertModePoint, AlertModeEvents, AlertModeBoth)
+	}
+
+	log.Printf("Configuration loaded: BackendURL=%s, WorkerPort=%d, MaxStreams=%d, AlertMode=%s",
+		config.BackendURL, config.WorkerPort, config.MaxStreams, config.AlertMode)
+
+	if err := config.Snapshots.validate(); err != nil {
+		log.Fatal("Invalid snapshot configuration:", err)
+	}
+	if err := config.Storage.validate(config.WorkerPort); err != nil {
+		log.Fatal("Invalid storage configuration:", err)
+	}
+	if err := config.validateMediaAuth(); err != nil {
+		log.Fatal("Invalid storage configuration:", err)
+	}
 
 	// Create storage directory with error handling
 	if err := os.MkdirAll(config.StoragePath, 0755); err != nil {
@@ -808,8 +1116,6 @@ func main() {
 	r.Use(panicRecoveryMiddleware())
 
 	// API routes
-	r.POST("/stream/start", sm.handleStartStream)
-	r.POST("/stream/stop/:id", sm.handleStopStream)
 	r.GET("/stream/status", sm.handleStreamStatus)
 
 	// Health check
@@ -817,8 +1123,64 @@ func main() {
 		c.JSON(http.StatusOK, gin.H{"status": "healthy"})
 	})
 
-	// Serve snapshots statically
-	r.Static("/snapshots", config.StoragePath)
+	// Backend delivery status and metrics
+	r.GET("/backend/status", sm.handleBackendStatus)
+	r.GET("/metrics", sm.handleMetrics)
+
+	// Routes that control streams, expose frames, stored media or events, or
+	// start jobs on them, need a token when media is encrypted or credentials
+	// are set
+	auth := r.Group("/")
+	if config.authRequired() {
+		auth.Use(sm.mediaAuth)
+	}
+
+	// Stream control
+	auth.POST("/stream/start", sm.handleStartStream)
+	auth.POST("/stream/stop/:id", sm.handleStopStream)
+	auth.POST("/stream/restart-publisher/:id", sm.handleRestartPublisher)
+	auth.GET("/stream/demand", sm.handleDemand)
+
+	// Live MJPEG view and latest still of the frames
+	auth.GET("/stream/:id/mjpeg", sm.handleMJPEG)
+	auth.GET("/stream/:id/frame.jpg", sm.handleLatestFrame)
+
+	// Live events over WebSocket
+	auth.GET("/ws", sm.handleWebSocket)
+
+	// Snapshot storage usage and retention flags
+	auth.GET("/storage/usage", sm.handleStorageUsage)
+	auth.POST("/storage/flag", sm.handleFlagSnapshot)
+
+	// Snapshot archive queries
+	auth.GET("/archive/snapshots", sm.handleListSnapshots)
+
+	// Continuous recordings
+	auth.GET("/recordings", sm.handleListRecordings)
+	auth.POST("/recordings/export", sm.handleExportRecording)
+	auth.GET("/recordings/export/:id", sm.handleRecordingExportStatus)
+	auth.Static("/recordings/files", config.Recording.Path)
+
+	// Timelapse videos
+	auth.POST("/timelapse/build", sm.handleBuildTimelapse)
+	auth.GET("/timelapse/build/:id", sm.handleTimelapseBuildStatus)
+
+	// Evidence export bundles
+	auth.POST("/export", sm.handleCreateExport)
+	auth.GET("/export/:id", sm.handleExportStatus)
+	auth.GET("/export/:id/download", sm.handleExportDownload)
+
+	// Key rotation of encrypted media (503 when encryption is off)
+	auth.POST("/storage/rotate-keys", sm.handleRotateKeys)
+	auth.GET("/storage/rotate-keys", sm.handleRotationStatus)
+
+	// Serve snapshots decrypted through an authorized endpoint when media is
+	// encrypted at rest, or statically for the URLs sent with alerts
+	if config.Storage.Encryption.Enabled {
+		auth.GET("/media/*key", sm.handleMedia)
+	} else {
+		r.Static("/snapshots", config.StoragePath)
+	}
 
 	// Start server
 	server := &http.Server{
@@ -832,7 +1194,7 @@ func main() {
 				log.Printf("Panic in server goroutine: %v", r)
 			}
 		}()
-		
+
 		log.Printf("Worker service starting on port %d", config.WorkerPort)
 		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			log.Fatal("Failed to start server:", err)
@@ -875,13 +1237,29 @@ AfterReady:
 	sm.streamMutex.Lock()
 	for id, stream := range sm.streams {
 		stream.Cancel()
-		if stream.Capture != nil {
-			stream.Capture.Close() // FIXED: Proper indentation
+		stream.closeCapture()
+		sm.endEvent(stream)
+		if stream.ring != nil {
+			stream.ring.Flush()
 		}
+		sm.stopPublisher(stream)
+		sm.stopRecorder(stream)
 		log.Printf("Stopped stream for camera %s", id)
 	}
 	sm.streamMutex.Unlock()
 
+	// Give the ended events a chance to reach the backend
+	sm.waitForEvents(5 * time.Second)
+
+	// Send any grouped alert emails that are still pending
+	if sm.email != nil {
+		sm.email.Close()
+	}
+
+	if sm.rtsp != nil {
+		sm.rtsp.Close()
+	}
+
 	// Shutdown server with timeout
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
@@ -891,4 +1269,4 @@ AfterReady:
 	}
 
 	log.Println("Worker service exited")
-}
\ No newline at end of file
+}
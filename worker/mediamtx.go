@@ -0,0 +1,454 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+)
+
+// MediaMTXConfig enables the MediaMTX control API: managed paths with
+// publish/read credentials, a data check of each path and reader counts
+type MediaMTXConfig struct {
+	Enabled     bool   `yaml:"enabled"`
+	APIURL      string `yaml:"api_url"` // default http://<mediamtx_url host>:9997
+	APIUser     string `yaml:"api_user"`
+	APIPass     string `yaml:"api_pass"`
+	PublishUser string `yaml:"publish_user"`
+	PublishPass string `yaml:"publish_pass"`
+	ReadUser    string `yaml:"read_user"`
+	ReadPass    string `yaml:"read_pass"`
+	PollSeconds int    `yaml:"poll_seconds"`
+	// RunOnDemand is set as runOnDemand of the paths of on-demand cameras,
+	// e.g. "wget -qO- http://worker:8080/stream/demand?path=$MTX_PATH"
+	RunOnDemand string `yaml:"run_on_demand"`
+}
+
+// MediaMTXPathStatus is what MediaMTX reports about one of a camera's paths
+type MediaMTXPathStatus struct {
+	Path          string    `json:"path"`
+	Ready         bool      `json:"ready"`
+	Receiving     bool      `json:"receiving"`
+	BytesReceived uint64    `json:"bytes_received"`
+	Readers       int       `json:"readers"`
+	LastData      time.Time `json:"last_data,omitempty"`
+}
+
+// mediamtxPath is an item of /v3/paths/list
+type mediamtxPath struct {
+	Name          string `json:"name"`
+	Ready         bool   `json:"ready"`
+	BytesReceived uint64 `json:"bytesReceived"`
+	Readers       []struct {
+		Type string `json:"type"`
+	} `json:"readers"`
+}
+
+// mediamtxUser is an entry of authInternalUsers in the MediaMTX config
+type mediamtxUser struct {
+	User        string               `json:"user"`
+	Pass        string               `json:"pass"`
+	IPs         []string             `json:"ips"`
+	Permissions []mediamtxPermission `json:"permissions"`
+}
+
+// mediamtxPermission allows an action on a path
+type mediamtxPermission struct {
+	Action string `json:"action"`
+	Path   string `json:"path,omitempty"`
+}
+
+// MediaMTX talks to the MediaMTX control API
+type MediaMTX struct {
+	config MediaMTXConfig
+	host   string
+	client *resty.Client
+	// Serializes read-modify-write changes of the global config
+	configMutex sync.Mutex
+	mutex       sync.RWMutex
+	paths       map[string]*MediaMTXPathStatus
+}
+
+// NewMediaMTX creates the API client; it returns nil when the API is disabled
+func NewMediaMTX(config Config) (*MediaMTX, error) {
+	if !config.MediaMTX.Enabled {
+		return nil, nil
+	}
+	u, err := url.Parse(config.MediaMTXURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid MediaMTXURL: %v", err)
+	}
+	host := u.Hostname()
+	if host == "" {
+		host = "localhost"
+	}
+	apiURL := config.MediaMTX.APIURL
+	if apiURL == "" {
+		apiURL = "http://" + net.JoinHostPort(host, "9997")
+	}
+
+	client := resty.New()
+	client.SetBaseURL(strings.TrimSuffix(apiURL, "/"))
+	client.SetTimeout(5 * time.Second)
+	if config.MediaMTX.APIUser != "" {
+		client.SetBasicAuth(config.MediaMTX.APIUser, config.MediaMTX.APIPass)
+	}
+
+	log.Printf("MediaMTX API configured: %s", apiURL)
+	return &MediaMTX{
+		config: config.MediaMTX,
+		host:   host,
+		client: client,
+		paths:  make(map[string]*MediaMTXPathStatus),
+	}, nil
+}
+
+// request starts an API request. Results are decoded even if a proxy drops
+// the content type: a config read that silently came back empty would wipe
+// the users on write.
+func (m *MediaMTX) request() *resty.Request {
+	return m.client.R().ForceContentType("application/json")
+}
+
+// escapePathName escapes each segment of a path name for an API URL
+func escapePathName(name string) string {
+	segments := strings.Split(name, "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	return strings.Join(segments, "/")
+}
+
+// apiError turns a failed request or an error response into an error
+func apiError(action string, resp *resty.Response, err error) error {
+	if err != nil {
+		return fmt.Errorf("MediaMTX %s failed: %v", action, err)
+	}
+	if resp.IsError() {
+		return fmt.Errorf("MediaMTX %s failed: %s: %s", action, resp.Status(), strings.TrimSpace(resp.String()))
+	}
+	return nil
+}
+
+// AddPaths creates paths that only accept a publisher and grants the
+// configured credentials on them. Existing paths are updated. Paths of an
+// on-demand camera run the run_on_demand hook when a reader arrives.
+func (m *MediaMTX) AddPaths(names []string, onDemand bool) error {
+	conf := map[string]interface{}{
+		"source": "publisher",
+		// A restarted ffmpeg takes over from its stale session
+		"overridePublisher": true,
+		"runOnDemand":       "",
+	}
+	if onDemand && m.config.RunOnDemand != "" {
+		conf["runOnDemand"] = m.config.RunOnDemand
+		// Reopen the hook if the worker restarts while readers wait
+		conf["runOnDemandRestart"] = true
+	}
+	for _, name := range names {
+		resp, err := m.request().SetBody(conf).Post("/v3/config/paths/add/" + escapePathName(name))
+		if err == nil && resp.StatusCode() == 400 && strings.Contains(resp.String(), "already exists") {
+			resp, err = m.request().SetBody(conf).Patch("/v3/config/paths/patch/" + escapePathName(name))
+		}
+		if err := apiError("add path "+name, resp, err); err != nil {
+			return err
+		}
+	}
+	return m.setPermissions(names, true)
+}
+
+// RemovePaths revokes the credentials on paths and deletes them
+func (m *MediaMTX) RemovePaths(names []string) error {
+	if err := m.setPermissions(names, false); err != nil {
+		return err
+	}
+	for _, name := range names {
+		resp, err := m.request().Delete("/v3/config/paths/delete/" + escapePathName(name))
+		if err == nil && resp.StatusCode() == 404 {
+			continue
+		}
+		if err := apiError("delete path "+name, resp, err); err != nil {
+			return err
+		}
+	}
+	m.mutex.Lock()
+	for _, name := range names {
+		delete(m.paths, name)
+	}
+	m.mutex.Unlock()
+	return nil
+}
+
+// setPermissions grants or revokes publish and read permissions on paths for
+// the configured users in authInternalUsers. Users left without permissions
+// are removed.
+func (m *MediaMTX) setPermissions(names []string, grant bool) error {
+	var grants []mediamtxUser
+	if m.config.PublishUser != "" {
+		grants = append(grants, mediamtxUser{User: m.config.PublishUser, Pass: m.config.PublishPass, Permissions: []mediamtxPermission{{Action: "publish"}}})
+	}
+	if m.config.ReadUser != "" {
+		grants = append(grants, mediamtxUser{User: m.config.ReadUser, Pass: m.config.ReadPass, Permissions: []mediamtxPermission{{Action: "read"}, {Action: "playback"}}})
+	}
+	if len(grants) == 0 {
+		return nil
+	}
+
+	m.configMutex.Lock()
+	defer m.configMutex.Unlock()
+
+	var global struct {
+		AuthInternalUsers []mediamtxUser `json:"authInternalUsers"`
+	}
+	resp, err := m.request().SetResult(&global).Get("/v3/config/global/get")
+	if err := apiError("get config", resp, err); err != nil {
+		return err
+	}
+
+	users := global.AuthInternalUsers
+	for _, g := range grants {
+		i := -1
+		for j := range users {
+			if users[j].User == g.User && users[j].Pass == g.Pass {
+				i = j
+				break
+			}
+		}
+		if i < 0 {
+			if !grant {
+				continue
+			}
+			users = append(users, mediamtxUser{User: g.User, Pass: g.Pass, IPs: []string{}})
+			i = len(users) - 1
+		}
+		for _, name := range names {
+			for _, action := range g.Permissions {
+				users[i].Permissions = setPermission(users[i].Permissions, mediamtxPermission{Action: action.Action, Path: name}, grant)
+			}
+		}
+	}
+
+	kept := make([]mediamtxUser, 0, len(users))
+	for _, u := range users {
+		if len(u.Permissions) > 0 {
+			kept = append(kept, u)
+		}
+	}
+	resp, err = m.request().SetBody(map[string]interface{}{"authInternalUsers": kept}).Patch("/v3/config/global/patch")
+	return apiError("update users", resp, err)
+}
+
+// setPermission adds or removes a permission from a list
+func setPermission(list []mediamtxPermission, p mediamtxPermission, grant bool) []mediamtxPermission {
+	for i, existing := range list {
+		if existing == p {
+			if grant {
+				return list
+			}
+			return append(list[:i], list[i+1:]...)
+		}
+	}
+	if grant {
+		list = append(list, p)
+	}
+	return list
+}
+
+// poll refreshes the status of every path from /v3/paths/list
+func (m *MediaMTX) poll() error {
+	var items []mediamtxPath
+	for page := 0; ; page++ {
+		var result struct {
+			PageCount int            `json:"pageCount"`
+			Items     []mediamtxPath `json:"items"`
+		}
+		resp, err := m.request().
+			SetQueryParam("page", fmt.Sprint(page)).
+			SetQueryParam("itemsPerPage", "500").
+			SetResult(&result).
+			Get("/v3/paths/list")
+		if err := apiError("list paths", resp, err); err != nil {
+			return err
+		}
+		items = append(items, result.Items...)
+		if page+1 >= result.PageCount {
+			break
+		}
+	}
+
+	now := time.Now()
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	seen := make(map[string]bool, len(items))
+	for _, item := range items {
+		seen[item.Name] = true
+		status, ok := m.paths[item.Name]
+		if !ok {
+			status = &MediaMTXPathStatus{Path: item.Name}
+			m.paths[item.Name] = status
+		}
+		// A byte count that moved since the last poll is data arriving
+		status.Receiving = item.Ready && ok && item.BytesReceived > status.BytesReceived
+		if status.Receiving {
+			status.LastData = now
+		}
+		status.Ready = item.Ready
+		status.BytesReceived = item.BytesReceived
+		status.Readers = len(item.Readers)
+	}
+	for name, status := range m.paths {
+		if !seen[name] {
+			// MediaMTX only lists paths that are configured or in use
+			status.Ready, status.Receiving, status.BytesReceived, status.Readers = false, false, 0, 0
+		}
+	}
+	return nil
+}
+
+// PathStatus returns the last known status of a path
+func (m *MediaMTX) PathStatus(name string) MediaMTXPathStatus {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	if status, ok := m.paths[name]; ok {
+		return *status
+	}
+	return MediaMTXPathStatus{Path: name}
+}
+
+// pollInterval returns the time between polls of /v3/paths/list
+func (m *MediaMTX) pollInterval() time.Duration {
+	if m.config.PollSeconds > 0 {
+		return time.Duration(m.config.PollSeconds) * time.Second
+	}
+	return 5 * time.Second
+}
+
+// IsTarget reports whether a publish output goes to this MediaMTX
+func (m *MediaMTX) IsTarget(o publishOutput) bool {
+	u, err := url.Parse(o.url)
+	return err == nil && u.Hostname() == m.host
+}
+
+// variantPath returns the publish path of a camera's raw or annotated stream
+func (sm *StreamManager) variantPath(camera Camera, variant string) string {
+	path := sm.publishPath(camera)
+	if variant == FrameAnnotated && sm.publishRaw(camera) {
+		path += annotatedPathSuffix
+	}
+	return path
+}
+
+// mediamtxPath returns the MediaMTX path name of a camera's raw or annotated
+// stream. Publish paths are URL-escaped; MediaMTX names paths unescaped.
+func (sm *StreamManager) mediamtxPath(camera Camera, variant string) string {
+	path := sm.variantPath(camera, variant)
+	if name, err := url.PathUnescape(path); err == nil {
+		return name
+	}
+	return path
+}
+
+// mediamtxPaths returns the MediaMTX paths a camera publishes to
+func (sm *StreamManager) mediamtxPaths(camera Camera) []string {
+	if sm.mediamtx == nil {
+		return nil
+	}
+	var paths []string
+	variants := []string{FrameAnnotated}
+	if sm.publishRaw(camera) {
+		variants = append(variants, FrameRaw)
+	}
+	for _, variant := range variants {
+		outputs, err := sm.publishOutputs(camera, variant)
+		if err != nil {
+			continue
+		}
+		for _, o := range outputs {
+			if sm.mediamtx.IsTarget(o) {
+				paths = append(paths, sm.mediamtxPath(camera, variant))
+				break
+			}
+		}
+	}
+	return paths
+}
+
+// mediamtxStatus returns the MediaMTX paths of a stream and its total
+// number of readers
+func (sm *StreamManager) mediamtxStatus(camera Camera) ([]MediaMTXPathStatus, int) {
+	var paths []MediaMTXPathStatus
+	readers := 0
+	for _, name := range sm.mediamtxPaths(camera) {
+		status := sm.mediamtx.PathStatus(name)
+		readers += status.Readers
+		paths = append(paths, status)
+	}
+	return paths, readers
+}
+
+// runMediaMTXMonitor polls MediaMTX and restarts a publisher that reports
+// running while its path has received no data for stall_seconds
+func (sm *StreamManager) runMediaMTXMonitor() {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Panic in MediaMTX monitor: %v", r)
+		}
+	}()
+
+	failing := false
+	for {
+		time.Sleep(sm.mediamtx.pollInterval())
+		if err := sm.mediamtx.poll(); err != nil {
+			if !failing {
+				log.Printf("MediaMTX monitor: %v", err)
+			}
+			failing = true
+			continue
+		}
+		failing = false
+		sm.checkMediaMTXPaths()
+	}
+}
+
+// checkMediaMTXPaths hands the reader counts to the publishers and restarts
+// those whose path isn't receiving data
+func (sm *StreamManager) checkMediaMTXPaths() {
+	stall := time.Duration(sm.config.Publisher.StallSeconds) * time.Second
+
+	sm.streamMutex.RLock()
+	defer sm.streamMutex.RUnlock()
+	for _, stream := range sm.streams {
+		paths := sm.mediamtxPaths(stream.Camera)
+		for _, p := range []struct {
+			publisher *Publisher
+			path      string
+		}{
+			{stream.publisher, sm.mediamtxPath(stream.Camera, FrameAnnotated)},
+			{stream.rawPublisher, sm.mediamtxPath(stream.Camera, FrameRaw)},
+		} {
+			if p.publisher == nil || !containsString(paths, p.path) {
+				continue
+			}
+			path := sm.mediamtx.PathStatus(p.path)
+			p.publisher.SetReaders(path.Readers)
+
+			status := p.publisher.Status()
+			if stall <= 0 || status.State != PublisherRunning || time.Since(status.StartedAt) < stall {
+				continue
+			}
+			last := path.LastData
+			if last.Before(status.StartedAt) {
+				last = status.StartedAt
+			}
+			if time.Since(last) > stall {
+				log.Printf("MediaMTX path %s received no data for %s, restarting publisher of camera %s", p.path, stall, stream.Camera.ID)
+				p.publisher.Restart()
+			}
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestSetPermission(t *testing.T) {
+	read := mediamtxPermission{Action: "read", Path: "cam-1"}
+	publish := mediamtxPermission{Action: "publish", Path: "cam-1"}
+	tests := []struct {
+		list  []mediamtxPermission
+		p     mediamtxPermission
+		grant bool
+		want  []mediamtxPermission
+	}{
+		{nil, read, true, []mediamtxPermission{read}},
+		{[]mediamtxPermission{read}, read, true, []mediamtxPermission{read}},
+		{[]mediamtxPermission{read}, publish, true, []mediamtxPermission{read, publish}},
+		{[]mediamtxPermission{read, publish}, read, false, []mediamtxPermission{publish}},
+		{[]mediamtxPermission{publish}, read, false, []mediamtxPermission{publish}},
+	}
+	for _, tt := range tests {
+		list := append([]mediamtxPermission(nil), tt.list...)
+		if got := setPermission(list, tt.p, tt.grant); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("setPermission(%v, %v, %v) = %v, want %v", tt.list, tt.p, tt.grant, got, tt.want)
+		}
+	}
+}
+
+// fakeMediaMTX is the part of the MediaMTX API the worker uses
+type fakeMediaMTX struct {
+	mutex sync.Mutex
+	paths map[string]map[string]interface{}
+	users []mediamtxUser
+	list  []mediamtxPath
+}
+
+func (f *fakeMediaMTX) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	var body map[string]interface{}
+	if r.Body != nil {
+		json.NewDecoder(r.Body).Decode(&body)
+	}
+	switch p := r.URL.Path; {
+	case r.Method == http.MethodPost && strings.HasPrefix(p, "/v3/config/paths/add/"):
+		name := strings.TrimPrefix(p, "/v3/config/paths/add/")
+		if _, ok := f.paths[name]; ok {
+			http.Error(w, `{"error":"path already exists"}`, http.StatusBadRequest)
+			return
+		}
+		f.paths[name] = body
+	case r.Method == http.MethodPatch && strings.HasPrefix(p, "/v3/config/paths/patch/"):
+		name := strings.TrimPrefix(p, "/v3/config/paths/patch/")
+		for k, v := range body {
+			f.paths[name][k] = v
+		}
+	case r.Method == http.MethodDelete && strings.HasPrefix(p, "/v3/config/paths/delete/"):
+		name := strings.TrimPrefix(p, "/v3/config/paths/delete/")
+		if _, ok := f.paths[name]; !ok {
+			http.Error(w, `{"error":"path not found"}`, http.StatusNotFound)
+			return
+		}
+		delete(f.paths, name)
+	case r.Method == http.MethodGet && p == "/v3/config/global/get":
+		json.NewEncoder(w).Encode(map[string]interface{}{"authInternalUsers": f.users})
+	case r.Method == http.MethodPatch && p == "/v3/config/global/patch":
+		data, _ := json.Marshal(body["authInternalUsers"])
+		f.users = nil
+		json.Unmarshal(data, &f.users)
+	case r.Method == http.MethodGet && p == "/v3/paths/list":
+		// One item per page, to exercise paging
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		items := []mediamtxPath{}
+		if page < len(f.list) {
+			items = append(items, f.list[page])
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"pageCount": len(f.list), "items": items})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestMediaMTXPaths(t *testing.T) {
+	admin := mediamtxUser{User: "admin", Pass: "admin", IPs: []string{}, Permissions: []mediamtxPermission{{Action: "api"}}}
+	api := &fakeMediaMTX{paths: make(map[string]map[string]interface{}), users: []mediamtxUser{admin}}
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	var config Config
+	config.MediaMTXURL = "rtsp://mediamtx:8554"
+	config.MediaMTX = MediaMTXConfig{
+		Enabled:     true,
+		APIURL:      server.URL,
+		PublishUser: "worker",
+		PublishPass: "pub",
+		ReadUser:    "viewer",
+		ReadPass:    "read",
+		RunOnDemand: "wget -qO- http://worker:8080/stream/demand?path=$MTX_PATH",
+	}
+	m, err := NewMediaMTX(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := []string{"hq/front door", "hq/front door_annotated"}
+	if err := m.AddPaths(names, false); err != nil {
+		t.Fatal(err)
+	}
+	// Adding again updates the existing paths
+	if err := m.AddPaths(names, true); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		conf, ok := api.paths[name]
+		if !ok {
+			t.Fatalf("path %q not created, have %v", name, api.paths)
+		}
+		if conf["source"] != "publisher" || conf["runOnDemand"] != config.MediaMTX.RunOnDemand || conf["runOnDemandRestart"] != true {
+			t.Errorf("path %q config = %v", name, conf)
+		}
+	}
+	want := []mediamtxUser{
+		admin,
+		{User: "worker", Pass: "pub", IPs: []string{}, Permissions: []mediamtxPermission{
+			{Action: "publish", Path: names[0]}, {Action: "publish", Path: names[1]},
+		}},
+		{User: "viewer", Pass: "read", IPs: []string{}, Permissions: []mediamtxPermission{
+			{Action: "read", Path: names[0]}, {Action: "playback", Path: names[0]},
+			{Action: "read", Path: names[1]}, {Action: "playback", Path: names[1]},
+		}},
+	}
+	if !reflect.DeepEqual(api.users, want) {
+		t.Errorf("users after AddPaths = %+v, want %+v", api.users, want)
+	}
+
+	// Removing one path keeps the other's permissions
+	if err := m.RemovePaths(names[1:]); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := api.paths[names[1]]; ok {
+		t.Errorf("path %q not deleted", names[1])
+	}
+	want[1].Permissions = want[1].Permissions[:1]
+	want[2].Permissions = want[2].Permissions[:2]
+	if !reflect.DeepEqual(api.users, want) {
+		t.Errorf("users after removing one path = %+v, want %+v", api.users, want)
+	}
+
+	// Users left without permissions are dropped, other users are untouched,
+	// and paths that are already gone are not an error
+	api.paths = make(map[string]map[string]interface{})
+	if err := m.RemovePaths(names); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(api.users, []mediamtxUser{admin}) {
+		t.Errorf("users after removing all paths = %+v, want only admin", api.users)
+	}
+}
+
+func TestMediaMTXPoll(t *testing.T) {
+	api := &fakeMediaMTX{}
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	var config Config
+	config.MediaMTX = MediaMTXConfig{Enabled: true, APIURL: server.URL}
+	m, err := NewMediaMTX(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var watched mediamtxPath
+	if err := json.Unmarshal([]byte(`{"name":"cam-1","ready":true,"bytesReceived":250,"readers":[{"type":"rtspSession"},{"type":"webRTCSession"}]}`), &watched); err != nil {
+		t.Fatal(err)
+	}
+	poll := func(list ...mediamtxPath) {
+		t.Helper()
+		api.mutex.Lock()
+		api.list = list
+		api.mutex.Unlock()
+		if err := m.poll(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	poll(mediamtxPath{Name: "cam-1", Ready: true, BytesReceived: 100}, mediamtxPath{Name: "cam-2"})
+	// The first sighting has nothing to compare with
+	if s := m.PathStatus("cam-1"); !s.Ready || s.Receiving || s.BytesReceived != 100 {
+		t.Errorf("first poll: %+v", s)
+	}
+
+	poll(watched, mediamtxPath{Name: "cam-2"})
+	if s := m.PathStatus("cam-1"); !s.Receiving || s.Readers != 2 || s.LastData.IsZero() {
+		t.Errorf("data arriving: %+v", s)
+	}
+
+	poll(mediamtxPath{Name: "cam-1", Ready: true, BytesReceived: 250}, mediamtxPath{Name: "cam-2"})
+	if s := m.PathStatus("cam-1"); s.Receiving || s.Readers != 0 || s.LastData.IsZero() {
+		t.Errorf("no new data: %+v", s)
+	}
+
+	// A path MediaMTX no longer lists is reset
+	poll(mediamtxPath{Name: "cam-2"})
+	if s := m.PathStatus("cam-1"); s.Ready || s.BytesReceived != 0 {
+		t.Errorf("unlisted path: %+v", s)
+	}
+	if s := m.PathStatus("cam-3"); s.Path != "cam-3" || s.Ready {
+		t.Errorf("unknown path: %+v", s)
+	}
+}
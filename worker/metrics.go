@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Metrics is a small registry of counters and gauges exposed in the
+// Prometheus text format on /metrics
+type Metrics struct {
+	mutex  sync.Mutex
+	types  map[string]string
+	help   map[string]string
+	values map[string]map[string]float64 // metric name -> label set -> value
+}
+
+// NewMetrics creates an empty registry
+func NewMetrics() *Metrics {
+	return &Metrics{
+		types:  make(map[string]string),
+		help:   make(map[string]string),
+		values: make(map[string]map[string]float64),
+	}
+}
+
+// Describe registers the type ("counter" or "gauge") and help text of a metric
+func (m *Metrics) Describe(name, metricType, help string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.types[name] = metricType
+	m.help[name] = help
+	if m.values[name] == nil {
+		m.values[name] = make(map[string]float64)
+	}
+}
+
+// Add increments a counter. labels are name/value pairs.
+func (m *Metrics) Add(name string, delta float64, labels ...string) {
+	key := labelKey(labels)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.values[name] == nil {
+		m.values[name] = make(map[string]float64)
+	}
+	m.values[name][key] += delta
+}
+
+// Inc increments a counter by one
+func (m *Metrics) Inc(name string, labels ...string) {
+	m.Add(name, 1, labels...)
+}
+
+// Set sets a gauge. labels are name/value pairs.
+func (m *Metrics) Set(name string, value float64, labels ...string) {
+	key := labelKey(labels)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.values[name] == nil {
+		m.values[name] = make(map[string]float64)
+	}
+	m.values[name][key] = value
+}
+
+// Reset drops every series of a gauge, e.g. before re-collecting per-stream values
+func (m *Metrics) Reset(name string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.values[name] = make(map[string]float64)
+}
+
+// Render writes all metrics in the Prometheus text format
+func (m *Metrics) Render(w io.Writer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	names := make([]string, 0, len(m.values))
+	for name := range m.values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if help := m.help[name]; help != "" {
+			fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+		}
+		if metricType := m.types[name]; metricType != "" {
+			fmt.Fprintf(w, "# TYPE %s %s\n", name, metricType)
+		}
+
+		keys := make([]string, 0, len(m.values[name]))
+		for key := range m.values[name] {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Fprintf(w, "%s%s %g\n", name, key, m.values[name][key])
+		}
+	}
+}
+
+// labelKey renders name/value pairs as a Prometheus label set, e.g. {camera="a"}
+func labelKey(labels []string) string {
+	if len(labels) < 2 {
+		return ""
+	}
+	parts := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labels[i+1])
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, labels[i], value))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// handleMetrics serves the registry, refreshing per-stream gauges first
+func (sm *StreamManager) handleMetrics(c *gin.Context) {
+	sm.collectStreamMetrics()
+	c.Status(http.StatusOK)
+	c.Header("Content-Type", "text/plain; version=0.0.4")
+	sm.metrics.Render(c.Writer)
+}
+
+// collectStreamMetrics updates the per-stream gauges from the current streams
+func (sm *StreamManager) collectStreamMetrics() {
+	sm.metrics.Reset("worker_stream_fps")
+	sm.metrics.Reset("worker_stream_frames")
+
+	sm.streamMutex.RLock()
+	defer sm.streamMutex.RUnlock()
+
+	sm.metrics.Set("worker_streams", float64(len(sm.streams)))
+	for id, stream := range sm.streams {
+		stream.Mutex.RLock()
+		elapsed := time.Since(stream.StartTime).Seconds()
+		frames := stream.FrameCount
+		stream.Mutex.RUnlock()
+
+		sm.metrics.Set("worker_stream_frames", float64(frames), "camera", id)
+		if elapsed > 0 {
+			sm.metrics.Set("worker_stream_fps", float64(frames)/elapsed, "camera", id)
+		}
+	}
+}
+
+// registerMetrics describes the metrics the worker exports
+func registerMetrics(m *Metrics) {
+	m.Describe("worker_streams", "gauge", "Number of active camera streams.")
+	m.Describe("worker_stream_frames", "gauge", "Frames processed per stream since it started.")
+	m.Describe("worker_stream_fps", "gauge", "Average frames per second per stream.")
+	m.Describe("worker_publish_frames_total", "counter", "Frames handed to the MediaMTX publisher per stream.")
+	m.Describe("worker_publish_seconds_total", "counter", "Time the frame loop spent handing frames to the publisher per stream.")
+	m.Describe("worker_backend_requests_total", "counter", "Backend deliveries by kind and result (ok, error, auth_error).")
+	m.Describe("worker_storage_bytes", "gauge", "Bytes in the snapshot store at the last retention scan.")
+	m.Describe("worker_storage_files", "gauge", "Files in the snapshot store at the last retention scan.")
+	m.Describe("worker_storage_camera_bytes", "gauge", "Bytes in the snapshot store per camera at the last retention scan.")
+	m.Describe("worker_storage_deleted_total", "counter", "Files deleted by the retention cleaner by reason.")
+	m.Describe("worker_email_dropped_total", "counter", "Alerts not emailed per camera by reason (rate_limit, error).")
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gocv.io/x/gocv"
+)
+
+const mjpegBoundary = "frame"
+
+// mjpegViewer is one client of a camera's MJPEG stream
+type mjpegViewer struct {
+	maxWidth  int
+	maxHeight int
+	interval  time.Duration // 0 sends every frame
+	next      time.Time
+	frames    chan []byte
+}
+
+// MJPEGHub fans out a camera's annotated frames to MJPEG viewers. Each frame
+// is encoded once per distinct output size, only when a viewer is due for one.
+type MJPEGHub struct {
+	mutex   sync.Mutex
+	viewers map[*mjpegViewer]struct{}
+	closed  bool
+}
+
+// NewMJPEGHub creates a hub without viewers
+func NewMJPEGHub() *MJPEGHub {
+	return &MJPEGHub{viewers: make(map[*mjpegViewer]struct{})}
+}
+
+// HasViewers reports whether anyone is watching, so the frame loop can skip the hub
+func (h *MJPEGHub) HasViewers() bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return len(h.viewers) > 0
+}
+
+// Publish hands a frame to the viewers that are due. full is the frame already
+// encoded at full size, or nil.
+func (h *MJPEGHub) Publish(img *gocv.Mat, full []byte) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	now := time.Now()
+	encoded := make(map[image.Point][]byte)
+	for viewer := range h.viewers {
+		if now.Before(viewer.next) {
+			continue
+		}
+		size := image.Pt(img.Cols(), img.Rows())
+		if s, ok := fitWithin(size.X, size.Y, viewer.maxWidth, viewer.maxHeight); ok {
+			size = s
+		}
+
+		data, ok := encoded[size]
+		if !ok {
+			var err error
+			if data, err = encodeMJPEGFrame(img, size, full); err != nil {
+				log.Printf("MJPEG encode error: %v", err)
+				continue
+			}
+			encoded[size] = data
+		}
+
+		// Replace a frame the viewer hasn't taken yet, so slow viewers see
+		// the latest frame instead of falling behind
+		select {
+		case <-viewer.frames:
+		default:
+		}
+		viewer.frames <- data
+		viewer.next = now.Add(viewer.interval)
+	}
+}
+
+// encodeMJPEGFrame encodes a frame at the given size, reusing the full-size
+// encoding when there is one
+func encodeMJPEGFrame(img *gocv.Mat, size image.Point, full []byte) ([]byte, error) {
+	src := img
+	if size.X != img.Cols() || size.Y != img.Rows() {
+		resized := gocv.NewMat()
+		defer resized.Close()
+		gocv.Resize(*img, &resized, size, 0, 0, gocv.InterpolationArea)
+		src = &resized
+	} else if full != nil {
+		return full, nil
+	}
+
+	buf, err := gocv.IMEncodeWithParams(gocv.JPEGFileExt, *src, []int{gocv.IMWriteJpegQuality, 80})
+	if err != nil {
+		return nil, err
+	}
+	defer buf.Close()
+	// The buffer is freed on Close, viewers need their own copy
+	return append([]byte(nil), buf.GetBytes()...), nil
+}
+
+// subscribe adds a viewer; it returns nil when the stream has stopped
+func (h *MJPEGHub) subscribe(maxWidth, maxHeight int, maxFPS float64) *mjpegViewer {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.closed {
+		return nil
+	}
+	viewer := &mjpegViewer{
+		maxWidth:  maxWidth,
+		maxHeight: maxHeight,
+		frames:    make(chan []byte, 1),
+	}
+	if maxFPS > 0 {
+		viewer.interval = time.Duration(float64(time.Second) / maxFPS)
+	}
+	h.viewers[viewer] = struct{}{}
+	return viewer
+}
+
+// unsubscribe removes a viewer
+func (h *MJPEGHub) unsubscribe(viewer *mjpegViewer) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if _, ok := h.viewers[viewer]; ok {
+		delete(h.viewers, viewer)
+		close(viewer.frames)
+	}
+}
+
+// Close ends every viewer's stream when the camera stream stops
+func (h *MJPEGHub) Close() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.closed = true
+	for viewer := range h.viewers {
+		delete(h.viewers, viewer)
+		close(viewer.frames)
+	}
+}
+
+// handleMJPEG serves the annotated frames of a stream as
+// multipart/x-mixed-replace: GET /stream/:id/mjpeg?fps=&width=&height=
+func (sm *StreamManager) handleMJPEG(c *gin.Context) {
+	cameraID := c.Param("id")
+
+	var maxFPS float64
+	if v := c.Query("fps"); v != "" {
+		n, err := strconv.ParseFloat(v, 64)
+		if err != nil || n <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "fps must be a positive number"})
+			return
+		}
+		maxFPS = n
+	}
+	var size [2]int
+	for i, name := range []string{"width", "height"} {
+		if v := c.Query(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": name + " must be a positive number"})
+				return
+			}
+			size[i] = n
+		}
+	}
+
+	sm.streamMutex.RLock()
+	stream, exists := sm.streams[cameraID]
+	sm.streamMutex.RUnlock()
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("stream for camera %s not found", cameraID)})
+		return
+	}
+
+	viewer := stream.mjpeg.subscribe(size[0], size[1], maxFPS)
+	if viewer == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("stream for camera %s not found", cameraID)})
+		return
+	}
+	defer stream.mjpeg.unsubscribe(viewer)
+
+	c.Header("Content-Type", "multipart/x-mixed-replace; boundary="+mjpegBoundary)
+	c.Header("Cache-Control", "no-cache, no-store, must-revalidate")
+	c.Header("Pragma", "no-cache")
+	c.Header("Connection", "close")
+	c.Status(http.StatusOK)
+
+	ctx := c.Request.Context()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case frame, ok := <-viewer.frames:
+			if !ok {
+				return
+			}
+			if _, err := fmt.Fprintf(c.Writer, "--%s\r\nContent-Type: image/jpeg\r\nContent-Length: %d\r\n\r\n", mjpegBoundary, len(frame)); err != nil {
+				return
+			}
+			if _, err := c.Writer.Write(frame); err != nil {
+				return
+			}
+			if _, err := c.Writer.Write([]byte("\r\n")); err != nil {
+				return
+			}
+			c.Writer.Flush()
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gocv.io/x/gocv"
+)
+
+func TestMJPEGHubPublish(t *testing.T) {
+	img := gocv.NewMatWithSize(4, 4, gocv.MatTypeCV8UC3)
+	defer img.Close()
+
+	hub := NewMJPEGHub()
+	if hub.HasViewers() {
+		t.Fatal("new hub has viewers")
+	}
+	fast := hub.subscribe(0, 0, 0)
+	throttled := hub.subscribe(0, 0, 1)
+	gone := hub.subscribe(0, 0, 0)
+	hub.unsubscribe(gone)
+
+	hub.Publish(&img, []byte("frame 1"))
+	hub.Publish(&img, []byte("frame 2"))
+
+	// A viewer that hasn't taken a frame gets the latest one
+	if got := string(<-fast.frames); got != "frame 2" {
+		t.Errorf("fast viewer got %q, want frame 2", got)
+	}
+	// A viewer limited to 1 fps skips frames until it is due
+	if got := string(<-throttled.frames); got != "frame 1" {
+		t.Errorf("throttled viewer got %q, want frame 1", got)
+	}
+	select {
+	case frame := <-throttled.frames:
+		t.Errorf("throttled viewer got %q before it was due", frame)
+	default:
+	}
+	if _, ok := <-gone.frames; ok {
+		t.Error("unsubscribed viewer still receives frames")
+	}
+
+	hub.Close()
+	if _, ok := <-fast.frames; ok {
+		t.Error("Close left a viewer open")
+	}
+	if hub.HasViewers() || hub.subscribe(0, 0, 0) != nil {
+		t.Error("closed hub accepts viewers")
+	}
+}
+
+func TestHandleMJPEG(t *testing.T) {
+	img := gocv.NewMatWithSize(4, 4, gocv.MatTypeCV8UC3)
+	defer img.Close()
+
+	hub := NewMJPEGHub()
+	sm := &StreamManager{streams: map[string]*CameraStream{"cam-1": {mjpeg: hub}}}
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/stream/:id/mjpeg", sm.handleMJPEG)
+
+	for _, tt := range []struct {
+		path   string
+		status int
+	}{
+		{"/stream/cam-1/mjpeg?fps=0", http.StatusBadRequest},
+		{"/stream/cam-1/mjpeg?width=wide", http.StatusBadRequest},
+		{"/stream/cam-1/mjpeg?height=-1", http.StatusBadRequest},
+		{"/stream/cam-2/mjpeg", http.StatusNotFound},
+	} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if w.Code != tt.status {
+			t.Errorf("GET %s: status %d, want %d", tt.path, w.Code, tt.status)
+		}
+	}
+
+	// Headers go out with the first frame, which is published once the
+	// handler has subscribed
+	go func() {
+		for i := 0; !hub.HasViewers(); i++ {
+			if i == 100 {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		hub.Publish(&img, []byte("jpeg data"))
+	}()
+
+	server := httptest.NewServer(router)
+	defer server.Close()
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(server.URL + "/stream/cam-1/mjpeg?fps=5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if got := resp.Header.Get("Content-Type"); got != "multipart/x-mixed-replace; boundary="+mjpegBoundary {
+		t.Fatalf("content type %q", got)
+	}
+
+	r := bufio.NewReader(resp.Body)
+	if line, err := r.ReadString('\n'); err != nil || line != "--"+mjpegBoundary+"\r\n" {
+		t.Fatalf("boundary line %q, %v", line, err)
+	}
+	header, err := textproto.NewReader(r).ReadMIMEHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Get("Content-Type") != "image/jpeg" || header.Get("Content-Length") != "9" {
+		t.Errorf("part header %v", header)
+	}
+	part := make([]byte, 9)
+	if _, err := io.ReadFull(r, part); err != nil || string(part) != "jpeg data" {
+		t.Errorf("part %q, %v", part, err)
+	}
+
+	// Stopping the stream ends the response
+	hub.Close()
+	if _, err := io.ReadAll(r); err != nil {
+		t.Errorf("response did not end cleanly: %v", err)
+	}
+}
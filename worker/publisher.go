@@ -0,0 +1,877 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gocv.io/x/gocv"
+)
+
+// fpsSampleFrames is how many frames are timed before ffmpeg starts, so it
+// starts with the camera's real frame rate
+const fpsSampleFrames = 25
+
+// Publisher states reported in stream status
+const (
+	PublisherStarting = "starting"
+	PublisherRunning  = "running"
+	PublisherBackoff  = "backoff"
+	PublisherStopped  = "stopped"
+	PublisherIdle     = "idle"
+)
+
+// errNoDemand ends the ffmpeg run of an on-demand publisher nobody watches
+var errNoDemand = errors.New("no viewers")
+
+// PublisherConfig controls where streams are published and how the publisher
+// is supervised
+type PublisherConfig struct {
+	StallSeconds      int             `yaml:"stall_seconds"`
+	MaxBackoffSeconds int             `yaml:"max_backoff_seconds"`
+	Targets           []PublishTarget `yaml:"targets"`
+	PathTemplate      string          `yaml:"path_template"`
+	Site              string          `yaml:"site"`
+	Raw               bool            `yaml:"raw"`
+	// OnDemand runs ffmpeg only while a runOnDemand hook is open or MediaMTX
+	// reports readers, and for OnDemandIdleSeconds after
+	OnDemand            bool `yaml:"on_demand"`
+	OnDemandIdleSeconds int  `yaml:"on_demand_idle_seconds"`
+	// Encoder applies to every camera; Profile names one of Profiles as the
+	// default, and cameras can pick another
+	Encoder  EncoderProfile            `yaml:"encoder"`
+	Profile  string                    `yaml:"profile"`
+	Profiles map[string]EncoderProfile `yaml:"profiles"`
+}
+
+// PublisherStatus is the publisher part of the stream status
+type PublisherStatus struct {
+	State         string          `json:"state"`
+	Targets       []string        `json:"targets"`
+	Encoder       *EncoderProfile `json:"encoder,omitempty"`
+	Restarts      int             `json:"restarts"`
+	LastError     string          `json:"last_error,omitempty"`
+	StartedAt     time.Time       `json:"started_at,omitempty"`
+	LastProgress  time.Time       `json:"last_progress,omitempty"`
+	DroppedFrames int64           `json:"dropped_frames"`
+	Width         int             `json:"width"`
+	Height        int             `json:"height"`
+	FPS           float64         `json:"fps"`
+	OnDemand      bool            `json:"on_demand,omitempty"`
+	Demand        int             `json:"demand,omitempty"`
+	Readers       int             `json:"readers,omitempty"`
+}
+
+// publishQueueSize is how many frames wait for ffmpeg before new ones are dropped
+const publishQueueSize = 8
+
+// Publisher runs ffmpeg to publish a camera's processed frames to its targets.
+// Frames are piped as raw BGR with wall-clock timestamps, so the output keeps
+// the camera's timing without a JPEG encode and decode per frame. It restarts
+// ffmpeg with a backoff when it exits and kills it when its output stops
+// progressing while frames are being fed.
+type Publisher struct {
+	cameraID  string
+	source    string // camera URL of a passthrough, empty when fed frames
+	outputs   []publishOutput
+	encoder   EncoderProfile
+	config    PublisherConfig
+	ctx       context.Context
+	cancel    context.CancelFunc
+	done      chan struct{}
+	restart   chan struct{}
+	ready     chan struct{}
+	mutex     sync.Mutex
+	frames    chan []byte
+	free      chan []byte // frame buffers ffmpeg is done with, for reuse
+	status    PublisherStatus
+	lastFeed  time.Time
+	lastFrame time.Time
+	interval  float64 // moving average of the frame interval in seconds
+	timed     int
+	onDemand  bool
+	wantedAt  time.Time // last time a hook or reader wanted the stream
+	wake      chan struct{}
+	rtsp      *RTSPServer // serves the embedded output, if any
+}
+
+// NewPassthroughPublisher creates a publisher that republishes the camera's
+// own stream without re-encoding
+func NewPassthroughPublisher(camera Camera, outputs []publishOutput, config PublisherConfig) *Publisher {
+	p := NewPublisher(camera.ID, outputs, EncoderProfile{}, config)
+	p.source = camera.RTSPURL
+	close(p.ready)
+	return p
+}
+
+// NewPublisher creates a publisher for a camera, its resolved targets and
+// encoder settings
+func NewPublisher(cameraID string, outputs []publishOutput, encoder EncoderProfile, config PublisherConfig) *Publisher {
+	targets := make([]string, len(outputs))
+	for i, o := range outputs {
+		targets[i] = o.Redacted()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	status := PublisherStatus{State: PublisherStarting, Targets: targets}
+	if encoder.Codec != "" {
+		status.Encoder = &encoder
+	}
+	return &Publisher{
+		cameraID: cameraID,
+		outputs:  outputs,
+		encoder:  encoder,
+		config:   config,
+		ctx:      ctx,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+		restart:  make(chan struct{}, 1),
+		ready:    make(chan struct{}),
+		wake:     make(chan struct{}, 1),
+		// Room for every queued frame plus the one being written
+		free:   make(chan []byte, publishQueueSize+1),
+		status: status,
+	}
+}
+
+// Run keeps ffmpeg running until Stop is called
+func (p *Publisher) Run() {
+	defer close(p.done)
+	defer func() {
+		if rec := recover(); rec != nil {
+			log.Printf("Panic in publisher for camera %s: %v", p.cameraID, rec)
+		}
+		p.setState(PublisherStopped)
+	}()
+
+	maxBackoff := time.Duration(p.config.MaxBackoffSeconds) * time.Second
+	backoff := time.Second
+	restarting := false
+	for {
+		if !p.awaitDemand() {
+			return
+		}
+		if restarting {
+			p.mutex.Lock()
+			p.status.Restarts++
+			p.mutex.Unlock()
+		}
+		restarting = true
+		started := time.Now()
+		err := p.publish()
+		if err == errNoDemand {
+			// Not a failure: wait for the next viewer
+			restarting = false
+			continue
+		}
+		if err != nil {
+			log.Printf("Publisher for camera %s stopped: %v", p.cameraID, err)
+			p.mutex.Lock()
+			p.status.LastError = err.Error()
+			p.mutex.Unlock()
+		}
+
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-p.restart:
+			// Restarted through the API: go again right away
+			backoff = time.Second
+			continue
+		default:
+		}
+
+		// Reset the backoff after a run that lasted a while
+		if time.Since(started) > time.Minute {
+			backoff = time.Second
+		}
+		p.setState(PublisherBackoff)
+		log.Printf("Restarting publisher for camera %s in %v", p.cameraID, backoff)
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-p.restart:
+			backoff = time.Second
+			continue
+		case <-time.After(backoff):
+		}
+		backoff = nextBackoff(backoff, maxBackoff)
+	}
+}
+
+// nextBackoff doubles a restart delay, capped at max
+func nextBackoff(backoff, max time.Duration) time.Duration {
+	if backoff >= max {
+		return backoff
+	}
+	backoff *= 2
+	if backoff > max {
+		backoff = max
+	}
+	return backoff
+}
+
+// publish runs one ffmpeg process until it exits, stalls or is restarted
+func (p *Publisher) publish() error {
+	if p.source != "" {
+		return p.run(exec.Command("ffmpeg", passthroughArgs(p.source, p.outputs)...), nil)
+	}
+
+	// The frame size and rate are only known once frames arrive
+	select {
+	case <-p.ready:
+	case <-p.ctx.Done():
+		return nil
+	}
+	p.mutex.Lock()
+	width, height, fps := p.status.Width, p.status.Height, p.fps()
+	p.mutex.Unlock()
+
+	cmd := exec.Command("ffmpeg", publisherArgs(width, height, fps, p.encoder, p.outputs)...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("failed to get ffmpeg stdin: %v", err)
+	}
+	return p.run(cmd, stdin)
+}
+
+// run starts ffmpeg and supervises it until it exits, stalls or is
+// restarted. stdin is nil for a passthrough.
+func (p *Publisher) run(cmd *exec.Cmd, stdin io.WriteCloser) error {
+	closeStdin := func() {
+		if stdin != nil {
+			stdin.Close()
+		}
+	}
+	if err := prepareOutputs(p.outputs); err != nil {
+		closeStdin()
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		closeStdin()
+		return fmt.Errorf("failed to get ffmpeg stdout: %v", err)
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		closeStdin()
+		return fmt.Errorf("failed to get ffmpeg stderr: %v", err)
+	}
+	// The embedded output is read from fd 3 of ffmpeg
+	name := embeddedPath(p.outputs)
+	var embedded, embeddedWriter *os.File
+	if name != "" && p.rtsp != nil {
+		if embedded, embeddedWriter, err = os.Pipe(); err != nil {
+			closeStdin()
+			return fmt.Errorf("failed to create embedded output pipe: %v", err)
+		}
+		cmd.ExtraFiles = []*os.File{embeddedWriter}
+	}
+	err = cmd.Start()
+	if embeddedWriter != nil {
+		// ffmpeg has its own copy; the pipe ends when it exits
+		embeddedWriter.Close()
+	}
+	if err != nil {
+		closeStdin()
+		if embedded != nil {
+			embedded.Close()
+		}
+		return fmt.Errorf("failed to start ffmpeg: %v", err)
+	}
+	if embedded != nil {
+		go func() {
+			defer embedded.Close()
+			p.rtsp.Feed(name, embedded)
+		}()
+	}
+
+	// Frames are written by their own goroutine so a stuck ffmpeg never
+	// blocks the frame loop; frames that don't fit are dropped
+	var frames chan []byte
+	if stdin != nil {
+		frames = make(chan []byte, publishQueueSize)
+	}
+	now := time.Now()
+	p.mutex.Lock()
+	p.frames = frames
+	p.status.State = PublisherStarting
+	p.status.StartedAt = now
+	p.status.LastProgress = time.Time{}
+	p.lastFeed = time.Time{}
+	if stdin != nil {
+		log.Printf("Started publisher for camera %s -> %s (%dx%d, %.1f fps)", p.cameraID, strings.Join(p.status.Targets, ", "), p.status.Width, p.status.Height, p.fps())
+	} else {
+		log.Printf("Started passthrough publisher for camera %s -> %s", p.cameraID, strings.Join(p.status.Targets, ", "))
+	}
+	p.mutex.Unlock()
+
+	if stdin != nil {
+		go func() {
+			defer stdin.Close()
+			for frame := range frames {
+				if _, err := stdin.Write(frame); err != nil {
+					// ffmpeg has exited; Wait reports why
+					for range frames {
+					}
+					return
+				}
+				p.release(frame)
+			}
+		}()
+	}
+
+	var lastLine string
+	var linesMutex sync.Mutex
+	var outputs sync.WaitGroup
+	outputs.Add(2)
+	go func() {
+		defer outputs.Done()
+		scanner := bufio.NewScanner(stdout)
+		lastFrame := "frame=0"
+		for scanner.Scan() {
+			// A progress report counts when the output frame count moved
+			line := scanner.Text()
+			if strings.HasPrefix(line, "frame=") && line != lastFrame {
+				lastFrame = line
+				p.mutex.Lock()
+				p.status.State = PublisherRunning
+				p.status.LastProgress = time.Now()
+				p.mutex.Unlock()
+			}
+		}
+	}()
+	go func() {
+		defer outputs.Done()
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" {
+				continue
+			}
+			log.Printf("[FFMPEG %s]: %s", p.cameraID, line)
+			linesMutex.Lock()
+			lastLine = line
+			linesMutex.Unlock()
+		}
+	}()
+
+	exited := make(chan error, 1)
+	go func() {
+		outputs.Wait()
+		exited <- cmd.Wait()
+	}()
+
+	// interrupt lets ffmpeg close the RTSP session cleanly
+	interrupt := func() {
+		p.detach()
+		_ = cmd.Process.Signal(syscall.SIGINT)
+		select {
+		case <-exited:
+		case <-time.After(5 * time.Second):
+			_ = cmd.Process.Kill()
+			<-exited
+		}
+	}
+
+	stall := time.Duration(p.config.StallSeconds) * time.Second
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	var result error
+	for result == nil {
+		select {
+		case err := <-exited:
+			p.detach()
+			linesMutex.Lock()
+			line := lastLine
+			linesMutex.Unlock()
+			if err != nil {
+				return fmt.Errorf("ffmpeg exited: %v: %s", err, line)
+			}
+			return fmt.Errorf("ffmpeg finished: %s", line)
+		case <-p.ctx.Done():
+			interrupt()
+			return nil
+		case <-p.restart:
+			// Keep the request so Run skips the backoff
+			p.restart <- struct{}{}
+			p.detach()
+			_ = cmd.Process.Kill()
+			<-exited
+			log.Printf("Publisher for camera %s restarted on request", p.cameraID)
+			return nil
+		case <-ticker.C:
+			if !p.demanded() {
+				interrupt()
+				log.Printf("Publisher for camera %s has no viewers, stopping ffmpeg", p.cameraID)
+				return errNoDemand
+			}
+			if stall > 0 && p.stalled(stall) {
+				result = fmt.Errorf("no output progress for %v", stall)
+			}
+		}
+	}
+
+	p.detach()
+	_ = cmd.Process.Kill()
+	<-exited
+	return result
+}
+
+// passthroughArgs builds the ffmpeg command line that republishes the
+// camera's video as is, without decoding or encoding it
+func passthroughArgs(source string, outputs []publishOutput) []string {
+	var args []string
+	if strings.HasPrefix(source, "rtsp://") || strings.HasPrefix(source, "rtsps://") {
+		args = append(args, "-rtsp_transport", "tcp")
+	}
+	args = append(args,
+		"-i", source,
+		"-map", "0:v",
+		"-c", "copy",
+		"-nostats",
+		"-progress", "pipe:1",
+	)
+	return append(args, outputArgs(outputs)...)
+}
+
+// publisherArgs builds the ffmpeg command line for raw BGR frames of the given
+// size, encoded once for all outputs. Timestamps come from the wall clock, so
+// a camera that slows down or drops frames is not sped up; fps only sets the
+// keyframe interval unless the encoder lowers the rate.
+func publisherArgs(width, height int, fps float64, encoder EncoderProfile, outputs []publishOutput) []string {
+	args := []string{
+		"-y",
+		"-f", "rawvideo",
+		"-pix_fmt", "bgr24",
+		"-video_size", fmt.Sprintf("%dx%d", width, height),
+		"-framerate", strconv.FormatFloat(fps, 'f', 2, 64),
+		"-use_wallclock_as_timestamps", "1",
+		"-i", "-",
+	}
+	args = append(args, encoderArgs(encoder, width, height, fps)...)
+	args = append(args, fpsModeArgs()...)
+	args = append(args,
+		"-map", "0:v",
+		// Progress on stdout is how stalls are detected
+		"-nostats",
+		"-progress", "pipe:1",
+	)
+	if len(outputs) > 1 {
+		// Extradata in the headers for the muxers behind tee
+		args = append(args, "-flags", "+global_header")
+	}
+	return append(args, outputArgs(outputs)...)
+}
+
+// fps returns the measured frame rate. Callers hold the mutex.
+func (p *Publisher) fps() float64 {
+	if p.interval <= 0 {
+		return 25
+	}
+	return 1 / p.interval
+}
+
+// stalled reports whether frames were fed but ffmpeg made no progress for the
+// given time. A camera that delivers no frames is not a publisher stall.
+func (p *Publisher) stalled(stall time.Duration) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	last := p.status.LastProgress
+	if last.IsZero() {
+		last = p.status.StartedAt
+	}
+	// A passthrough feeds itself, so no progress is always a stall
+	fed := p.source != "" || time.Since(p.lastFeed) < stall
+	return time.Since(last) > stall && fed
+}
+
+// setOnDemand makes the publisher run ffmpeg only while it is wanted. Call it
+// before Run.
+func (p *Publisher) setOnDemand(onDemand bool) {
+	p.onDemand = onDemand
+	p.status.OnDemand = onDemand
+}
+
+// demanded reports whether ffmpeg should run: always, or for an on-demand
+// publisher while a hook is open or for on_demand_idle_seconds after the
+// last hook or reader
+func (p *Publisher) demanded() bool {
+	if !p.onDemand {
+		return true
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	idle := time.Duration(p.config.OnDemandIdleSeconds) * time.Second
+	return p.status.Demand > 0 || (!p.wantedAt.IsZero() && time.Since(p.wantedAt) < idle)
+}
+
+// awaitDemand waits until ffmpeg should run; it returns false when the
+// publisher is stopped first
+func (p *Publisher) awaitDemand() bool {
+	for !p.demanded() {
+		p.setState(PublisherIdle)
+		select {
+		case <-p.ctx.Done():
+			return false
+		case <-p.wake:
+		case <-p.restart:
+			// Nothing runs that could be restarted
+		}
+	}
+	return true
+}
+
+// want records that someone wants the stream and wakes an idle publisher.
+// Callers hold the mutex.
+func (p *Publisher) want() {
+	p.wantedAt = time.Now()
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Demand keeps an on-demand publisher running until the returned release is
+// called
+func (p *Publisher) Demand() func() {
+	p.mutex.Lock()
+	p.status.Demand++
+	p.want()
+	p.mutex.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			p.mutex.Lock()
+			p.status.Demand--
+			// The idle time counts from the release
+			p.wantedAt = time.Now()
+			p.mutex.Unlock()
+		})
+	}
+}
+
+// SetReaders records the readers MediaMTX reports on the publisher's path;
+// readers keep an on-demand publisher running
+func (p *Publisher) SetReaders(readers int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.status.Readers = readers
+	if readers > 0 {
+		p.want()
+	}
+}
+
+// detach stops feeding the current ffmpeg process
+func (p *Publisher) detach() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.frames != nil {
+		close(p.frames)
+		p.frames = nil
+	}
+}
+
+// setState updates the reported state
+func (p *Publisher) setState(state string) {
+	p.mutex.Lock()
+	p.status.State = state
+	p.mutex.Unlock()
+}
+
+// WriteFrame times a BGR frame and queues a copy of it for ffmpeg without
+// blocking. A change of frame size restarts ffmpeg.
+func (p *Publisher) WriteFrame(img *gocv.Mat) {
+	now := time.Now()
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if !p.lastFrame.IsZero() {
+		dt := now.Sub(p.lastFrame).Seconds()
+		if p.interval == 0 {
+			p.interval = dt
+		} else {
+			p.interval = 0.9*p.interval + 0.1*dt
+		}
+	}
+	p.lastFrame = now
+	p.status.FPS = p.fps()
+
+	width, height := img.Cols(), img.Rows()
+	if width != p.status.Width || height != p.status.Height {
+		if p.status.Width != 0 {
+			log.Printf("Frame size of camera %s changed to %dx%d, restarting publisher", p.cameraID, width, height)
+			p.Restart()
+		}
+		p.status.Width, p.status.Height = width, height
+	}
+	if p.timed < fpsSampleFrames {
+		p.timed++
+		if p.timed == fpsSampleFrames {
+			close(p.ready)
+		}
+	}
+
+	if p.frames == nil {
+		return
+	}
+	p.lastFeed = now
+	// Don't copy a frame that would be dropped anyway
+	if len(p.frames) == cap(p.frames) {
+		p.status.DroppedFrames++
+		return
+	}
+	p.frames <- p.frameBuffer(img)
+}
+
+// frameBuffer copies the pixels of a frame into a buffer from the free list.
+// A 1080p BGR frame is about 6 MB, too much to allocate for every frame.
+func (p *Publisher) frameBuffer(img *gocv.Mat) []byte {
+	data, err := img.DataPtrUint8()
+	if err != nil {
+		// Not continuous, e.g. a region of a larger Mat
+		return img.ToBytes()
+	}
+
+	var buf []byte
+	select {
+	case buf = <-p.free:
+	default:
+	}
+	if cap(buf) < len(data) {
+		buf = make([]byte, len(data))
+	}
+	buf = buf[:len(data)]
+	copy(buf, data)
+	return buf
+}
+
+// release returns a frame buffer to the free list once ffmpeg has it
+func (p *Publisher) release(buf []byte) {
+	select {
+	case p.free <- buf:
+	default:
+	}
+}
+
+// Status returns the current publisher status
+func (p *Publisher) Status() PublisherStatus {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.status
+}
+
+// Restart kills the current ffmpeg process and starts a new one right away
+func (p *Publisher) Restart() {
+	select {
+	case p.restart <- struct{}{}:
+	default:
+	}
+}
+
+// Stop ends publishing and waits for ffmpeg to exit
+func (p *Publisher) Stop() {
+	p.cancel()
+	<-p.done
+}
+
+// startPublisher starts the supervised ffmpeg publisher of a stream's
+// annotated frames and, when enabled, the passthrough of its raw video
+func (sm *StreamManager) startPublisher(stream *CameraStream) error {
+	// Managed MediaMTX paths must exist before ffmpeg connects
+	if paths := sm.mediamtxPaths(stream.Camera); len(paths) > 0 {
+		if err := sm.mediamtx.AddPaths(paths, sm.publishOnDemand(stream.Camera)); err != nil {
+			log.Printf("Failed to create MediaMTX paths for camera %s: %v", stream.Camera.ID, err)
+		}
+	}
+
+	outputs, err := sm.publishOutputs(stream.Camera, FrameAnnotated)
+	if err != nil {
+		return err
+	}
+	encoder, err := sm.encoderProfile(stream.Camera)
+	if err != nil {
+		return err
+	}
+	onDemand := sm.publishOnDemand(stream.Camera)
+	stream.publisher = NewPublisher(stream.Camera.ID, outputs, encoder, sm.config.Publisher)
+	stream.publisher.setOnDemand(onDemand)
+	sm.serveEmbedded(stream.publisher)
+	go stream.publisher.Run()
+
+	if sm.publishRaw(stream.Camera) {
+		outputs, err := sm.publishOutputs(stream.Camera, FrameRaw)
+		if err != nil {
+			return err
+		}
+		stream.rawPublisher = NewPassthroughPublisher(stream.Camera, outputs, sm.config.Publisher)
+		stream.rawPublisher.setOnDemand(onDemand)
+		sm.serveEmbedded(stream.rawPublisher)
+		go stream.rawPublisher.Run()
+	}
+	return nil
+}
+
+// stopPublisher stops the publishers of a stream, if any
+func (sm *StreamManager) stopPublisher(stream *CameraStream) {
+	if stream == nil {
+		return
+	}
+	if stream.publisher != nil {
+		stream.publisher.Stop()
+		sm.unserveEmbedded(stream.publisher)
+		stream.publisher = nil
+	}
+	if stream.rawPublisher != nil {
+		stream.rawPublisher.Stop()
+		sm.unserveEmbedded(stream.rawPublisher)
+		stream.rawPublisher = nil
+	}
+	if paths := sm.mediamtxPaths(stream.Camera); len(paths) > 0 {
+		if err := sm.mediamtx.RemovePaths(paths); err != nil {
+			log.Printf("Failed to remove MediaMTX paths for camera %s: %v", stream.Camera.ID, err)
+		}
+	}
+}
+
+// serveEmbedded adds a publisher's embedded output to the RTSP server, whose
+// readers then keep an on-demand publisher running
+func (sm *StreamManager) serveEmbedded(p *Publisher) {
+	name := embeddedPath(p.outputs)
+	if name == "" || sm.rtsp == nil {
+		return
+	}
+	p.rtsp = sm.rtsp
+	sm.rtsp.AddStream(name, p.Demand)
+}
+
+// unserveEmbedded removes a stopped publisher's embedded output from the RTSP
+// server
+func (sm *StreamManager) unserveEmbedded(p *Publisher) {
+	if name := embeddedPath(p.outputs); name != "" && p.rtsp != nil {
+		p.rtsp.RemoveStream(name)
+	}
+}
+
+// handleRestartPublisher restarts the ffmpeg publishers of a stream without
+// touching capture or detection. ?variant=raw or annotated restarts only one.
+func (sm *StreamManager) handleRestartPublisher(c *gin.Context) {
+	cameraID := c.Param("id")
+	variant := c.Query("variant")
+	if variant != "" && variant != FrameRaw && variant != FrameAnnotated {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("variant must be %s or %s", FrameRaw, FrameAnnotated)})
+		return
+	}
+
+	sm.streamMutex.RLock()
+	stream, exists := sm.streams[cameraID]
+	publishers := make(map[string]*Publisher)
+	if exists {
+		if stream.publisher != nil && variant != FrameRaw {
+			publishers["publisher"] = stream.publisher
+		}
+		if stream.rawPublisher != nil && variant != FrameAnnotated {
+			publishers["raw_publisher"] = stream.rawPublisher
+		}
+	}
+	sm.streamMutex.RUnlock()
+
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("stream for camera %s not found", cameraID)})
+		return
+	}
+	if len(publishers) == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("camera %s has no such publisher", cameraID)})
+		return
+	}
+
+	response := gin.H{"message": "Publisher restart requested"}
+	for name, publisher := range publishers {
+		publisher.Restart()
+		response[name] = publisher.Status()
+	}
+	log.Printf("Publisher restart requested for camera %s", cameraID)
+	c.JSON(http.StatusAccepted, response)
+}
+
+// publisherForPath finds the publisher of a publish path, as MediaMTX names
+// it in $MTX_PATH
+func (sm *StreamManager) publisherForPath(path string) (*Publisher, string) {
+	path = strings.Trim(path, "/")
+	sm.streamMutex.RLock()
+	defer sm.streamMutex.RUnlock()
+	for id, stream := range sm.streams {
+		for _, p := range []struct {
+			publisher *Publisher
+			variant   string
+		}{
+			{stream.publisher, FrameAnnotated},
+			{stream.rawPublisher, FrameRaw},
+		} {
+			if p.publisher == nil {
+				continue
+			}
+			// Camera IDs are escaped in paths; MediaMTX may hand either form
+			name := sm.variantPath(stream.Camera, p.variant)
+			unescaped, _ := url.PathUnescape(name)
+			if path == name || path == unescaped {
+				return p.publisher, id
+			}
+		}
+	}
+	return nil, ""
+}
+
+// handleDemand keeps the publisher of a path running while the request is
+// open, as MediaMTX's runOnDemand hook: GET /stream/demand?path=
+func (sm *StreamManager) handleDemand(c *gin.Context) {
+	path := c.Query("path")
+	publisher, cameraID := sm.publisherForPath(path)
+	if publisher == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("no stream is published at %q", path)})
+		return
+	}
+
+	release := publisher.Demand()
+	defer release()
+	log.Printf("Viewer demand opened for camera %s (%s)", cameraID, path)
+	defer log.Printf("Viewer demand closed for camera %s (%s)", cameraID, path)
+
+	c.Header("Content-Type", "text/plain")
+	c.Header("Cache-Control", "no-store")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	// Writes notice a hook that went away without closing the connection
+	ticker := time.NewTicker(15 * time.Second)
+	defer ticker.Stop()
+	ctx := c.Request.Context()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-publisher.done:
+			return
+		case <-ticker.C:
+			if _, err := c.Writer.Write([]byte("\n")); err != nil {
+				return
+			}
+			c.Writer.Flush()
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+func TestNextBackoff(t *testing.T) {
+	tests := []struct {
+		backoff, max, want time.Duration
+	}{
+		{time.Second, 30 * time.Second, 2 * time.Second},
+		{8 * time.Second, 30 * time.Second, 16 * time.Second},
+		{16 * time.Second, 30 * time.Second, 30 * time.Second},
+		{30 * time.Second, 30 * time.Second, 30 * time.Second},
+		// No maximum keeps the initial delay
+		{time.Second, 0, time.Second},
+	}
+	for _, tt := range tests {
+		if got := nextBackoff(tt.backoff, tt.max); got != tt.want {
+			t.Errorf("nextBackoff(%v, %v) = %v, want %v", tt.backoff, tt.max, got, tt.want)
+		}
+	}
+}
+
+func TestPublisherStalled(t *testing.T) {
+	now := time.Now()
+	stall := 10 * time.Second
+	tests := []struct {
+		name     string
+		started  time.Time
+		progress time.Time
+		fed      time.Time
+		source   string
+		want     bool
+	}{
+		{"progressing", now.Add(-time.Minute), now.Add(-time.Second), now, "", false},
+		{"no progress while fed", now.Add(-time.Minute), now.Add(-20 * time.Second), now, "", true},
+		{"never progressed", now.Add(-time.Minute), time.Time{}, now, "", true},
+		{"still starting", now.Add(-5 * time.Second), time.Time{}, now, "", false},
+		// A camera that stopped delivering frames is not a publisher stall
+		{"not fed", now.Add(-time.Minute), now.Add(-20 * time.Second), now.Add(-20 * time.Second), "", false},
+		// A passthrough feeds itself
+		{"passthrough", now.Add(-time.Minute), now.Add(-20 * time.Second), time.Time{}, "rtsp://camera/stream", true},
+	}
+	for _, tt := range tests {
+		p := &Publisher{lastFeed: tt.fed, source: tt.source}
+		p.status.StartedAt = tt.started
+		p.status.LastProgress = tt.progress
+		if got := p.stalled(stall); got != tt.want {
+			t.Errorf("%s: stalled() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPublisherDemand(t *testing.T) {
+	p := NewPublisher("cam-1", nil, EncoderProfile{}, PublisherConfig{OnDemandIdleSeconds: 10})
+	if !p.demanded() {
+		t.Fatal("a publisher that isn't on demand must always run")
+	}
+	p.setOnDemand(true)
+	if p.demanded() {
+		t.Fatal("an on-demand publisher nobody wants is demanded")
+	}
+
+	// A reader wakes the idle publisher
+	woke := make(chan bool)
+	go func() { woke <- p.awaitDemand() }()
+	time.Sleep(20 * time.Millisecond)
+	if state := p.Status().State; state != PublisherIdle {
+		t.Errorf("state while waiting = %q, want %q", state, PublisherIdle)
+	}
+	p.SetReaders(2)
+	select {
+	case ok := <-woke:
+		if !ok {
+			t.Fatal("awaitDemand() = false after a reader arrived")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("a reader did not wake the publisher")
+	}
+
+	// It keeps running for the idle time after the last reader leaves
+	p.SetReaders(0)
+	if !p.demanded() {
+		t.Error("publisher stopped as soon as the last reader left")
+	}
+	p.mutex.Lock()
+	p.wantedAt = time.Now().Add(-11 * time.Second)
+	p.mutex.Unlock()
+	if p.demanded() {
+		t.Error("publisher still demanded after the idle time")
+	}
+
+	// A hook holds it until released, and a double release counts once
+	release := p.Demand()
+	p.mutex.Lock()
+	p.wantedAt = time.Now().Add(-time.Minute)
+	p.mutex.Unlock()
+	if !p.demanded() {
+		t.Error("publisher not demanded while a hook holds it")
+	}
+	release()
+	release()
+	if demand := p.Status().Demand; demand != 0 {
+		t.Errorf("demand after release = %d, want 0", demand)
+	}
+	if !p.demanded() {
+		t.Error("the idle time must count from the release")
+	}
+
+	// Stopping ends the wait
+	p.mutex.Lock()
+	p.wantedAt = time.Time{}
+	p.mutex.Unlock()
+	go func() { woke <- p.awaitDemand() }()
+	p.cancel()
+	select {
+	case ok := <-woke:
+		if ok {
+			t.Error("awaitDemand() = true after the publisher was stopped")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("stopping did not end awaitDemand()")
+	}
+}
+
+// benchmarkFrame returns a 1080p BGR frame with a gradient, so the JPEG
+// encoder has some detail to work on
+func benchmarkFrame(b *testing.B) gocv.Mat {
+	img := gocv.NewMatWithSize(1080, 1920, gocv.MatTypeCV8UC3)
+	data, err := img.DataPtrUint8()
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i := range data {
+		data[i] = byte(i / 3 % 251)
+	}
+	return img
+}
+
+// BenchmarkFrameJPEG measures the frame loop cost of the former MJPEG pipe:
+// one JPEG encode and copy per published frame
+func BenchmarkFrameJPEG(b *testing.B) {
+	img := benchmarkFrame(b)
+	defer img.Close()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf, err := gocv.IMEncode(gocv.JPEGFileExt, img)
+		if err != nil {
+			b.Fatal(err)
+		}
+		_ = append([]byte(nil), buf.GetBytes()...)
+		buf.Close()
+	}
+}
+
+// BenchmarkFrameRaw measures the frame loop cost of the rawvideo pipe: one
+// copy into a reused buffer per published frame
+func BenchmarkFrameRaw(b *testing.B) {
+	img := benchmarkFrame(b)
+	defer img.Close()
+	p := NewPublisher("bench", nil, EncoderProfile{}, PublisherConfig{})
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p.release(p.frameBuffer(&img))
+	}
+}
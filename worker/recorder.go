@@ -0,0 +1,776 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Recording sources: the camera stream as is, or the frames with the
+// detection overlay drawn on them
+const (
+	RecordingSourceRaw       = "raw"
+	RecordingSourceAnnotated = "annotated"
+)
+
+// segmentLayout is the UTC start time in segment file names
+const segmentLayout = "20060102-150405"
+
+// RecordingConfig controls continuous segmented recording (DVR). It is set
+// globally in config.yaml; enabled, source, segment_seconds and
+// retention_hours can be overridden per camera in the start request.
+type RecordingConfig struct {
+	Enabled          bool   `yaml:"enabled" json:"enabled"`
+	Source           string `yaml:"source" json:"source"`
+	SegmentSeconds   int    `yaml:"segment_seconds" json:"segment_seconds"`
+	RetentionHours   int    `yaml:"retention_hours" json:"retention_hours"`
+	Path             string `yaml:"path" json:"-"`
+	MaxExportMinutes int    `yaml:"max_export_minutes" json:"-"`
+	MaxExports       int    `yaml:"max_exports" json:"-"` // exports running at once, the rest wait
+}
+
+// recordingExportKeep is how long a finished recording export stays queryable
+const recordingExportKeep = 24 * time.Hour
+
+// RecordingExport is a time range of a recording being exported in the background
+type RecordingExport struct {
+	ID         string     `json:"id"`
+	Status     string     `json:"status"`
+	CameraID   string     `json:"camera_id"`
+	From       time.Time  `json:"from"`
+	To         time.Time  `json:"to"`
+	Accurate   bool       `json:"accurate"`
+	CreatedAt  time.Time  `json:"created_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	Key        string     `json:"key,omitempty"`
+	URL        string     `json:"url,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	StatusURL  string     `json:"status_url"`
+}
+
+// recordingExports tracks the recording exports of this worker run. slots
+// holds one token per running ffmpeg.
+type recordingExports struct {
+	mutex sync.Mutex
+	jobs  map[string]*RecordingExport
+	slots chan struct{}
+}
+
+// get returns a copy of a job
+func (e *recordingExports) get(id string) (RecordingExport, bool) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	job, ok := e.jobs[id]
+	if !ok {
+		return RecordingExport{}, false
+	}
+	return *job, true
+}
+
+// update changes a job under the lock
+func (e *recordingExports) update(id string, fn func(job *RecordingExport)) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if job, ok := e.jobs[id]; ok {
+		fn(job)
+	}
+}
+
+// RecordingSegment is one recorded file
+type RecordingSegment struct {
+	CameraID  string    `json:"camera_id"`
+	File      string    `json:"file"`
+	URL       string    `json:"url"`
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	Size      int64     `json:"size"`
+	Recording bool      `json:"recording"`
+}
+
+// Recorder runs ffmpeg to record a camera into fixed-length MP4 segments and
+// restarts it if it exits while the stream is running
+type Recorder struct {
+	cameraID string
+	rtspURL  string
+	config   RecordingConfig
+	dir      string
+	ctx      context.Context
+	cancel   context.CancelFunc
+	done     chan struct{}
+	mutex    sync.Mutex
+	cmd      *exec.Cmd
+	frames   chan []byte
+	dropped  int64
+}
+
+// NewRecorder creates a recorder writing to <path>/<camera>
+func NewRecorder(camera Camera, config RecordingConfig) (*Recorder, error) {
+	dir := filepath.Join(config.Path, cameraDirName(camera.ID))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create recording directory %s: %v", dir, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Recorder{
+		cameraID: camera.ID,
+		rtspURL:  camera.RTSPURL,
+		config:   config,
+		dir:      dir,
+		ctx:      ctx,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}, nil
+}
+
+// Run keeps ffmpeg running until Stop is called
+func (r *Recorder) Run() {
+	defer close(r.done)
+	defer func() {
+		if rec := recover(); rec != nil {
+			log.Printf("Panic in recorder for camera %s: %v", r.cameraID, rec)
+		}
+	}()
+
+	backoff := time.Second
+	for {
+		started := time.Now()
+		if err := r.record(); err != nil {
+			log.Printf("Recorder for camera %s stopped: %v", r.cameraID, err)
+		}
+
+		select {
+		case <-r.ctx.Done():
+			return
+		default:
+		}
+
+		// Reset the backoff after a run that lasted a while
+		if time.Since(started) > time.Minute {
+			backoff = time.Second
+		}
+		log.Printf("Restarting recorder for camera %s in %v", r.cameraID, backoff)
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff < 30*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+// record runs one ffmpeg process until it exits
+func (r *Recorder) record() error {
+	cmd := exec.Command("ffmpeg", r.args()...)
+	// Segment names use ffmpeg's local time, so pin it to UTC
+	cmd.Env = append(os.Environ(), "TZ=UTC")
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+
+	var stdin io.WriteCloser
+	if r.config.Source == RecordingSourceAnnotated {
+		var err error
+		if stdin, err = cmd.StdinPipe(); err != nil {
+			return fmt.Errorf("failed to get ffmpeg stdin: %v", err)
+		}
+	}
+
+	if err := cmd.Start(); err != nil {
+		if stdin != nil {
+			stdin.Close()
+		}
+		return fmt.Errorf("failed to start ffmpeg: %v", err)
+	}
+
+	// Frames are written by their own goroutine so a stuck ffmpeg never
+	// blocks the frame loop; frames that don't fit are dropped
+	var frames chan []byte
+	if stdin != nil {
+		frames = make(chan []byte, 8)
+		go func() {
+			defer stdin.Close()
+			for frame := range frames {
+				if _, err := stdin.Write(frame); err != nil {
+					// ffmpeg has exited; Wait reports why
+					for range frames {
+					}
+					return
+				}
+			}
+		}()
+	}
+
+	r.mutex.Lock()
+	r.cmd = cmd
+	r.frames = frames
+	r.dropped = 0
+	r.mutex.Unlock()
+
+	log.Printf("Recording camera %s (%s) to %s", r.cameraID, r.config.Source, r.dir)
+	err := cmd.Wait()
+
+	r.mutex.Lock()
+	r.cmd = nil
+	r.closeFramesLocked()
+	if r.dropped > 0 {
+		log.Printf("Recorder for camera %s dropped %d frames", r.cameraID, r.dropped)
+	}
+	r.mutex.Unlock()
+
+	if err != nil {
+		return fmt.Errorf("ffmpeg exited: %v: %s", err, lastLine(stderr.String()))
+	}
+	return nil
+}
+
+// args builds the ffmpeg command line for the configured source
+func (r *Recorder) args() []string {
+	var args []string
+	if r.config.Source == RecordingSourceAnnotated {
+		args = []string{
+			"-f", "mjpeg",
+			"-use_wallclock_as_timestamps", "1",
+			"-i", "-",
+			"-c:v", "libx264",
+			"-preset", "veryfast",
+			"-pix_fmt", "yuv420p",
+			// Keyframes every 2 seconds so segments can be cut on time
+			"-force_key_frames", "expr:gte(t,n_forced*2)",
+		}
+	} else {
+		if strings.HasPrefix(r.rtspURL, "rtsp://") || strings.HasPrefix(r.rtspURL, "rtsps://") {
+			args = append(args, "-rtsp_transport", "tcp")
+		}
+		args = append(args,
+			"-i", r.rtspURL,
+			"-map", "0:v",
+			"-c", "copy",
+		)
+	}
+
+	return append(args,
+		"-f", "segment",
+		"-segment_time", strconv.Itoa(r.config.SegmentSeconds),
+		"-segment_format", "mp4",
+		// Fragmented MP4 so the segment being written is already playable
+		"-segment_format_options", "movflags=+frag_keyframe+empty_moov+default_base_moof",
+		"-reset_timestamps", "1",
+		"-strftime", "1",
+		filepath.Join(r.dir, "%Y%m%d-%H%M%S.mp4"),
+	)
+}
+
+// WriteFrame queues a JPEG frame for an annotated recording without blocking
+func (r *Recorder) WriteFrame(jpeg []byte) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.frames == nil {
+		return
+	}
+	select {
+	case r.frames <- jpeg:
+	default:
+		r.dropped++
+	}
+}
+
+// closeFramesLocked stops feeding ffmpeg, which closes its stdin once the
+// queued frames are written. Caller must hold r.mutex.
+func (r *Recorder) closeFramesLocked() {
+	if r.frames != nil {
+		close(r.frames)
+		r.frames = nil
+	}
+}
+
+// wantsFrames reports whether the recorder records the annotated frames
+func (r *Recorder) wantsFrames() bool {
+	return r.config.Source == RecordingSourceAnnotated
+}
+
+// Stop ends the recording and waits for ffmpeg to finish the current segment
+func (r *Recorder) Stop() {
+	r.cancel()
+
+	r.mutex.Lock()
+	r.closeFramesLocked()
+	if r.cmd != nil && r.cmd.Process != nil {
+		_ = r.cmd.Process.Signal(syscall.SIGINT)
+	}
+	r.mutex.Unlock()
+
+	select {
+	case <-r.done:
+	case <-time.After(10 * time.Second):
+		r.mutex.Lock()
+		if r.cmd != nil && r.cmd.Process != nil {
+			_ = r.cmd.Process.Kill()
+		}
+		r.mutex.Unlock()
+		<-r.done
+	}
+}
+
+// recordingConfig returns the recording settings for a camera, falling back to
+// the global settings
+func (sm *StreamManager) recordingConfig(camera Camera) RecordingConfig {
+	config := sm.config.Recording
+	if camera.Recording != nil {
+		config.Enabled = camera.Recording.Enabled
+		if camera.Recording.Source != "" {
+			config.Source = camera.Recording.Source
+		}
+		if camera.Recording.SegmentSeconds > 0 {
+			config.SegmentSeconds = camera.Recording.SegmentSeconds
+		}
+		if camera.Recording.RetentionHours > 0 {
+			config.RetentionHours = camera.Recording.RetentionHours
+		}
+	}
+	if config.Source != RecordingSourceAnnotated {
+		config.Source = RecordingSourceRaw
+	}
+	if config.SegmentSeconds <= 0 {
+		config.SegmentSeconds = 300
+	}
+	return config
+}
+
+// startRecorder starts continuous recording for a stream if it is enabled
+func (sm *StreamManager) startRecorder(stream *CameraStream) {
+	config := sm.recordingConfig(stream.Camera)
+	if !config.Enabled {
+		return
+	}
+
+	recorder, err := NewRecorder(stream.Camera, config)
+	if err != nil {
+		log.Printf("Failed to start recorder for camera %s: %v", stream.Camera.ID, err)
+		return
+	}
+	stream.recorder = recorder
+	go recorder.Run()
+}
+
+// stopRecorder stops the recorder of a stream, if any
+func (sm *StreamManager) stopRecorder(stream *CameraStream) {
+	if stream.recorder != nil {
+		stream.recorder.Stop()
+		stream.recorder = nil
+	}
+}
+
+// cameraDirName returns the single path element that holds a camera's files
+// on disk and names them in URLs. It maps a name to itself, so directory
+// names read back from disk can be passed as camera IDs.
+func cameraDirName(cameraID string) string {
+	name := strings.NewReplacer("/", "_", `\`, "_").Replace(cameraID)
+	if name == "" || strings.Trim(name, ".") == "" {
+		name = "_" + name
+	}
+	return name
+}
+
+// recordingDir returns the directory holding a camera's segments
+func (sm *StreamManager) recordingDir(cameraID string) string {
+	return filepath.Join(sm.config.Recording.Path, cameraDirName(cameraID))
+}
+
+// listSegments returns the segments of a camera that overlap [from, to],
+// oldest first. Zero times leave the range open.
+func (sm *StreamManager) listSegments(cameraID string, from, to time.Time) ([]RecordingSegment, error) {
+	entries, err := os.ReadDir(sm.recordingDir(cameraID))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to list recordings for camera %s: %v", cameraID, err)
+	}
+
+	var segments []RecordingSegment
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || filepath.Ext(name) != ".mp4" {
+			continue
+		}
+		start, err := time.Parse(segmentLayout, strings.TrimSuffix(name, ".mp4"))
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		segments = append(segments, RecordingSegment{
+			CameraID: cameraID,
+			File:     name,
+			URL:      "/recordings/files/" + url.PathEscape(cameraDirName(cameraID)) + "/" + name,
+			Start:    start,
+			End:      info.ModTime().UTC(), // last write
+			Size:     info.Size(),
+		})
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].Start.Before(segments[j].Start)
+	})
+
+	// The last segment of an active recorder is still being written
+	if n := len(segments); n > 0 && sm.isRecording(cameraID) {
+		segments[n-1].Recording = true
+	}
+
+	matching := segments[:0]
+	for _, seg := range segments {
+		if (!from.IsZero() && seg.End.Before(from)) || (!to.IsZero() && seg.Start.After(to)) {
+			continue
+		}
+		matching = append(matching, seg)
+	}
+	return matching, nil
+}
+
+// isRecording reports whether a camera has an active recorder
+func (sm *StreamManager) isRecording(cameraID string) bool {
+	sm.streamMutex.RLock()
+	defer sm.streamMutex.RUnlock()
+
+	stream, exists := sm.streams[cameraID]
+	return exists && stream.recorder != nil
+}
+
+// runRecordingCleaner deletes segments older than the retention period of
+// their camera every 10 minutes
+func (sm *StreamManager) runRecordingCleaner() {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Panic in recording cleaner: %v", r)
+		}
+	}()
+
+	for {
+		sm.cleanRecordings()
+		time.Sleep(10 * time.Minute)
+	}
+}
+
+// cleanRecordings applies the recording retention once and forgets old
+// export jobs
+func (sm *StreamManager) cleanRecordings() {
+	exportCutoff := time.Now().Add(-recordingExportKeep)
+	sm.recordExports.mutex.Lock()
+	for id, job := range sm.recordExports.jobs {
+		if job.FinishedAt != nil && job.FinishedAt.Before(exportCutoff) {
+			delete(sm.recordExports.jobs, id)
+		}
+	}
+	sm.recordExports.mutex.Unlock()
+
+	cameras, err := os.ReadDir(sm.config.Recording.Path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Failed to list recordings: %v", err)
+		}
+		return
+	}
+
+	// Active streams may override the retention period
+	configs := make(map[string]RecordingConfig)
+	sm.streamMutex.RLock()
+	for _, stream := range sm.streams {
+		configs[cameraDirName(stream.Camera.ID)] = sm.recordingConfig(stream.Camera)
+	}
+	sm.streamMutex.RUnlock()
+
+	for _, dir := range cameras {
+		if !dir.IsDir() {
+			continue
+		}
+		cameraID := dir.Name()
+
+		config, ok := configs[cameraID]
+		if !ok {
+			config = sm.config.Recording
+		}
+		if config.RetentionHours <= 0 {
+			continue
+		}
+
+		cutoff := time.Now().Add(-time.Duration(config.RetentionHours) * time.Hour)
+		segments, err := sm.listSegments(cameraID, time.Time{}, cutoff)
+		if err != nil {
+			log.Printf("Recording cleanup failed for camera %s: %v", cameraID, err)
+			continue
+		}
+		for _, seg := range segments {
+			if seg.Recording || !seg.End.Before(cutoff) {
+				continue
+			}
+			path := filepath.Join(sm.recordingDir(cameraID), seg.File)
+			if err := os.Remove(path); err != nil {
+				log.Printf("Failed to delete recording %s: %v", path, err)
+				continue
+			}
+			log.Printf("Recording retention: deleted %s", path)
+		}
+	}
+}
+
+// exportRange writes the recording of a camera between from and to to an MP4
+// file in the snapshot store and returns its key and URL
+func (sm *StreamManager) exportRange(cameraID string, from, to time.Time, accurate bool) (string, string, error) {
+	segments, err := sm.listSegments(cameraID, from, to)
+	if err != nil {
+		return "", "", err
+	}
+	if len(segments) == 0 {
+		return "", "", fmt.Errorf("no recordings for camera %s between %s and %s", cameraID, from.Format(time.RFC3339), to.Format(time.RFC3339))
+	}
+
+	list, err := os.CreateTemp("", "export-*.txt")
+	if err != nil {
+		return "", "", fmt.Errorf("failed to create segment list: %v", err)
+	}
+	defer os.Remove(list.Name())
+	for _, seg := range segments {
+		path, err := filepath.Abs(filepath.Join(sm.recordingDir(cameraID), seg.File))
+		if err != nil {
+			list.Close()
+			return "", "", err
+		}
+		fmt.Fprintf(list, "file '%s'\n", strings.ReplaceAll(path, "'", `'\''`))
+	}
+	list.Close()
+
+	out, err := os.CreateTemp("", "export-*.mp4")
+	if err != nil {
+		return "", "", fmt.Errorf("failed to create export file: %v", err)
+	}
+	out.Close()
+	defer os.Remove(out.Name())
+
+	// from lies in the first segment or before it, so the offset is not
+	// affected by gaps between segments
+	offset := from.Sub(segments[0].Start)
+	if offset < 0 {
+		offset = 0
+	}
+	// The concatenated timeline has no gaps, so its length is the recorded
+	// time in the range rather than to - from
+	args := []string{
+		"-y",
+		"-ss", fmt.Sprintf("%.3f", offset.Seconds()),
+		"-f", "concat",
+		"-safe", "0",
+		"-i", list.Name(),
+		"-t", fmt.Sprintf("%.3f", recordedDuration(segments, from, to).Seconds()),
+	}
+	if accurate {
+		// Re-encode to cut on the exact frames
+		args = append(args, "-c:v", "libx264", "-preset", "veryfast", "-pix_fmt", "yuv420p")
+	} else {
+		// Copy the stream; the input seek starts the export at the keyframe
+		// at or before from, so it may begin up to a GOP early
+		args = append(args, "-c", "copy")
+	}
+	args = append(args, "-movflags", "+faststart", out.Name())
+
+	cmd := exec.Command("ffmpeg", args...)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", "", fmt.Errorf("ffmpeg failed: %v: %s", err, lastLine(stderr.String()))
+	}
+
+	key := fmt.Sprintf("%s/exports/%s_%s.mp4", cameraID, from.UTC().Format(segmentLayout), to.UTC().Format(segmentLayout))
+	url, err := sm.store.SaveFile(key, out.Name(), "video/mp4")
+	if err != nil {
+		return "", "", err
+	}
+	return key, url, nil
+}
+
+// startRecordingExport queues an export and returns the job. At most
+// max_exports run at once; the others stay queued until a slot frees.
+func (sm *StreamManager) startRecordingExport(cameraID string, from, to time.Time, accurate bool) RecordingExport {
+	id := newEventID()
+	job := &RecordingExport{
+		ID:        id,
+		Status:    ExportQueued,
+		CameraID:  cameraID,
+		From:      from,
+		To:        to,
+		Accurate:  accurate,
+		CreatedAt: time.Now(),
+		StatusURL: strings.TrimSuffix(sm.config.Storage.PublicURL, "/") + "/recordings/export/" + id,
+	}
+
+	sm.recordExports.mutex.Lock()
+	if sm.recordExports.jobs == nil {
+		sm.recordExports.jobs = make(map[string]*RecordingExport)
+	}
+	if sm.recordExports.slots == nil {
+		slots := sm.config.Recording.MaxExports
+		if slots <= 0 {
+			slots = 1
+		}
+		sm.recordExports.slots = make(chan struct{}, slots)
+	}
+	sm.recordExports.jobs[id] = job
+	queued := *job
+	slots := sm.recordExports.slots
+	sm.recordExports.mutex.Unlock()
+
+	go sm.runRecordingExport(id, slots)
+	return queued
+}
+
+// runRecordingExport waits for a slot, runs ffmpeg and records the outcome
+func (sm *StreamManager) runRecordingExport(id string, slots chan struct{}) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Panic in recording export %s: %v", id, r)
+			sm.recordExports.update(id, func(job *RecordingExport) {
+				job.Status = ExportFailed
+				job.Error = fmt.Sprintf("panic: %v", r)
+				now := time.Now()
+				job.FinishedAt = &now
+			})
+		}
+	}()
+
+	slots <- struct{}{}
+	defer func() { <-slots }()
+
+	var job RecordingExport
+	sm.recordExports.update(id, func(j *RecordingExport) {
+		j.Status = ExportRunning
+		job = *j
+	})
+
+	key, url, err := sm.exportRange(job.CameraID, job.From, job.To, job.Accurate)
+	sm.recordExports.update(id, func(j *RecordingExport) {
+		now := time.Now()
+		j.FinishedAt = &now
+		if err != nil {
+			j.Status = ExportFailed
+			j.Error = err.Error()
+			return
+		}
+		j.Status = ExportDone
+		j.Key = key
+		j.URL = url
+	})
+	if err != nil {
+		log.Printf("Recording export %s for camera %s failed: %v", id, job.CameraID, err)
+		return
+	}
+	log.Printf("Recording export %s for camera %s ready: %s", id, job.CameraID, key)
+}
+
+// recordedDuration returns how much of [from, to] the segments cover
+func recordedDuration(segments []RecordingSegment, from, to time.Time) time.Duration {
+	var total time.Duration
+	for _, seg := range segments {
+		start, end := seg.Start, seg.End
+		if start.Before(from) {
+			start = from
+		}
+		if end.After(to) {
+			end = to
+		}
+		if end.After(start) {
+			total += end.Sub(start)
+		}
+	}
+	return total
+}
+
+// handleListRecordings lists the recorded segments of a camera:
+// GET /recordings?camera=&from=&to=
+func (sm *StreamManager) handleListRecordings(c *gin.Context) {
+	cameraID := c.Query("camera")
+	if cameraID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "camera is required"})
+		return
+	}
+
+	var from, to time.Time
+	if v := c.Query("from"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "from must be an RFC 3339 time"})
+			return
+		}
+		from = t
+	}
+	if v := c.Query("to"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "to must be an RFC 3339 time"})
+			return
+		}
+		to = t
+	}
+
+	segments, err := sm.listSegments(cameraID, from, to)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if segments == nil {
+		segments = []RecordingSegment{}
+	}
+	c.JSON(http.StatusOK, gin.H{"camera_id": cameraID, "segments": segments})
+}
+
+// handleExportRecording queues the export of a time range of a camera's
+// recording as one MP4
+func (sm *StreamManager) handleExportRecording(c *gin.Context) {
+	var req struct {
+		CameraID string    `json:"camera_id" binding:"required"`
+		From     time.Time `json:"from" binding:"required"`
+		To       time.Time `json:"to" binding:"required"`
+		Accurate bool      `json:"accurate"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !req.To.After(req.From) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "to must be after from"})
+		return
+	}
+	if max := time.Duration(sm.config.Recording.MaxExportMinutes) * time.Minute; max > 0 && req.To.Sub(req.From) > max {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("export is limited to %d minutes", sm.config.Recording.MaxExportMinutes)})
+		return
+	}
+
+	job := sm.startRecordingExport(req.CameraID, req.From, req.To, req.Accurate)
+	c.JSON(http.StatusAccepted, job)
+}
+
+// handleRecordingExportStatus reports a recording export job
+func (sm *StreamManager) handleRecordingExportStatus(c *gin.Context) {
+	job, ok := sm.recordExports.get(c.Param("id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "export not found"})
+		return
+	}
+	c.JSON(http.StatusOK, job)
+}
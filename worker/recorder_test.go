@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestCameraDirName(t *testing.T) {
+	tests := []struct {
+		id   string
+		want string
+	}{
+		{"cam-1", "cam-1"},
+		{"front door", "front door"},
+		{"site/cam-1", "site_cam-1"},
+		{`site\cam-1`, "site_cam-1"},
+		{"..", "_.."},
+		{".", "_."},
+		{"", "_"},
+	}
+	for _, tt := range tests {
+		got := cameraDirName(tt.id)
+		if got != tt.want {
+			t.Errorf("cameraDirName(%q) = %q, want %q", tt.id, got, tt.want)
+		}
+		// Directory names read back from disk map to themselves
+		if again := cameraDirName(got); again != got {
+			t.Errorf("cameraDirName(%q) = %q, want it unchanged", got, again)
+		}
+	}
+}
+
+func TestListSegmentsURL(t *testing.T) {
+	sm := &StreamManager{streams: map[string]*CameraStream{}}
+	sm.config.Recording.Path = t.TempDir()
+	dir := sm.recordingDir("site/front door")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "20240501-142500.mp4"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	segments, err := sm.listSegments("site/front door", time.Time{}, time.Time{})
+	if err != nil || len(segments) != 1 {
+		t.Fatalf("listSegments() = %v, %v; want one segment", segments, err)
+	}
+	// The URL names the directory the segment is served from
+	if want := "/recordings/files/site_front%20door/20240501-142500.mp4"; segments[0].URL != want {
+		t.Errorf("segment URL = %q, want %q", segments[0].URL, want)
+	}
+}
+
+func TestRecordingExportJob(t *testing.T) {
+	sm := &StreamManager{streams: map[string]*CameraStream{}}
+	sm.config.Recording.Path = t.TempDir()
+	sm.config.Recording.MaxExportMinutes = 60
+	sm.config.Recording.MaxExports = 1
+	sm.config.Storage.PublicURL = "http://worker"
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/recordings/export", sm.handleExportRecording)
+	router.GET("/recordings/export/:id", sm.handleRecordingExportStatus)
+
+	request := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	status := func(id string) RecordingExport {
+		w := request(http.MethodGet, "/recordings/export/"+id, "")
+		var job RecordingExport
+		if w.Code != http.StatusOK {
+			t.Fatalf("status of %s: %d", id, w.Code)
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &job); err != nil {
+			t.Fatal(err)
+		}
+		return job
+	}
+
+	if w := request(http.MethodPost, "/recordings/export", `{"camera_id": "cam-1", "from": "2024-05-01T15:00:00Z", "to": "2024-05-01T14:00:00Z"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("reversed range: status %d, want 400", w.Code)
+	}
+	if w := request(http.MethodPost, "/recordings/export", `{"camera_id": "cam-1", "from": "2024-05-01T14:00:00Z", "to": "2024-05-01T16:00:00Z"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("range over max_export_minutes: status %d, want 400", w.Code)
+	}
+	if w := request(http.MethodGet, "/recordings/export/unknown", ""); w.Code != http.StatusNotFound {
+		t.Errorf("unknown export: status %d, want 404", w.Code)
+	}
+
+	// Hold the only slot, so the export has to wait
+	slots := make(chan struct{}, 1)
+	slots <- struct{}{}
+	sm.recordExports.slots = slots
+	waitFor := func(id, state string) RecordingExport {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			job := status(id)
+			if job.Status == state || time.Now().After(deadline) {
+				return job
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	w := request(http.MethodPost, "/recordings/export", `{"camera_id": "cam-1", "from": "2024-05-01T14:00:00Z", "to": "2024-05-01T14:30:00Z"}`)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("export: status %d, want 202: %s", w.Code, w.Body)
+	}
+	var job RecordingExport
+	if err := json.Unmarshal(w.Body.Bytes(), &job); err != nil {
+		t.Fatal(err)
+	}
+	if job.Status != ExportQueued || job.StatusURL != "http://worker/recordings/export/"+job.ID {
+		t.Errorf("queued job = %+v", job)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if got := status(job.ID); got.Status != ExportQueued {
+		t.Errorf("export ran while every slot was taken: %+v", got)
+	}
+
+	// Once the slot frees, it runs and fails: there are no recordings
+	<-slots
+	if got := waitFor(job.ID, ExportFailed); got.Status != ExportFailed || got.FinishedAt == nil || got.Error == "" {
+		t.Errorf("export without recordings = %+v, want failed", got)
+	}
+	select {
+	case slots <- struct{}{}:
+	case <-time.After(time.Second):
+		t.Error("export did not release its slot")
+	}
+}
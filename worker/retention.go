@@ -0,0 +1,386 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RetentionConfig limits how much snapshot storage is kept. A zero limit is disabled.
+type RetentionConfig struct {
+	MaxAgeHours     int            `yaml:"max_age_hours"`
+	MaxTotalMB      int            `yaml:"max_total_mb"`
+	CameraQuotaMB   int            `yaml:"camera_quota_mb"`
+	CameraQuotasMB  map[string]int `yaml:"camera_quotas_mb"`
+	IntervalSeconds int            `yaml:"interval_seconds"`
+	FlagsFile       string         `yaml:"flags_file"`
+}
+
+// enabled reports whether any retention limit is set
+func (c RetentionConfig) enabled() bool {
+	return c.MaxAgeHours > 0 || c.MaxTotalMB > 0 || c.CameraQuotaMB > 0 || len(c.CameraQuotasMB) > 0
+}
+
+// quota returns the storage quota for a camera in bytes, 0 for none
+func (c RetentionConfig) quota(cameraID string) int64 {
+	if mb, ok := c.CameraQuotasMB[cameraID]; ok {
+		return int64(mb) << 20
+	}
+	return int64(c.CameraQuotaMB) << 20
+}
+
+// CameraUsage is the storage used by one camera
+type CameraUsage struct {
+	Bytes int64 `json:"bytes"`
+	Files int   `json:"files"`
+}
+
+// StorageUsage is a snapshot of storage use taken by the cleaner
+type StorageUsage struct {
+	TotalBytes   int64                  `json:"total_bytes"`
+	TotalFiles   int                    `json:"total_files"`
+	FlaggedFiles int                    `json:"flagged_files"`
+	Cameras      map[string]CameraUsage `json:"cameras"`
+	ScannedAt    time.Time              `json:"scanned_at"`
+	LastDeleted  int                    `json:"last_deleted"`
+	LastFreed    int64                  `json:"last_freed_bytes"`
+}
+
+// RetentionManager applies the retention policy to a SnapshotStore and keeps
+// the set of flagged snapshots that must never be deleted
+type RetentionManager struct {
+	config  RetentionConfig
+	store   SnapshotStore
+	metrics *Metrics
+	flagged map[string]bool // snapshot base keys, so related files are kept too
+	usage   *StorageUsage
+	mutex   sync.Mutex
+	runLock sync.Mutex
+}
+
+// NewRetentionManager creates a manager and loads the flagged list
+func NewRetentionManager(config RetentionConfig, store SnapshotStore, metrics *Metrics) *RetentionManager {
+	rm := &RetentionManager{
+		config:  config,
+		store:   store,
+		metrics: metrics,
+		flagged: make(map[string]bool),
+	}
+
+	if data, err := os.ReadFile(config.FlagsFile); err == nil {
+		var keys []string
+		if err := json.Unmarshal(data, &keys); err != nil {
+			log.Printf("Failed to load retention flags from %s: %v", config.FlagsFile, err)
+		}
+		for _, key := range keys {
+			rm.flagged[key] = true
+		}
+	}
+
+	return rm
+}
+
+// Run cleans up on the configured interval until the process exits
+func (rm *RetentionManager) Run() {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Panic in retention cleaner: %v", r)
+		}
+	}()
+
+	interval := time.Duration(rm.config.IntervalSeconds) * time.Second
+	if interval <= 0 {
+		interval = 5 * time.Minute
+	}
+
+	for {
+		if _, err := rm.Cleanup(); err != nil {
+			log.Printf("Retention cleanup failed: %v", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// snapshotGroup is a snapshot with its related files (variants, sidecar,
+// thumbnail, crops, alert record, clip), which are kept or deleted together
+type snapshotGroup struct {
+	base    string
+	camera  string
+	objects []StoredObject
+	size    int64
+	modTime time.Time // of the newest file, e.g. an alert record written later
+}
+
+// groupSnapshots groups stored files by snapshot, oldest group first
+func groupSnapshots(objects []StoredObject) []*snapshotGroup {
+	byBase := make(map[string]*snapshotGroup)
+	var groups []*snapshotGroup
+	for _, obj := range objects {
+		base := snapshotBase(obj.Key)
+		group, ok := byBase[base]
+		if !ok {
+			group = &snapshotGroup{base: base, camera: cameraFromKey(obj.Key)}
+			byBase[base] = group
+			groups = append(groups, group)
+		}
+		group.objects = append(group.objects, obj)
+		group.size += obj.Size
+		if obj.ModTime.After(group.modTime) {
+			group.modTime = obj.ModTime
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].modTime.Before(groups[j].modTime)
+	})
+	return groups
+}
+
+// Cleanup deletes snapshots that break the retention policy, oldest first,
+// and refreshes the usage figures. A snapshot's files go together, so no
+// sidecar or crop outlives its image.
+func (rm *RetentionManager) Cleanup() (*StorageUsage, error) {
+	rm.runLock.Lock()
+	defer rm.runLock.Unlock()
+
+	objects, err := rm.store.List("")
+	if err != nil {
+		return nil, err
+	}
+	groups := groupSnapshots(objects)
+
+	rm.mutex.Lock()
+	flagged := make(map[string]bool, len(rm.flagged))
+	for k := range rm.flagged {
+		flagged[k] = true
+	}
+	rm.mutex.Unlock()
+
+	deleted := make(map[string]bool)
+	deletedCount := 0
+	var freed int64
+	// remove deletes a group's files and returns the bytes freed; files that
+	// fail to delete are retried on the next run
+	remove := func(group *snapshotGroup, reason string) int64 {
+		var groupFreed int64
+		for _, obj := range group.objects {
+			if deleted[obj.Key] {
+				continue
+			}
+			if err := rm.store.Delete(obj.Key); err != nil {
+				log.Printf("Retention: failed to delete %s: %v", obj.Key, err)
+				continue
+			}
+			deleted[obj.Key] = true
+			deletedCount++
+			groupFreed += obj.Size
+			rm.metrics.Inc("worker_storage_deleted_total", "reason", reason)
+		}
+		log.Printf("Retention: deleted %s (%d file(s), %d bytes, %s)", group.base, len(group.objects), groupFreed, reason)
+		freed += groupFreed
+		return groupFreed
+	}
+	isDeleted := func(group *snapshotGroup) bool {
+		return deleted[group.objects[0].Key]
+	}
+
+	// Maximum age
+	if rm.config.MaxAgeHours > 0 {
+		cutoff := time.Now().Add(-time.Duration(rm.config.MaxAgeHours) * time.Hour)
+		for _, group := range groups {
+			if group.modTime.Before(cutoff) && !flagged[group.base] {
+				remove(group, "max_age")
+			}
+		}
+	}
+
+	// Per-camera quotas
+	cameraBytes := make(map[string]int64)
+	for _, group := range groups {
+		if !isDeleted(group) {
+			cameraBytes[group.camera] += group.size
+		}
+	}
+	for _, group := range groups {
+		quota := rm.config.quota(group.camera)
+		if quota <= 0 || isDeleted(group) || flagged[group.base] || cameraBytes[group.camera] <= quota {
+			continue
+		}
+		cameraBytes[group.camera] -= remove(group, "camera_quota")
+	}
+
+	// Maximum total size
+	if rm.config.MaxTotalMB > 0 {
+		limit := int64(rm.config.MaxTotalMB) << 20
+		var total int64
+		for _, obj := range objects {
+			if !deleted[obj.Key] {
+				total += obj.Size
+			}
+		}
+		for _, group := range groups {
+			if total <= limit {
+				break
+			}
+			if isDeleted(group) || flagged[group.base] {
+				continue
+			}
+			total -= remove(group, "max_total")
+		}
+	}
+
+	// Usage after cleanup
+	usage := &StorageUsage{
+		Cameras:     make(map[string]CameraUsage),
+		ScannedAt:   time.Now(),
+		LastDeleted: deletedCount,
+		LastFreed:   freed,
+	}
+	for _, obj := range objects {
+		if deleted[obj.Key] {
+			continue
+		}
+		usage.TotalBytes += obj.Size
+		usage.TotalFiles++
+		if flagged[snapshotBase(obj.Key)] {
+			usage.FlaggedFiles++
+		}
+		camera := cameraFromKey(obj.Key)
+		cu := usage.Cameras[camera]
+		cu.Bytes += obj.Size
+		cu.Files++
+		usage.Cameras[camera] = cu
+	}
+
+	rm.metrics.Set("worker_storage_bytes", float64(usage.TotalBytes))
+	rm.metrics.Set("worker_storage_files", float64(usage.TotalFiles))
+	rm.metrics.Reset("worker_storage_camera_bytes")
+	for camera, cu := range usage.Cameras {
+		rm.metrics.Set("worker_storage_camera_bytes", float64(cu.Bytes), "camera", camera)
+	}
+
+	if deletedCount > 0 {
+		log.Printf("Retention: deleted %d file(s), freed %d bytes, %d bytes in use", deletedCount, freed, usage.TotalBytes)
+	}
+
+	rm.mutex.Lock()
+	rm.usage = usage
+	rm.mutex.Unlock()
+
+	return usage, nil
+}
+
+// Usage returns the usage from the last scan, scanning now if there hasn't been one
+func (rm *RetentionManager) Usage() (*StorageUsage, error) {
+	rm.mutex.Lock()
+	usage := rm.usage
+	rm.mutex.Unlock()
+
+	if usage != nil {
+		return usage, nil
+	}
+	return rm.Cleanup()
+}
+
+// SetFlagged marks or unmarks a snapshot (by key or URL) as flagged
+func (rm *RetentionManager) SetFlagged(snapshot string, flagged bool) error {
+	key := snapshotKeyFromRef(snapshot)
+	if key == "" {
+		return fmt.Errorf("snapshot is required")
+	}
+	base := snapshotBase(key)
+
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+
+	if flagged {
+		rm.flagged[base] = true
+	} else {
+		delete(rm.flagged, base)
+	}
+
+	keys := make([]string, 0, len(rm.flagged))
+	for k := range rm.flagged {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	data, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(rm.config.FlagsFile, data, 0644); err != nil {
+		return fmt.Errorf("failed to save retention flags: %v", err)
+	}
+	return nil
+}
+
+// snapshotKeyFromRef accepts a storage key or a snapshot URL and returns the key
+func snapshotKeyFromRef(ref string) string {
+	for _, route := range []string{"/snapshots/", "/media/"} {
+		if i := strings.Index(ref, route); i >= 0 {
+			ref = ref[i+len(route):]
+			break
+		}
+	}
+	if i := strings.IndexAny(ref, "?#"); i >= 0 {
+		ref = ref[:i]
+	}
+	return strings.TrimPrefix(ref, "/")
+}
+
+// cameraFromKey returns the camera a stored file belongs to. Keys are either
+// "<camera>/..." or "<camera>_<timestamp>.<ext>".
+func cameraFromKey(key string) string {
+	if i := strings.Index(key, "/"); i > 0 {
+		return key[:i]
+	}
+	name := snapshotBase(key)
+	if i := strings.LastIndex(name, "_"); i > 0 {
+		return name[:i]
+	}
+	return name
+}
+
+// handleStorageUsage reports storage usage per camera
+func (sm *StreamManager) handleStorageUsage(c *gin.Context) {
+	var (
+		usage *StorageUsage
+		err   error
+	)
+	if c.Query("refresh") == "true" {
+		usage, err = sm.retention.Cleanup()
+	} else {
+		usage, err = sm.retention.Usage()
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, usage)
+}
+
+// handleFlagSnapshot flags or unflags a snapshot so retention keeps it
+func (sm *StreamManager) handleFlagSnapshot(c *gin.Context) {
+	var req struct {
+		Snapshot string `json:"snapshot"`
+		Flagged  bool   `json:"flagged"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := sm.retention.SetFlagged(req.Snapshot, req.Flagged); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"snapshot": snapshotKeyFromRef(req.Snapshot), "flagged": req.Flagged})
+}
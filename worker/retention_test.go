@@ -0,0 +1,116 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestGroupSnapshots(t *testing.T) {
+	now := time.Now()
+	objects := []StoredObject{
+		{Key: "cam-1/2024-05-01/b.jpg", Size: 10, ModTime: now.Add(-time.Hour)},
+		{Key: "cam-1/2024-05-01/a_thumb.jpg", Size: 1, ModTime: now.Add(-3 * time.Hour)},
+		{Key: "cam-1/2024-05-01/a.jpg", Size: 10, ModTime: now.Add(-3 * time.Hour)},
+		// An alert record written later makes the group newer
+		{Key: "cam-1/2024-05-01/a_alert.json", Size: 2, ModTime: now.Add(-30 * time.Minute)},
+		{Key: "cam-2_20240501T100000.jpg", Size: 5, ModTime: now.Add(-2 * time.Hour)},
+		{Key: "cam-2_20240501T100000_face0.jpg", Size: 3, ModTime: now.Add(-2 * time.Hour)},
+	}
+
+	type group struct {
+		base   string
+		camera string
+		files  int
+		size   int64
+	}
+	var got []group
+	for _, g := range groupSnapshots(objects) {
+		got = append(got, group{g.base, g.camera, len(g.objects), g.size})
+	}
+	want := []group{
+		{"cam-2_20240501T100000", "cam-2", 2, 8},
+		{"cam-1/2024-05-01/b", "cam-1", 1, 10},
+		{"cam-1/2024-05-01/a", "cam-1", 3, 13},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("groupSnapshots() = %+v, want %+v", got, want)
+	}
+}
+
+func TestRetentionCleanup(t *testing.T) {
+	// Each snapshot is an image and a thumbnail totalling 1 MB; a is flagged
+	snapshots := []struct {
+		base string
+		age  time.Duration
+	}{
+		{"cam-1/2024-05-01/a", 4 * time.Hour},
+		{"cam-1/2024-05-01/b", 3 * time.Hour},
+		{"cam-1/2024-05-01/c", 2 * time.Hour},
+		{"cam-1/2024-05-01/d", 50 * time.Minute},
+		{"cam-2/2024-04-29/e", 48 * time.Hour},
+		{"cam-2/2024-05-01/f", 30 * time.Minute},
+	}
+	const thumbSize = 100
+
+	tests := []struct {
+		name   string
+		config RetentionConfig
+		want   []string
+	}{
+		{"no limits", RetentionConfig{}, []string{"a", "b", "c", "d", "e", "f"}},
+		{"max age", RetentionConfig{MaxAgeHours: 1}, []string{"a", "d", "f"}},
+		// Oldest unflagged snapshots go first until the camera fits
+		{"camera quota", RetentionConfig{CameraQuotaMB: 2}, []string{"a", "d", "e", "f"}},
+		{"per-camera quota", RetentionConfig{CameraQuotaMB: 2, CameraQuotasMB: map[string]int{"cam-1": 0, "cam-2": 1}}, []string{"a", "b", "c", "d", "f"}},
+		{"max total", RetentionConfig{MaxTotalMB: 3}, []string{"a", "d", "f"}},
+	}
+	for _, tt := range tests {
+		store, err := NewLocalStore(t.TempDir(), "http://worker")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range snapshots {
+			modTime := time.Now().Add(-s.age)
+			files := map[string]int{s.base + ".jpg": 1<<20 - thumbSize, s.base + "_thumb.jpg": thumbSize}
+			for key, size := range files {
+				if _, err := store.Save(key, make([]byte, size), "image/jpeg"); err != nil {
+					t.Fatal(err)
+				}
+				p, _ := store.path(key)
+				if err := os.Chtimes(p, modTime, modTime); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+
+		rm := NewRetentionManager(tt.config, store, NewMetrics())
+		rm.flagged["cam-1/2024-05-01/a"] = true
+		usage, err := rm.Cleanup()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+
+		objects, err := store.List("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, g := range groupSnapshots(objects) {
+			if len(g.objects) != 2 {
+				t.Errorf("%s: %s kept %d of its 2 files", tt.name, g.base, len(g.objects))
+			}
+			got = append(got, filepath.Base(g.base))
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: kept %v, want %v", tt.name, got, tt.want)
+		}
+		if usage.TotalBytes != int64(len(tt.want))<<20 || usage.TotalFiles != 2*len(tt.want) || usage.FlaggedFiles != 2 {
+			t.Errorf("%s: usage = %+v", tt.name, usage)
+		}
+	}
+}
@@ -0,0 +1,756 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RTSPServerConfig enables the embedded RTSP server, which serves the
+// published streams itself so small installs can run without MediaMTX
+type RTSPServerConfig struct {
+	Enabled  bool   `yaml:"enabled"`
+	Address  string `yaml:"address"`
+	UDPPort  int    `yaml:"udp_port"` // RTP port for UDP readers, RTCP on the next one; 0 is TCP only
+	ReadUser string `yaml:"read_user"`
+	ReadPass string `yaml:"read_pass"`
+}
+
+const (
+	rtpPayloadType = 96
+	rtpClockRate   = 90000
+	// Keeps packets under a typical MTU with IP, UDP and RTP headers
+	rtpMaxPayload = 1400
+	// Access units queued per reader before it skips to the next keyframe
+	rtspReaderQueue = 64
+	rtspTimeout     = 60 * time.Second
+	rtspTrack       = "trackID=0"
+)
+
+// RTSPServer serves H.264 streams fed by the publishers' ffmpeg processes
+type RTSPServer struct {
+	config   RTSPServerConfig
+	listener net.Listener
+	rtp      *net.UDPConn
+	rtcp     *net.UDPConn
+	mutex    sync.RWMutex
+	streams  map[string]*rtspStream
+}
+
+// RTSPStreamStatus is the embedded server part of the stream status
+type RTSPStreamStatus struct {
+	Path    string `json:"path"`
+	Readers int    `json:"readers"`
+}
+
+// rtspStream is one served path and its readers
+type rtspStream struct {
+	name    string
+	demand  func() func()
+	mutex   sync.Mutex
+	sps     []byte
+	pps     []byte
+	seq     uint16
+	ssrc    uint32
+	start   time.Time
+	readers map[*rtspReader]struct{}
+}
+
+// rtspReader receives the RTP packets of a stream, one access unit at a time
+type rtspReader struct {
+	packets chan [][]byte
+	needKey bool // guarded by the stream mutex
+	release func()
+	close   func()
+}
+
+// validateRTSPServer refuses an embedded RTSP server open to anyone while the
+// worker's HTTP routes for the same frames require a token
+func (c Config) validateRTSPServer() error {
+	if c.RTSPServer.Enabled && c.authRequired() && (c.RTSPServer.ReadUser == "" || c.RTSPServer.ReadPass == "") {
+		return fmt.Errorf("rtsp_server needs read_user and read_pass while media routes require a token")
+	}
+	return nil
+}
+
+// NewRTSPServer listens on the configured address and UDP ports
+func NewRTSPServer(config RTSPServerConfig) (*RTSPServer, error) {
+	listener, err := net.Listen("tcp", config.Address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %v", config.Address, err)
+	}
+	s := &RTSPServer{
+		config:   config,
+		listener: listener,
+		streams:  make(map[string]*rtspStream),
+	}
+	if config.UDPPort > 0 {
+		if s.rtp, err = net.ListenUDP("udp", &net.UDPAddr{Port: config.UDPPort}); err == nil {
+			s.rtcp, err = net.ListenUDP("udp", &net.UDPAddr{Port: config.UDPPort + 1})
+		}
+		if err != nil {
+			listener.Close()
+			if s.rtp != nil {
+				s.rtp.Close()
+			}
+			return nil, fmt.Errorf("failed to listen on UDP port %d: %v", config.UDPPort, err)
+		}
+	}
+	log.Printf("Embedded RTSP server listening on %s (UDP port %d, auth=%t)", listener.Addr(), config.UDPPort, config.ReadUser != "")
+	return s, nil
+}
+
+// Run accepts RTSP connections until the listener is closed
+func (s *RTSPServer) Run() {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Panic in RTSP server: %v", r)
+		}
+	}()
+
+	// Receiver reports and NAT keepalives from UDP readers are not used
+	for _, conn := range []*net.UDPConn{s.rtp, s.rtcp} {
+		if conn != nil {
+			go func(conn *net.UDPConn) {
+				buf := make([]byte, 1500)
+				for {
+					if _, _, err := conn.ReadFromUDP(buf); err != nil {
+						return
+					}
+				}
+			}(conn)
+		}
+	}
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("RTSP server stopped: %v", err)
+			}
+			return
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// Close stops the server and disconnects every reader
+func (s *RTSPServer) Close() {
+	s.listener.Close()
+	if s.rtp != nil {
+		s.rtp.Close()
+		s.rtcp.Close()
+	}
+	s.mutex.Lock()
+	names := make([]string, 0, len(s.streams))
+	for name := range s.streams {
+		names = append(names, name)
+	}
+	s.mutex.Unlock()
+	for _, name := range names {
+		s.RemoveStream(name)
+	}
+}
+
+// AddStream serves a path. demand, if set, is held while readers play it.
+func (s *RTSPServer) AddStream(name string, demand func() func()) {
+	b := make([]byte, 4)
+	rand.Read(b)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.streams[name] = &rtspStream{
+		name:    name,
+		demand:  demand,
+		ssrc:    binary.BigEndian.Uint32(b),
+		start:   time.Now(),
+		readers: make(map[*rtspReader]struct{}),
+	}
+}
+
+// RemoveStream stops serving a path and disconnects its readers
+func (s *RTSPServer) RemoveStream(name string) {
+	s.mutex.Lock()
+	st, ok := s.streams[name]
+	delete(s.streams, name)
+	s.mutex.Unlock()
+	if !ok {
+		return
+	}
+	st.mutex.Lock()
+	readers := make([]*rtspReader, 0, len(st.readers))
+	for reader := range st.readers {
+		readers = append(readers, reader)
+	}
+	st.mutex.Unlock()
+	for _, reader := range readers {
+		reader.close()
+	}
+}
+
+// stream returns the stream of a path, or nil
+func (s *RTSPServer) stream(name string) *rtspStream {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.streams[name]
+}
+
+// Status returns the number of readers of a path
+func (s *RTSPServer) Status(name string) RTSPStreamStatus {
+	status := RTSPStreamStatus{Path: name}
+	if st := s.stream(name); st != nil {
+		st.mutex.Lock()
+		status.Readers = len(st.readers)
+		st.mutex.Unlock()
+	}
+	return status
+}
+
+// Feed reads ffmpeg's H.264 Annex B output and serves it at a path until
+// the output ends
+func (s *RTSPServer) Feed(name string, r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 1<<20), 8<<20)
+	scanner.Split(splitAnnexB)
+
+	// An access unit is complete when the next one starts, which costs one
+	// frame of latency but needs no parsing beyond the NAL unit header
+	var au [][]byte
+	vcl := false
+	for scanner.Scan() {
+		nalu := scanner.Bytes()
+		if len(nalu) == 0 {
+			continue
+		}
+		typ := nalu[0] & 0x1f
+		isVCL := typ >= 1 && typ <= 5
+		// SEI, parameter sets and delimiters after a picture, or a first
+		// slice (first_mb_in_slice 0), start the next access unit
+		startsAU := typ == 6 || typ == 7 || typ == 8 || typ == 9 || (typ >= 14 && typ <= 18) ||
+			(isVCL && len(nalu) > 1 && nalu[1]&0x80 != 0)
+		if vcl && startsAU {
+			if st := s.stream(name); st != nil {
+				st.writeAccessUnit(au)
+			}
+			au, vcl = nil, false
+		}
+		if typ == 9 {
+			continue
+		}
+		au = append(au, append([]byte(nil), nalu...))
+		vcl = vcl || isVCL
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("RTSP server: reading stream %s: %v", name, err)
+		// Keep ffmpeg from blocking on the pipe until it exits
+		_, _ = io.Copy(io.Discard, r)
+	}
+}
+
+// splitAnnexB splits a byte stream at H.264 start codes into NAL units
+func splitAnnexB(data []byte, atEOF bool) (int, []byte, error) {
+	startCode := []byte{0, 0, 1}
+	start := bytes.Index(data, startCode)
+	if start < 0 {
+		if atEOF {
+			return len(data), nil, nil
+		}
+		return 0, nil, nil
+	}
+	begin := start + len(startCode)
+	next := bytes.Index(data[begin:], startCode)
+	if next < 0 {
+		if atEOF {
+			return len(data), bytes.TrimRight(data[begin:], "\x00"), nil
+		}
+		return start, nil, nil
+	}
+	end := begin + next
+	// The zero of a four byte start code trails the previous unit
+	return end, bytes.TrimRight(data[begin:end], "\x00"), nil
+}
+
+// writeAccessUnit packetizes an access unit once and queues it for every
+// reader. Readers that fall behind, and new ones, wait for a keyframe.
+func (st *rtspStream) writeAccessUnit(au [][]byte) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	idr, hasParams := false, false
+	for _, nalu := range au {
+		switch nalu[0] & 0x1f {
+		case 5:
+			idr = true
+		case 7:
+			st.sps, hasParams = nalu, true
+		case 8:
+			st.pps = nalu
+		}
+	}
+	// Readers joining at this keyframe need the parameter sets
+	if idr && !hasParams && st.sps != nil && st.pps != nil {
+		au = append([][]byte{st.sps, st.pps}, au...)
+	}
+	if len(st.readers) == 0 {
+		return
+	}
+
+	ts := uint32(time.Since(st.start).Seconds() * rtpClockRate)
+	packets := st.packetize(au, ts)
+	for reader := range st.readers {
+		if reader.needKey && !idr {
+			continue
+		}
+		select {
+		case reader.packets <- packets:
+			reader.needKey = false
+		default:
+			reader.needKey = true
+		}
+	}
+}
+
+// packetize turns NAL units into RTP packets (RFC 6184, single NAL unit and
+// FU-A), with the marker bit on the last packet of the access unit
+func (st *rtspStream) packetize(au [][]byte, ts uint32) [][]byte {
+	var packets [][]byte
+	for i, nalu := range au {
+		last := i == len(au)-1
+		if len(nalu) <= rtpMaxPayload {
+			packets = append(packets, st.rtpPacket(nalu, ts, last))
+			continue
+		}
+		indicator := nalu[0]&0xe0 | 28
+		payload := nalu[1:]
+		for first := true; len(payload) > 0; first = false {
+			n := min(len(payload), rtpMaxPayload-2)
+			header := nalu[0] & 0x1f
+			if first {
+				header |= 0x80
+			}
+			if n == len(payload) {
+				header |= 0x40
+			}
+			fragment := append([]byte{indicator, header}, payload[:n]...)
+			payload = payload[n:]
+			packets = append(packets, st.rtpPacket(fragment, ts, last && len(payload) == 0))
+		}
+	}
+	return packets
+}
+
+// rtpPacket adds the RTP header to a payload. Callers hold the mutex.
+func (st *rtspStream) rtpPacket(payload []byte, ts uint32, marker bool) []byte {
+	pkt := make([]byte, 12+len(payload))
+	pkt[0] = 0x80
+	pkt[1] = rtpPayloadType
+	if marker {
+		pkt[1] |= 0x80
+	}
+	binary.BigEndian.PutUint16(pkt[2:], st.seq)
+	st.seq++
+	binary.BigEndian.PutUint32(pkt[4:], ts)
+	binary.BigEndian.PutUint32(pkt[8:], st.ssrc)
+	copy(pkt[12:], payload)
+	return pkt
+}
+
+// sdp describes the stream, with the parameter sets once they are known
+func (st *rtspStream) sdp() string {
+	st.mutex.Lock()
+	sps, pps := st.sps, st.pps
+	st.mutex.Unlock()
+
+	fmtp := "packetization-mode=1"
+	if sps != nil && pps != nil && len(sps) >= 4 {
+		fmtp += fmt.Sprintf("; profile-level-id=%s; sprop-parameter-sets=%s,%s",
+			strings.ToUpper(hex.EncodeToString(sps[1:4])),
+			base64.StdEncoding.EncodeToString(sps),
+			base64.StdEncoding.EncodeToString(pps))
+	}
+	return strings.Join([]string{
+		"v=0",
+		"o=- 0 0 IN IP4 127.0.0.1",
+		"s=" + st.name,
+		"c=IN IP4 0.0.0.0",
+		"t=0 0",
+		fmt.Sprintf("m=video 0 RTP/AVP %d", rtpPayloadType),
+		fmt.Sprintf("a=rtpmap:%d H264/%d", rtpPayloadType, rtpClockRate),
+		fmt.Sprintf("a=fmtp:%d %s", rtpPayloadType, fmtp),
+		"a=control:" + rtspTrack,
+		"",
+	}, "\r\n")
+}
+
+// addReader adds a reader that waits for the next keyframe
+func (st *rtspStream) addReader(reader *rtspReader) {
+	if st.demand != nil {
+		reader.release = st.demand()
+	}
+	st.mutex.Lock()
+	reader.needKey = true
+	st.readers[reader] = struct{}{}
+	st.mutex.Unlock()
+}
+
+// removeReader removes a reader and ends its packet queue
+func (st *rtspStream) removeReader(reader *rtspReader) {
+	st.mutex.Lock()
+	_, ok := st.readers[reader]
+	delete(st.readers, reader)
+	st.mutex.Unlock()
+	if !ok {
+		return
+	}
+	close(reader.packets)
+	if reader.release != nil {
+		reader.release()
+	}
+}
+
+// rtspRequest is a parsed RTSP request
+type rtspRequest struct {
+	method string
+	url    string
+	header textproto.MIMEHeader
+}
+
+// rtspResponse is an RTSP response to write
+type rtspResponse struct {
+	status int
+	reason string
+	header [][2]string
+	body   string
+}
+
+// rtspSession is the state of one RTSP connection: a single track, played
+// over the connection (interleaved) or to the client's UDP port
+type rtspSession struct {
+	server      *RTSPServer
+	conn        net.Conn
+	writeMutex  sync.Mutex
+	id          string
+	stream      *rtspStream
+	channel     byte
+	udpAddr     *net.UDPAddr
+	reader      *rtspReader
+	closeOnce   sync.Once
+	remoteIP    net.IP
+	transportOK bool
+}
+
+// serveConn handles the requests of one RTSP connection
+func (s *RTSPServer) serveConn(conn net.Conn) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Panic in RTSP connection: %v", r)
+		}
+	}()
+
+	session := &rtspSession{server: s, conn: conn}
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		session.remoteIP = addr.IP
+	}
+	defer session.close()
+
+	br := bufio.NewReader(conn)
+	tp := textproto.NewReader(br)
+	for {
+		conn.SetReadDeadline(time.Now().Add(rtspTimeout))
+		first, err := br.Peek(1)
+		if err != nil {
+			return
+		}
+		// Interleaved RTCP from the client: skip it, it only keeps us alive
+		if first[0] == '$' {
+			header := make([]byte, 4)
+			if _, err := io.ReadFull(br, header); err != nil {
+				return
+			}
+			if _, err := br.Discard(int(binary.BigEndian.Uint16(header[2:]))); err != nil {
+				return
+			}
+			continue
+		}
+
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		if line == "" {
+			continue
+		}
+		parts := strings.Fields(line)
+		if len(parts) != 3 || !strings.HasPrefix(parts[2], "RTSP/") {
+			return
+		}
+		header, err := tp.ReadMIMEHeader()
+		if err != nil {
+			return
+		}
+		if n, _ := strconv.Atoi(header.Get("Content-Length")); n > 0 {
+			if _, err := br.Discard(n); err != nil {
+				return
+			}
+		}
+
+		req := &rtspRequest{method: parts[0], url: parts[1], header: header}
+		resp := session.handle(req)
+		if err := session.writeResponse(req, resp); err != nil {
+			return
+		}
+		switch {
+		case req.method == "PLAY" && resp.status == 200:
+			session.play()
+		case req.method == "TEARDOWN":
+			return
+		}
+	}
+}
+
+// handle answers a request
+func (c *rtspSession) handle(req *rtspRequest) rtspResponse {
+	switch req.method {
+	case "OPTIONS":
+		return rtspResponse{status: 200, header: [][2]string{{"Public", "OPTIONS, DESCRIBE, SETUP, PLAY, TEARDOWN, GET_PARAMETER"}}}
+	case "GET_PARAMETER", "SET_PARAMETER", "TEARDOWN":
+		return rtspResponse{status: 200}
+	case "DESCRIBE", "SETUP", "PLAY":
+	default:
+		return rtspResponse{status: 501, reason: "Not Implemented"}
+	}
+
+	if !c.server.authorized(req) {
+		return rtspResponse{status: 401, reason: "Unauthorized", header: [][2]string{{"WWW-Authenticate", `Basic realm="worker"`}}}
+	}
+
+	u, err := url.Parse(req.url)
+	if err != nil {
+		return rtspResponse{status: 400, reason: "Bad Request"}
+	}
+	name := strings.Trim(strings.TrimSuffix(strings.TrimSuffix(u.Path, "/"), rtspTrack), "/")
+
+	switch req.method {
+	case "DESCRIBE":
+		st := c.server.stream(name)
+		if st == nil {
+			return rtspResponse{status: 404, reason: "Not Found"}
+		}
+		return rtspResponse{
+			status: 200,
+			header: [][2]string{{"Content-Type", "application/sdp"}, {"Content-Base", strings.TrimSuffix(req.url, "/") + "/"}},
+			body:   st.sdp(),
+		}
+
+	case "SETUP":
+		st := c.server.stream(name)
+		if st == nil {
+			return rtspResponse{status: 404, reason: "Not Found"}
+		}
+		if c.stream != nil && c.stream != st {
+			return rtspResponse{status: 455, reason: "Method Not Valid In This State"}
+		}
+		transport, ok := c.setupTransport(req.header.Get("Transport"))
+		if !ok {
+			return rtspResponse{status: 461, reason: "Unsupported Transport"}
+		}
+		c.stream = st
+		if c.id == "" {
+			b := make([]byte, 8)
+			rand.Read(b)
+			c.id = hex.EncodeToString(b)
+		}
+		return rtspResponse{status: 200, header: [][2]string{
+			{"Transport", transport},
+			{"Session", fmt.Sprintf("%s;timeout=%d", c.id, int(rtspTimeout.Seconds()))},
+		}}
+
+	default: // PLAY
+		if c.stream == nil || !c.transportOK {
+			return rtspResponse{status: 455, reason: "Method Not Valid In This State"}
+		}
+		return rtspResponse{status: 200, header: [][2]string{{"Session", c.id}, {"Range", "npt=0.000-"}}}
+	}
+}
+
+// setupTransport picks interleaved TCP or UDP from the client's Transport
+// header and returns the reply
+func (c *rtspSession) setupTransport(header string) (string, bool) {
+	for _, option := range strings.Split(header, ",") {
+		params := strings.Split(strings.TrimSpace(option), ";")
+		values := make(map[string]string)
+		for _, p := range params[1:] {
+			k, v, _ := strings.Cut(p, "=")
+			values[strings.ToLower(k)] = v
+		}
+		if _, multicast := values["multicast"]; multicast {
+			continue
+		}
+
+		switch strings.ToUpper(params[0]) {
+		case "RTP/AVP/TCP":
+			channel := 0
+			if v, ok := values["interleaved"]; ok {
+				first, _, _ := strings.Cut(v, "-")
+				n, err := strconv.Atoi(first)
+				if err != nil || n < 0 || n > 254 {
+					continue
+				}
+				channel = n
+			}
+			c.channel, c.udpAddr, c.transportOK = byte(channel), nil, true
+			return fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d", channel, channel+1), true
+
+		case "RTP/AVP", "RTP/AVP/UDP":
+			ports, ok := values["client_port"]
+			if c.server.rtp == nil || !ok || c.remoteIP == nil {
+				continue
+			}
+			first, _, _ := strings.Cut(ports, "-")
+			port, err := strconv.Atoi(first)
+			if err != nil || port <= 0 || port > 65535 {
+				continue
+			}
+			c.udpAddr, c.transportOK = &net.UDPAddr{IP: c.remoteIP, Port: port}, true
+			return fmt.Sprintf("RTP/AVP;unicast;client_port=%s;server_port=%d-%d", ports, c.server.config.UDPPort, c.server.config.UDPPort+1), true
+		}
+	}
+	return "", false
+}
+
+// play starts sending the stream to the client
+func (c *rtspSession) play() {
+	if c.reader != nil {
+		return
+	}
+	reader := &rtspReader{
+		packets: make(chan [][]byte, rtspReaderQueue),
+		close:   func() { c.conn.Close() },
+	}
+	c.reader = reader
+	c.stream.addReader(reader)
+	log.Printf("RTSP reader %s playing %s", c.conn.RemoteAddr(), c.stream.name)
+
+	udpAddr := c.udpAddr
+	go func() {
+		for packets := range reader.packets {
+			for _, pkt := range packets {
+				var err error
+				if udpAddr != nil {
+					_, err = c.server.rtp.WriteToUDP(pkt, udpAddr)
+				} else {
+					err = c.writeInterleaved(pkt)
+				}
+				if err != nil {
+					c.conn.Close()
+					// Let the stream drop what's left until the reader is removed
+					for range reader.packets {
+					}
+					return
+				}
+			}
+		}
+	}()
+}
+
+// writeInterleaved sends an RTP packet over the RTSP connection
+func (c *rtspSession) writeInterleaved(pkt []byte) error {
+	frame := make([]byte, 4+len(pkt))
+	frame[0] = '$'
+	frame[1] = c.channel
+	binary.BigEndian.PutUint16(frame[2:], uint16(len(pkt)))
+	copy(frame[4:], pkt)
+
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+// writeResponse sends a response with the request's CSeq
+func (c *rtspSession) writeResponse(req *rtspRequest, resp rtspResponse) error {
+	if resp.reason == "" {
+		resp.reason = "OK"
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "RTSP/1.0 %d %s\r\n", resp.status, resp.reason)
+	fmt.Fprintf(&b, "CSeq: %s\r\n", req.header.Get("CSeq"))
+	b.WriteString("Server: face-detection-worker\r\n")
+	for _, h := range resp.header {
+		fmt.Fprintf(&b, "%s: %s\r\n", h[0], h[1])
+	}
+	if resp.body != "" {
+		fmt.Fprintf(&b, "Content-Length: %d\r\n", len(resp.body))
+	}
+	b.WriteString("\r\n")
+	b.WriteString(resp.body)
+
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	_, err := io.WriteString(c.conn, b.String())
+	return err
+}
+
+// close ends the session and removes its reader
+func (c *rtspSession) close() {
+	c.closeOnce.Do(func() {
+		c.conn.Close()
+		if c.reader != nil {
+			c.stream.removeReader(c.reader)
+			log.Printf("RTSP reader %s stopped playing %s", c.conn.RemoteAddr(), c.stream.name)
+		}
+	})
+}
+
+// authorized checks the Basic credentials of a request when read
+// credentials are configured
+func (s *RTSPServer) authorized(req *rtspRequest) bool {
+	if s.config.ReadUser == "" {
+		return true
+	}
+	auth := req.header.Get("Authorization")
+	encoded, ok := strings.CutPrefix(auth, "Basic ")
+	if !ok {
+		return false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return false
+	}
+	user, pass, _ := strings.Cut(string(decoded), ":")
+	userOK := subtle.ConstantTimeCompare([]byte(user), []byte(s.config.ReadUser)) == 1
+	passOK := subtle.ConstantTimeCompare([]byte(pass), []byte(s.config.ReadPass)) == 1
+	return userOK && passOK
+}
+
+// rtspStatus returns the embedded RTSP paths of a stream and its total number
+// of readers
+func (sm *StreamManager) rtspStatus(stream *CameraStream) ([]RTSPStreamStatus, int) {
+	var paths []RTSPStreamStatus
+	readers := 0
+	for _, p := range []*Publisher{stream.publisher, stream.rawPublisher} {
+		if p == nil || p.rtsp == nil {
+			continue
+		}
+		status := sm.rtsp.Status(embeddedPath(p.outputs))
+		paths = append(paths, status)
+		readers += status.Readers
+	}
+	return paths, readers
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+	"testing/iotest"
+)
+
+func TestSplitAnnexB(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []byte
+		want [][]byte
+	}{
+		{
+			"three byte start codes",
+			[]byte{0, 0, 1, 0x67, 1, 2, 0, 0, 1, 0x68, 3, 0, 0, 1, 0x65, 4, 5},
+			[][]byte{{0x67, 1, 2}, {0x68, 3}, {0x65, 4, 5}},
+		},
+		{
+			"four byte start codes",
+			[]byte{0, 0, 0, 1, 0x09, 0xf0, 0, 0, 0, 1, 0x41, 6, 7},
+			[][]byte{{0x09, 0xf0}, {0x41, 6, 7}},
+		},
+		{
+			"leading garbage",
+			[]byte{0xff, 0xee, 0, 0, 1, 0x41, 8},
+			[][]byte{{0x41, 8}},
+		},
+		{
+			"no start code",
+			[]byte{1, 2, 3},
+			nil,
+		},
+	}
+	for _, tt := range tests {
+		// One byte at a time exercises the requests for more data
+		scanner := bufio.NewScanner(iotest.OneByteReader(bytes.NewReader(tt.in)))
+		scanner.Split(splitAnnexB)
+		var got [][]byte
+		for scanner.Scan() {
+			got = append(got, append([]byte(nil), scanner.Bytes()...))
+		}
+		if err := scanner.Err(); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %x, want %x", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPacketize(t *testing.T) {
+	small := []byte{0x67, 1, 2, 3}
+	large := make([]byte, 2*rtpMaxPayload+100)
+	large[0] = 0x65
+	for i := 1; i < len(large); i++ {
+		large[i] = byte(i)
+	}
+
+	st := &rtspStream{ssrc: 0x01020304, seq: 65535}
+	packets := st.packetize([][]byte{small, large}, 9000)
+
+	if len(packets) != 4 {
+		t.Fatalf("got %d packets, want 4", len(packets))
+	}
+	for i, pkt := range packets {
+		if pkt[0] != 0x80 {
+			t.Errorf("packet %d: version byte %#x", i, pkt[0])
+		}
+		marker := pkt[1]&0x80 != 0
+		if marker != (i == len(packets)-1) {
+			t.Errorf("packet %d: marker %v", i, marker)
+		}
+		if pt := pkt[1] & 0x7f; pt != rtpPayloadType {
+			t.Errorf("packet %d: payload type %d", i, pt)
+		}
+		// The sequence number wraps
+		if seq := binary.BigEndian.Uint16(pkt[2:]); seq != uint16(65535+i) {
+			t.Errorf("packet %d: sequence %d", i, seq)
+		}
+		if ts := binary.BigEndian.Uint32(pkt[4:]); ts != 9000 {
+			t.Errorf("packet %d: timestamp %d", i, ts)
+		}
+		if ssrc := binary.BigEndian.Uint32(pkt[8:]); ssrc != 0x01020304 {
+			t.Errorf("packet %d: ssrc %#x", i, ssrc)
+		}
+		if len(pkt)-12 > rtpMaxPayload {
+			t.Errorf("packet %d: payload of %d bytes", i, len(pkt)-12)
+		}
+	}
+
+	// Single NAL unit packet
+	if !bytes.Equal(packets[0][12:], small) {
+		t.Errorf("single NAL unit payload %x, want %x", packets[0][12:], small)
+	}
+
+	// FU-A: indicator keeps NRI with type 28, header carries S/E and the type
+	wantHeaders := []byte{0x85, 0x05, 0x45}
+	var reassembled []byte
+	for i, pkt := range packets[1:] {
+		payload := pkt[12:]
+		if payload[0] != 0x60|28 {
+			t.Errorf("fragment %d: indicator %#x", i, payload[0])
+		}
+		if payload[1] != wantHeaders[i] {
+			t.Errorf("fragment %d: header %#x, want %#x", i, payload[1], wantHeaders[i])
+		}
+		reassembled = append(reassembled, payload[2:]...)
+	}
+	if !bytes.Equal(reassembled, large[1:]) {
+		t.Errorf("reassembled fragments differ from the NAL unit")
+	}
+}
+
+func TestValidateRTSPServer(t *testing.T) {
+	enabled := RTSPServerConfig{Enabled: true}
+	withCreds := RTSPServerConfig{Enabled: true, ReadUser: "viewer", ReadPass: "pass"}
+	tests := []struct {
+		name   string
+		config Config
+		ok     bool
+	}{
+		{"open worker", Config{RTSPServer: enabled}, true},
+		{"disabled", Config{BackendAuth: BackendAuthConfig{JWTSecret: "s"}}, true},
+		{"protected with credentials", Config{RTSPServer: withCreds, Storage: StorageConfig{Encryption: EncryptionConfig{AccessToken: "t"}}}, true},
+		// The frames would be open over RTSP while HTTP needs a token
+		{"protected without credentials", Config{RTSPServer: enabled, Storage: StorageConfig{Encryption: EncryptionConfig{AccessToken: "t"}}}, false},
+		{"jwt secret without credentials", Config{RTSPServer: enabled, BackendAuth: BackendAuthConfig{JWTSecret: "s"}}, false},
+		{"user without password", Config{RTSPServer: RTSPServerConfig{Enabled: true, ReadUser: "viewer"}, BackendAuth: BackendAuthConfig{JWTSecret: "s"}}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.config.validateRTSPServer(); (err == nil) != tt.ok {
+			t.Errorf("%s: validateRTSPServer() error = %v, want ok=%v", tt.name, err, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,512 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"log"
+	"mime"
+	"path"
+	"strings"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+// Snapshot formats
+const (
+	SnapshotJPEG = "jpeg"
+	SnapshotPNG  = "png"
+	SnapshotWebP = "webp"
+)
+
+// Snapshot variants: the frame with the detection overlay drawn on it, the
+// untouched frame, or both
+const (
+	VariantAnnotated = "annotated"
+	VariantClean     = "clean"
+	VariantBoth      = "both"
+)
+
+// SnapshotConfig controls how snapshots are encoded
+type SnapshotConfig struct {
+	Format    string          `yaml:"format"`
+	Variant   string          `yaml:"variant"`
+	Quality   int             `yaml:"quality"`
+	MaxWidth  int             `yaml:"max_width"`
+	MaxHeight int             `yaml:"max_height"`
+	Thumbnail ThumbnailConfig `yaml:"thumbnail"`
+	FaceCrops FaceCropConfig  `yaml:"face_crops"`
+	Workers   int             `yaml:"workers"`
+	QueueSize int             `yaml:"queue_size"`
+}
+
+// ThumbnailConfig controls the optional small JPEG saved next to each snapshot
+type ThumbnailConfig struct {
+	Enabled bool `yaml:"enabled"`
+	Width   int  `yaml:"width"`
+	Quality int  `yaml:"quality"`
+}
+
+// FaceCropConfig controls the padded JPEG crops saved for each detected face
+type FaceCropConfig struct {
+	Enabled  bool    `yaml:"enabled"`
+	Padding  float64 `yaml:"padding"`
+	MaxFaces int     `yaml:"max_faces"`
+	Quality  int     `yaml:"quality"`
+}
+
+// FaceBox is a face bounding box in frame pixels
+type FaceBox struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// faceBox converts a detection rectangle to a FaceBox
+func faceBox(r image.Rectangle) FaceBox {
+	return FaceBox{X: r.Min.X, Y: r.Min.Y, Width: r.Dx(), Height: r.Dy()}
+}
+
+// FaceCrop is the stored crop of one detected face
+type FaceCrop struct {
+	URL string  `json:"url"`
+	Box FaceBox `json:"box"`
+	key string
+}
+
+// extension returns the file extension for the configured format
+func (c SnapshotConfig) extension() string {
+	switch c.Format {
+	case SnapshotPNG:
+		return ".png"
+	case SnapshotWebP:
+		return ".webp"
+	default:
+		return ".jpg"
+	}
+}
+
+// encodeParams returns the gocv encoder parameters for the configured format
+func (c SnapshotConfig) encodeParams() []int {
+	switch c.Format {
+	case SnapshotPNG:
+		return []int{gocv.IMWritePngCompression, 3}
+	case SnapshotWebP:
+		return []int{gocv.IMWriteWebpQuality, c.Quality}
+	default:
+		return []int{gocv.IMWriteJpegQuality, c.Quality}
+	}
+}
+
+// needsClean reports whether snapshots need the frame before overlays are
+// drawn, for a clean variant or for face crops
+func (c SnapshotConfig) needsClean() bool {
+	return c.Variant == VariantClean || c.Variant == VariantBoth || c.FaceCrops.Enabled
+}
+
+// validate checks the format and fills in defaults
+func (c *SnapshotConfig) validate() error {
+	switch c.Format {
+	case "", "jpg":
+		c.Format = SnapshotJPEG
+	case SnapshotJPEG, SnapshotPNG, SnapshotWebP:
+	default:
+		return fmt.Errorf("unknown snapshot format %q (expected jpeg, png or webp)", c.Format)
+	}
+	switch c.Variant {
+	case "":
+		c.Variant = VariantAnnotated
+	case VariantAnnotated, VariantClean, VariantBoth:
+	default:
+		return fmt.Errorf("unknown snapshot variant %q (expected annotated, clean or both)", c.Variant)
+	}
+	if c.Quality <= 0 || c.Quality > 100 {
+		c.Quality = 90
+	}
+	if c.Thumbnail.Width <= 0 {
+		c.Thumbnail.Width = 320
+	}
+	if c.Thumbnail.Quality <= 0 || c.Thumbnail.Quality > 100 {
+		c.Thumbnail.Quality = 75
+	}
+	if c.FaceCrops.Padding <= 0 {
+		c.FaceCrops.Padding = 0.3
+	}
+	if c.FaceCrops.MaxFaces <= 0 {
+		c.FaceCrops.MaxFaces = 10
+	}
+	if c.FaceCrops.Quality <= 0 || c.FaceCrops.Quality > 100 {
+		c.FaceCrops.Quality = 85
+	}
+	if c.Workers <= 0 {
+		c.Workers = 2
+	}
+	if c.QueueSize <= 0 {
+		c.QueueSize = 32
+	}
+	return nil
+}
+
+// Snapshot is a snapshot whose key and URLs are known up front while the
+// image is encoded and stored in the background. Key holds the clean frame
+// when the variant is clean or both; AnnotatedKey is only set for both.
+type Snapshot struct {
+	Key          string
+	URL          string
+	AnnotatedKey string
+	AnnotatedURL string
+	ThumbnailKey string
+	ThumbnailURL string
+	FaceCrops    []FaceCrop
+	info         SnapshotInfo
+	img          gocv.Mat
+	annotated    gocv.Mat
+	cropFrame    *gocv.Mat // clean frame for the crops when img is annotated
+	done         chan struct{}
+	err          error
+}
+
+// Wait blocks until the snapshot has been stored and returns the write error, if any
+func (s *Snapshot) Wait() error {
+	<-s.done
+	return s.err
+}
+
+// ContentType returns the MIME type of the snapshot image
+func (s *Snapshot) ContentType() string {
+	if t := mime.TypeByExtension(path.Ext(s.Key)); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+// createSnapshot copies the frame and queues it for encoding, together with a
+// crop of each face when enabled and a JSON sidecar. img is the annotated
+// frame and clean the frame before overlays were drawn (nil unless the
+// variant or face crops need it). It returns as soon as the frame is queued so a slow disk or
+// bucket never stalls capture.
+func (sm *StreamManager) createSnapshot(stream *CameraStream, img, clean *gocv.Mat, faces []image.Rectangle, alertID, rule string) (snap *Snapshot, err error) {
+	cameraID := stream.Camera.ID
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Panic in createSnapshot for camera %s: %v", cameraID, r)
+			snap, err = nil, fmt.Errorf("panic while creating snapshot: %v", r)
+		}
+	}()
+
+	if img == nil || img.Empty() {
+		return nil, fmt.Errorf("image is nil or empty")
+	}
+
+	cfg := sm.config.Snapshots
+	primary := img
+	if cfg.needsClean() {
+		if clean == nil || clean.Empty() {
+			return nil, fmt.Errorf("clean frame is nil or empty")
+		}
+		if cfg.Variant != VariantAnnotated {
+			primary = clean
+		}
+	}
+	capturedAt := time.Now()
+	base := newSnapshotBase(cameraID, capturedAt)
+
+	snap = &Snapshot{
+		Key:  base + cfg.extension(),
+		done: make(chan struct{}),
+	}
+	url, err := sm.store.URL(snap.Key)
+	if err != nil {
+		return nil, err
+	}
+	snap.URL = url
+
+	if cfg.Variant == VariantBoth {
+		snap.AnnotatedKey = base + "_annotated" + cfg.extension()
+		if snap.AnnotatedURL, err = sm.store.URL(snap.AnnotatedKey); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.Thumbnail.Enabled {
+		snap.ThumbnailKey = base + "_thumb.jpg"
+		if snap.ThumbnailURL, err = sm.store.URL(snap.ThumbnailKey); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.FaceCrops.Enabled {
+		bounds := image.Rect(0, 0, img.Cols(), img.Rows())
+		for i, face := range faces {
+			if i >= cfg.FaceCrops.MaxFaces {
+				break
+			}
+			crop := FaceCrop{
+				Box: faceBox(face.Intersect(bounds)),
+				key: fmt.Sprintf("%s_face%d.jpg", base, i+1),
+			}
+			if crop.URL, err = sm.store.URL(crop.key); err != nil {
+				return nil, err
+			}
+			snap.FaceCrops = append(snap.FaceCrops, crop)
+		}
+	}
+
+	snap.info = SnapshotInfo{
+		Key:          snap.Key,
+		CameraID:     cameraID,
+		CameraName:   stream.Camera.Name,
+		CapturedAt:   capturedAt.UTC(),
+		AlertID:      alertID,
+		Rule:         rule,
+		Detector:     "haar:" + path.Base(sm.config.FaceCascade),
+		Format:       cfg.Format,
+		Variant:      cfg.Variant,
+		AnnotatedKey: snap.AnnotatedKey,
+		Width:        img.Cols(),
+		Height:       img.Rows(),
+		Boxes:        make([]FaceBox, 0, len(faces)),
+		ThumbnailKey: snap.ThumbnailKey,
+	}
+	for _, face := range faces {
+		snap.info.Boxes = append(snap.info.Boxes, faceBox(face))
+	}
+	for _, crop := range snap.FaceCrops {
+		snap.info.FaceCropKeys = append(snap.info.FaceCropKeys, crop.key)
+	}
+
+	snap.img = primary.Clone()
+	if snap.AnnotatedKey != "" {
+		snap.annotated = img.Clone()
+	}
+	// Crops never show the boxes or overlays drawn on the annotated frame
+	if len(snap.FaceCrops) > 0 && primary != clean {
+		cropFrame := clean.Clone()
+		snap.cropFrame = &cropFrame
+	}
+	select {
+	case sm.snapshotQueue <- snap:
+	default:
+		snap.close()
+		return nil, fmt.Errorf("snapshot queue full, dropping snapshot for camera %s", cameraID)
+	}
+
+	return snap, nil
+}
+
+// close releases the frames held by a snapshot
+func (s *Snapshot) close() {
+	s.img.Close()
+	if s.AnnotatedKey != "" {
+		s.annotated.Close()
+	}
+	if s.cropFrame != nil {
+		s.cropFrame.Close()
+	}
+}
+
+// runSnapshotWriter encodes and stores queued snapshots
+func (sm *StreamManager) runSnapshotWriter() {
+	for snap := range sm.snapshotQueue {
+		snap.err = sm.writeSnapshot(snap)
+		if snap.err != nil {
+			log.Printf("Failed to write snapshot %s: %v", snap.Key, snap.err)
+		}
+		snap.close()
+		close(snap.done)
+	}
+}
+
+// writeSnapshot scales the frame down if needed, encodes it once and stores
+// the encoded buffer as is
+func (sm *StreamManager) writeSnapshot(snap *Snapshot) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic while writing snapshot: %v", r)
+		}
+	}()
+
+	// Crops are cut from the full-resolution frame
+	if len(snap.FaceCrops) > 0 {
+		if err := sm.writeFaceCrops(snap); err != nil {
+			log.Printf("Failed to write face crops for %s: %v", snap.Key, err)
+		}
+	}
+
+	img, err := sm.saveSnapshotImage(snap.Key, snap.img, snap.ContentType())
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+
+	if snap.AnnotatedKey != "" {
+		if annotated, err := sm.saveSnapshotImage(snap.AnnotatedKey, snap.annotated, snap.ContentType()); err != nil {
+			log.Printf("Failed to write annotated snapshot %s: %v", snap.AnnotatedKey, err)
+		} else {
+			annotated.Close()
+		}
+	}
+
+	if snap.ThumbnailKey != "" {
+		if err := sm.writeThumbnail(snap, img); err != nil {
+			// The full snapshot is stored, so only log thumbnail failures
+			log.Printf("Failed to write thumbnail %s: %v", snap.ThumbnailKey, err)
+		}
+	}
+
+	if err := sm.writeSidecar(snap.info); err != nil {
+		log.Printf("Failed to write sidecar for %s: %v", snap.Key, err)
+	}
+
+	return nil
+}
+
+// saveSnapshotImage scales img down to the configured limits, encodes it once
+// and stores the encoded buffer under key. It returns the scaled image, which
+// the caller must close.
+func (sm *StreamManager) saveSnapshotImage(key string, img gocv.Mat, contentType string) (gocv.Mat, error) {
+	cfg := sm.config.Snapshots
+
+	scaled := gocv.NewMat()
+	if size, ok := fitWithin(img.Cols(), img.Rows(), cfg.MaxWidth, cfg.MaxHeight); ok {
+		if err := gocv.Resize(img, &scaled, size, 0, 0, gocv.InterpolationArea); err != nil {
+			scaled.Close()
+			return scaled, fmt.Errorf("failed to resize snapshot: %v", err)
+		}
+	} else {
+		img.CopyTo(&scaled)
+	}
+
+	buf, err := gocv.IMEncodeWithParams(gocv.FileExt(cfg.extension()), scaled, cfg.encodeParams())
+	if err != nil {
+		scaled.Close()
+		return scaled, fmt.Errorf("failed to encode %s snapshot: %v", cfg.Format, err)
+	}
+	defer buf.Close()
+
+	if _, err := sm.store.Save(key, buf.GetBytes(), contentType); err != nil {
+		scaled.Close()
+		return scaled, err
+	}
+	return scaled, nil
+}
+
+// writeThumbnail stores a small JPEG of the snapshot
+func (sm *StreamManager) writeThumbnail(snap *Snapshot, img gocv.Mat) error {
+	cfg := sm.config.Snapshots.Thumbnail
+
+	size, ok := fitWithin(img.Cols(), img.Rows(), cfg.Width, 0)
+	thumb := img
+	if ok {
+		scaled := gocv.NewMat()
+		defer scaled.Close()
+		if err := gocv.Resize(img, &scaled, size, 0, 0, gocv.InterpolationArea); err != nil {
+			return fmt.Errorf("failed to resize thumbnail: %v", err)
+		}
+		thumb = scaled
+	}
+
+	buf, err := gocv.IMEncodeWithParams(gocv.JPEGFileExt, thumb, []int{gocv.IMWriteJpegQuality, cfg.Quality})
+	if err != nil {
+		return fmt.Errorf("failed to encode thumbnail: %v", err)
+	}
+	defer buf.Close()
+
+	_, err = sm.store.Save(snap.ThumbnailKey, buf.GetBytes(), "image/jpeg")
+	return err
+}
+
+// writeFaceCrops stores a padded JPEG crop around each face box, cut from the
+// clean frame
+func (sm *StreamManager) writeFaceCrops(snap *Snapshot) error {
+	cfg := sm.config.Snapshots.FaceCrops
+	frame := &snap.img
+	if snap.cropFrame != nil {
+		frame = snap.cropFrame
+	}
+	bounds := image.Rect(0, 0, frame.Cols(), frame.Rows())
+
+	for _, crop := range snap.FaceCrops {
+		rect := padRect(crop.Box, cfg.Padding).Intersect(bounds)
+		if rect.Empty() {
+			continue
+		}
+
+		region := frame.Region(rect)
+		buf, err := gocv.IMEncodeWithParams(gocv.JPEGFileExt, region, []int{gocv.IMWriteJpegQuality, cfg.Quality})
+		region.Close()
+		if err != nil {
+			return fmt.Errorf("failed to encode face crop: %v", err)
+		}
+		_, err = sm.store.Save(crop.key, buf.GetBytes(), "image/jpeg")
+		buf.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// padRect grows a face box by padding times its size on every side
+func padRect(box FaceBox, padding float64) image.Rectangle {
+	dx := int(float64(box.Width) * padding)
+	dy := int(float64(box.Height) * padding)
+	return image.Rect(box.X-dx, box.Y-dy, box.X+box.Width+dx, box.Y+box.Height+dy)
+}
+
+// fitWithin returns the size that fits width x height inside maxWidth x
+// maxHeight (0 means unbounded) keeping the aspect ratio. ok is false when
+// no scaling is needed.
+func fitWithin(width, height, maxWidth, maxHeight int) (image.Point, bool) {
+	if width <= 0 || height <= 0 {
+		return image.Point{}, false
+	}
+
+	scale := 1.0
+	if maxWidth > 0 && width > maxWidth {
+		scale = float64(maxWidth) / float64(width)
+	}
+	if maxHeight > 0 && float64(height)*scale > float64(maxHeight) {
+		scale = float64(maxHeight) / float64(height)
+	}
+	if scale >= 1.0 {
+		return image.Point{}, false
+	}
+
+	w := int(float64(width) * scale)
+	h := int(float64(height) * scale)
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	return image.Pt(w, h), true
+}
+
+// snapshotBase returns the part of a key shared by a snapshot and its related
+// files: the key without extension or variant suffix
+func snapshotBase(key string) string {
+	stem := strings.TrimSuffix(key, path.Ext(key))
+	if i := strings.LastIndex(stem, "_"); i > 0 {
+		suffix := stem[i+1:]
+		if suffix == "thumb" || suffix == "annotated" || suffix == "alert" || (strings.HasPrefix(suffix, "face") && isDigits(suffix[len("face"):])) {
+			return stem[:i]
+		}
+	}
+	return stem
+}
+
+// isDigits reports whether s is a non-empty string of ASCII digits
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"image"
+	"testing"
+)
+
+func TestFitWithin(t *testing.T) {
+	tests := []struct {
+		width, height, maxWidth, maxHeight int
+		want                               image.Point
+		ok                                 bool
+	}{
+		{1920, 1080, 1280, 0, image.Pt(1280, 720), true},
+		{1920, 1080, 0, 540, image.Pt(960, 540), true},
+		{1920, 1080, 1280, 360, image.Pt(640, 360), true},
+		{1080, 1920, 1280, 1280, image.Pt(720, 1280), true},
+		{640, 480, 1280, 720, image.Point{}, false},
+		{1920, 1080, 0, 0, image.Point{}, false},
+		{1920, 1080, 1920, 1080, image.Point{}, false},
+		{4000, 2, 100, 0, image.Pt(100, 1), true},
+		{0, 1080, 1280, 0, image.Point{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := fitWithin(tt.width, tt.height, tt.maxWidth, tt.maxHeight)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("fitWithin(%d, %d, %d, %d) = %v, %v; want %v, %v", tt.width, tt.height, tt.maxWidth, tt.maxHeight, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestSnapshotBase(t *testing.T) {
+	tests := []struct {
+		key, want string
+	}{
+		{"cam-1/2024-05-01/143000_ab12.jpg", "cam-1/2024-05-01/143000_ab12"},
+		{"cam-1/2024-05-01/143000_ab12_annotated.jpg", "cam-1/2024-05-01/143000_ab12"},
+		{"cam-1/2024-05-01/143000_ab12_thumb.webp", "cam-1/2024-05-01/143000_ab12"},
+		{"cam-1/2024-05-01/143000_ab12_face0.jpg", "cam-1/2024-05-01/143000_ab12"},
+		{"cam-1/2024-05-01/143000_ab12_face12.jpg", "cam-1/2024-05-01/143000_ab12"},
+		{"cam-1/2024-05-01/143000_ab12_alert.json", "cam-1/2024-05-01/143000_ab12"},
+		{"cam-1/2024-05-01/143000_ab12.json", "cam-1/2024-05-01/143000_ab12"},
+		{"cam-1/2024-05-01/143000_ab12.mp4", "cam-1/2024-05-01/143000_ab12"},
+		// Only known suffixes are variants
+		{"cam-1/2024-05-01/143000_faceless.jpg", "cam-1/2024-05-01/143000_faceless"},
+		{"cam_1/snapshot.jpg", "cam_1/snapshot"},
+	}
+	for _, tt := range tests {
+		if got := snapshotBase(tt.key); got != tt.want {
+			t.Errorf("snapshotBase(%q) = %q, want %q", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestSnapshotVariant(t *testing.T) {
+	tests := []struct {
+		variant string
+		crops   bool
+		want    string
+		clean   bool
+		ok      bool
+	}{
+		{"", false, VariantAnnotated, false, true},
+		{VariantAnnotated, false, VariantAnnotated, false, true},
+		{VariantClean, false, VariantClean, true, true},
+		{VariantBoth, false, VariantBoth, true, true},
+		// Face crops are cut from the clean frame
+		{VariantAnnotated, true, VariantAnnotated, true, true},
+		{"raw", false, "", false, false},
+	}
+	for _, tt := range tests {
+		c := SnapshotConfig{Variant: tt.variant, FaceCrops: FaceCropConfig{Enabled: tt.crops}}
+		if err := c.validate(); (err == nil) != tt.ok {
+			t.Errorf("validate(%q) error = %v, want ok=%v", tt.variant, err, tt.ok)
+			continue
+		}
+		if !tt.ok {
+			continue
+		}
+		if c.Variant != tt.want || c.needsClean() != tt.clean {
+			t.Errorf("validate(%q) = %q, needsClean %v; want %q, %v", tt.variant, c.Variant, c.needsClean(), tt.want, tt.clean)
+		}
+	}
+}
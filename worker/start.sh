@@ -43,7 +43,7 @@ go mod tidy
 
 # Build the worker service
 echo "Building worker service..."
-go build -o face-detection-worker main.go
+go build -o face-detection-worker .
 
 # Start the worker service
 echo "Starting worker service..."
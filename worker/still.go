@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gocv.io/x/gocv"
+)
+
+// Frame variants served by /stream/:id/frame.jpg
+const (
+	FrameRaw       = "raw"
+	FrameAnnotated = "annotated"
+)
+
+const (
+	// stillKeepAlive is how long frames are kept after the last request, so
+	// an idle camera doesn't copy frames nobody asks for
+	stillKeepAlive = 30 * time.Second
+	// stillMaxAge is the age after which a request waits for a new frame
+	stillMaxAge = time.Second
+	stillWait   = 2 * time.Second
+)
+
+// stillFrame is the latest copy of one frame variant
+type stillFrame struct {
+	mat    gocv.Mat
+	at     time.Time
+	wanted time.Time
+}
+
+// LatestFrames keeps the most recent raw and annotated frame of a stream while
+// someone is asking for them
+type LatestFrames struct {
+	mutex  sync.Mutex
+	frames map[string]*stillFrame
+	notify chan struct{}
+	closed bool
+}
+
+// NewLatestFrames creates an empty frame holder
+func NewLatestFrames() *LatestFrames {
+	return &LatestFrames{
+		frames: map[string]*stillFrame{
+			FrameRaw:       {mat: gocv.NewMat()},
+			FrameAnnotated: {mat: gocv.NewMat()},
+		},
+		notify: make(chan struct{}),
+	}
+}
+
+// Capture copies a frame variant if it was requested recently
+func (l *LatestFrames) Capture(variant string, img *gocv.Mat) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	frame := l.frames[variant]
+	if l.closed || time.Since(frame.wanted) > stillKeepAlive {
+		return
+	}
+	img.CopyTo(&frame.mat)
+	frame.at = time.Now()
+
+	// Wake requests waiting for a fresh frame
+	close(l.notify)
+	l.notify = make(chan struct{})
+}
+
+// Get returns a copy of the latest frame of a variant and its time. A frame
+// older than stillMaxAge is replaced by the next one if it arrives in time.
+func (l *LatestFrames) Get(variant string) (gocv.Mat, time.Time, bool) {
+	deadline := time.After(stillWait)
+	for {
+		l.mutex.Lock()
+		if l.closed {
+			l.mutex.Unlock()
+			return gocv.Mat{}, time.Time{}, false
+		}
+		frame := l.frames[variant]
+		frame.wanted = time.Now()
+		if !frame.mat.Empty() && time.Since(frame.at) <= stillMaxAge {
+			mat, at := frame.mat.Clone(), frame.at
+			l.mutex.Unlock()
+			return mat, at, true
+		}
+		notify := l.notify
+		l.mutex.Unlock()
+
+		select {
+		case <-notify:
+		case <-deadline:
+			// Serve a stale frame rather than nothing, e.g. a camera that stalled
+			l.mutex.Lock()
+			defer l.mutex.Unlock()
+			if l.closed || frame.mat.Empty() {
+				return gocv.Mat{}, time.Time{}, false
+			}
+			return frame.mat.Clone(), frame.at, true
+		}
+	}
+}
+
+// Close frees the frames when the stream stops
+func (l *LatestFrames) Close() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.closed {
+		return
+	}
+	l.closed = true
+	for _, frame := range l.frames {
+		frame.mat.Close()
+	}
+	close(l.notify)
+}
+
+// handleLatestFrame returns the most recent frame of a stream as a JPEG:
+// GET /stream/:id/frame.jpg?variant=raw|annotated&width=&quality=
+func (sm *StreamManager) handleLatestFrame(c *gin.Context) {
+	cameraID := c.Param("id")
+
+	variant := c.DefaultQuery("variant", FrameAnnotated)
+	if variant != FrameRaw && variant != FrameAnnotated {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("variant must be %s or %s", FrameRaw, FrameAnnotated)})
+		return
+	}
+	width := 0
+	if v := c.Query("width"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "width must be a positive number"})
+			return
+		}
+		width = n
+	}
+	quality := 85
+	if v := c.Query("quality"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 100 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "quality must be between 1 and 100"})
+			return
+		}
+		quality = n
+	}
+
+	sm.streamMutex.RLock()
+	stream, exists := sm.streams[cameraID]
+	sm.streamMutex.RUnlock()
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("stream for camera %s not found", cameraID)})
+		return
+	}
+
+	img, at, ok := stream.stills.Get(variant)
+	if !ok {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "no frame available yet"})
+		return
+	}
+	defer img.Close()
+
+	out := img
+	if size, ok := fitWithin(img.Cols(), img.Rows(), width, 0); ok {
+		resized := gocv.NewMat()
+		defer resized.Close()
+		gocv.Resize(img, &resized, size, 0, 0, gocv.InterpolationArea)
+		out = resized
+	}
+
+	buf, err := gocv.IMEncodeWithParams(gocv.JPEGFileExt, out, []int{gocv.IMWriteJpegQuality, quality})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("failed to encode frame: %v", err)})
+		return
+	}
+	defer buf.Close()
+
+	c.Header("Cache-Control", "no-store")
+	c.Header("X-Frame-Time", at.UTC().Format(time.RFC3339Nano))
+	c.Data(http.StatusOK, "image/jpeg", buf.GetBytes())
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// Storage backends
+const (
+	StorageLocal = "local"
+	StorageS3    = "s3"
+)
+
+// StorageConfig selects where snapshots and clips are stored
+type StorageConfig struct {
+	Backend    string           `yaml:"backend"`
+	PublicURL  string           `yaml:"public_url"`
+	S3         S3Config         `yaml:"s3"`
+	Encryption EncryptionConfig `yaml:"encryption"`
+}
+
+// S3Config configures an S3-compatible bucket (AWS S3, MinIO, ...)
+type S3Config struct {
+	Endpoint       string `yaml:"endpoint"`
+	Region         string `yaml:"region"`
+	Bucket         string `yaml:"bucket"`
+	Prefix         string `yaml:"prefix"`
+	AccessKey      string `yaml:"access_key"`
+	SecretKey      string `yaml:"secret_key"`
+	UseSSL         bool   `yaml:"use_ssl"`
+	PublicURL      string `yaml:"public_url"`
+	PresignSeconds int    `yaml:"presign_seconds"`
+	CreateBucket   bool   `yaml:"create_bucket"`
+}
+
+// SnapshotStore stores snapshot images and clips under slash-separated keys
+// and hands out URLs that alerts can carry
+type SnapshotStore interface {
+	// Save stores data under key and returns its URL
+	Save(key string, data []byte, contentType string) (string, error)
+	// SaveFile moves a local file (e.g. an encoded clip) into the store and returns its URL
+	SaveFile(key string, localPath string, contentType string) (string, error)
+	// Load returns the data stored under key, or an error matching
+	// fs.ErrNotExist when there is none
+	Load(key string) ([]byte, error)
+	// Delete removes key from the store
+	Delete(key string) error
+	// URL returns the URL for key
+	URL(key string) (string, error)
+	// List returns every stored object whose key starts with prefix
+	List(prefix string) ([]StoredObject, error)
+}
+
+// StoredObject describes one object in a SnapshotStore
+type StoredObject struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// validate checks the public URLs. public_url is the address other services
+// use to reach the worker; when empty it is derived from the worker port so
+// stored media never gets a relative URL.
+func (c *StorageConfig) validate(workerPort int) error {
+	if c.PublicURL == "" {
+		c.PublicURL = fmt.Sprintf("http://localhost:%d", workerPort)
+		log.Printf("storage.public_url is not set, using %s; set it to the worker's address as seen by the backend and browsers", c.PublicURL)
+	}
+	if err := checkPublicURL(c.PublicURL); err != nil {
+		return fmt.Errorf("storage.public_url: %v", err)
+	}
+	if c.S3.PublicURL != "" {
+		if err := checkPublicURL(c.S3.PublicURL); err != nil {
+			return fmt.Errorf("storage.s3.public_url: %v", err)
+		}
+	}
+	return nil
+}
+
+// checkPublicURL requires an absolute http(s) URL
+func checkPublicURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("invalid URL %q: %v", raw, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%q is not an absolute http(s) URL", raw)
+	}
+	return nil
+}
+
+// NewSnapshotStore creates the store selected in the configuration, wrapped
+// in an EncryptedStore when encryption is enabled
+func NewSnapshotStore(config Config) (SnapshotStore, error) {
+	var (
+		store SnapshotStore
+		err   error
+	)
+	switch config.Storage.Backend {
+	case "", StorageLocal:
+		store, err = NewLocalStore(config.StoragePath, config.Storage.PublicURL)
+	case StorageS3:
+		store, err = NewS3Store(config.Storage.S3)
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", config.Storage.Backend)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if config.Storage.Encryption.Enabled {
+		return NewEncryptedStore(store, config.Storage.Encryption, config.Storage.PublicURL)
+	}
+	return store, nil
+}
+
+// LocalStore keeps files under a directory served by the worker at /snapshots
+type LocalStore struct {
+	root      string
+	publicURL string
+}
+
+// NewLocalStore creates a store rooted at root. publicURL, the worker's
+// absolute base URL, is prefixed to the /snapshots/<key> path.
+func NewLocalStore(root, publicURL string) (*LocalStore, error) {
+	if err := checkPublicURL(publicURL); err != nil {
+		return nil, fmt.Errorf("local storage needs a public URL: %v", err)
+	}
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create storage directory %s: %v", root, err)
+	}
+	return &LocalStore{root: root, publicURL: strings.TrimSuffix(publicURL, "/")}, nil
+}
+
+// path returns the file path for key, refusing keys that escape the root
+func (s *LocalStore) path(key string) (string, error) {
+	clean := path.Clean("/" + key)
+	if clean == "/" {
+		return "", fmt.Errorf("invalid storage key %q", key)
+	}
+	return filepath.Join(s.root, filepath.FromSlash(clean)), nil
+}
+
+func (s *LocalStore) Save(key string, data []byte, contentType string) (string, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return "", fmt.Errorf("failed to create directory for %s: %v", key, err)
+	}
+	if err := os.WriteFile(p, data, 0644); err != nil {
+		return "", fmt.Errorf("failed to write %s: %v", p, err)
+	}
+	return s.URL(key)
+}
+
+func (s *LocalStore) SaveFile(key string, localPath string, contentType string) (string, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return "", fmt.Errorf("failed to create directory for %s: %v", key, err)
+	}
+	if err := os.Rename(localPath, p); err == nil {
+		return s.URL(key)
+	}
+
+	// Rename fails across filesystems, fall back to copying
+	data, err := os.ReadFile(localPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %v", localPath, err)
+	}
+	defer os.Remove(localPath)
+	return s.Save(key, data, contentType)
+}
+
+func (s *LocalStore) Load(key string) ([]byte, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(p)
+}
+
+func (s *LocalStore) Delete(key string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	return os.Remove(p)
+}
+
+func (s *LocalStore) URL(key string) (string, error) {
+	return s.publicURL + "/snapshots/" + strings.TrimPrefix(key, "/"), nil
+}
+
+// List walks the storage directory below prefix, skipping hidden files such
+// as the retention flag list
+func (s *LocalStore) List(prefix string) ([]StoredObject, error) {
+	// Only walk the directory that can contain the prefix
+	start := s.root
+	if dir := path.Dir(path.Clean("/" + prefix + "x")); dir != "/" {
+		start = filepath.Join(s.root, filepath.FromSlash(dir))
+	}
+
+	var objects []StoredObject
+	err := filepath.WalkDir(start, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && p == start {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if strings.HasPrefix(d.Name(), ".") && p != s.root {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		rel, err := filepath.Rel(s.root, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		objects = append(objects, StoredObject{
+			Key:     key,
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %v", s.root, err)
+	}
+	return objects, nil
+}
+
+// S3Store keeps objects in an S3-compatible bucket
+type S3Store struct {
+	config S3Config
+	client *minio.Client
+}
+
+// NewS3Store connects to the bucket and optionally creates it
+func NewS3Store(config S3Config) (*S3Store, error) {
+	if config.Endpoint == "" || config.Bucket == "" {
+		return nil, fmt.Errorf("s3 storage requires endpoint and bucket")
+	}
+
+	client, err := minio.New(config.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(config.AccessKey, config.SecretKey, ""),
+		Secure: config.UseSSL,
+		Region: config.Region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create s3 client: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	exists, err := client.BucketExists(ctx, config.Bucket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check bucket %s: %v", config.Bucket, err)
+	}
+	if !exists {
+		if !config.CreateBucket {
+			return nil, fmt.Errorf("bucket %s does not exist", config.Bucket)
+		}
+		if err := client.MakeBucket(ctx, config.Bucket, minio.MakeBucketOptions{Region: config.Region}); err != nil {
+			return nil, fmt.Errorf("failed to create bucket %s: %v", config.Bucket, err)
+		}
+		log.Printf("Created bucket %s", config.Bucket)
+	}
+
+	return &S3Store{config: config, client: client}, nil
+}
+
+// objectName prefixes key with the configured prefix
+func (s *S3Store) objectName(key string) string {
+	return path.Join(s.config.Prefix, strings.TrimPrefix(key, "/"))
+}
+
+func (s *S3Store) Save(key string, data []byte, contentType string) (string, error) {
+	return s.put(key, bytes.NewReader(data), int64(len(data)), contentType)
+}
+
+func (s *S3Store) SaveFile(key string, localPath string, contentType string) (string, error) {
+	file, err := os.Open(localPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to open %s: %v", localPath, err)
+	}
+	defer os.Remove(localPath)
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return "", fmt.Errorf("failed to stat %s: %v", localPath, err)
+	}
+	return s.put(key, file, info.Size(), contentType)
+}
+
+func (s *S3Store) put(key string, r io.Reader, size int64, contentType string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	_, err := s.client.PutObject(ctx, s.config.Bucket, s.objectName(key), r, size, minio.PutObjectOptions{
+		ContentType: contentType,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to upload %s: %v", key, err)
+	}
+	return s.URL(key)
+}
+
+func (s *S3Store) Load(key string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	obj, err := s.client.GetObject(ctx, s.config.Bucket, s.objectName(key), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get %s: %v", key, err)
+	}
+	defer obj.Close()
+
+	// The request is only sent on the first read
+	data, err := io.ReadAll(obj)
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil, fmt.Errorf("%s: %w", key, fs.ErrNotExist)
+		}
+		return nil, fmt.Errorf("failed to read %s: %v", key, err)
+	}
+	return data, nil
+}
+
+func (s *S3Store) Delete(key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	return s.client.RemoveObject(ctx, s.config.Bucket, s.objectName(key), minio.RemoveObjectOptions{})
+}
+
+// URL returns a presigned URL when presign_seconds is set, otherwise a
+// public URL (public_url or the bucket endpoint)
+func (s *S3Store) URL(key string) (string, error) {
+	name := s.objectName(key)
+
+	if s.config.PresignSeconds > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		expiry := time.Duration(s.config.PresignSeconds) * time.Second
+		u, err := s.client.PresignedGetObject(ctx, s.config.Bucket, name, expiry, url.Values{})
+		if err != nil {
+			return "", fmt.Errorf("failed to presign %s: %v", key, err)
+		}
+		return u.String(), nil
+	}
+
+	if s.config.PublicURL != "" {
+		return strings.TrimSuffix(s.config.PublicURL, "/") + "/" + name, nil
+	}
+
+	u := *s.client.EndpointURL()
+	u.Path = "/" + path.Join(s.config.Bucket, name)
+	return u.String(), nil
+}
+
+func (s *S3Store) List(prefix string) ([]StoredObject, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	base := ""
+	if s.config.Prefix != "" {
+		base = strings.TrimSuffix(s.config.Prefix, "/") + "/"
+	}
+
+	var objects []StoredObject
+	for obj := range s.client.ListObjects(ctx, s.config.Bucket, minio.ListObjectsOptions{Prefix: base + prefix, Recursive: true}) {
+		if obj.Err != nil {
+			return nil, fmt.Errorf("failed to list bucket %s: %v", s.config.Bucket, obj.Err)
+		}
+		objects = append(objects, StoredObject{
+			Key:     strings.TrimPrefix(obj.Key, base),
+			Size:    obj.Size,
+			ModTime: obj.LastModified,
+		})
+	}
+	return objects, nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import "testing"
+
+func TestStorageConfigValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		config StorageConfig
+		want   string
+		ok     bool
+	}{
+		// Stored media must never get a URL relative to the worker
+		{"derived from the port", StorageConfig{}, "http://localhost:9090", true},
+		{"configured", StorageConfig{PublicURL: "https://worker.example.com/"}, "https://worker.example.com/", true},
+		{"relative", StorageConfig{PublicURL: "/snapshots"}, "", false},
+		{"no scheme", StorageConfig{PublicURL: "worker:8080"}, "", false},
+		{"other scheme", StorageConfig{PublicURL: "ftp://worker"}, "", false},
+		{"bad s3 public_url", StorageConfig{PublicURL: "http://worker", S3: S3Config{PublicURL: "cdn.example.com"}}, "", false},
+	}
+	for _, tt := range tests {
+		c := tt.config
+		err := c.validate(9090)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: validate() error = %v, want ok=%v", tt.name, err, tt.ok)
+			continue
+		}
+		if tt.ok && c.PublicURL != tt.want {
+			t.Errorf("%s: public_url = %q, want %q", tt.name, c.PublicURL, tt.want)
+		}
+	}
+}
+
+func TestLocalStoreURL(t *testing.T) {
+	if _, err := NewLocalStore(t.TempDir(), ""); err == nil {
+		t.Error("NewLocalStore() accepted an empty public URL")
+	}
+	store, err := NewLocalStore(t.TempDir(), "http://worker:8080/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := store.Save("cam-1/2024-05-01/a.jpg", []byte("x"), "image/jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "http://worker:8080/snapshots/cam-1/2024-05-01/a.jpg"; got != want {
+		t.Errorf("Save() URL = %q, want %q", got, want)
+	}
+}
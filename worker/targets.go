@@ -0,0 +1,388 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Publish target types
+const (
+	TargetRTSP = "rtsp"
+	TargetRTMP = "rtmp"
+	TargetSRT  = "srt"
+	TargetHLS  = "hls"
+	// TargetEmbedded serves the stream from the worker's own RTSP server
+	TargetEmbedded = "embedded"
+)
+
+// PublishTarget is one destination of a camera's published stream. url may
+// use {path}, the camera's path from the path template; network URLs without
+// a path get it appended. For hls, url is a local playlist (.m3u8) or directory.
+type PublishTarget struct {
+	Type string `yaml:"type" json:"type,omitempty"`
+	URL  string `yaml:"url" json:"url"`
+}
+
+// PublishSettings overrides the publish targets and path template of a
+// camera, and whether its raw video is published too
+type PublishSettings struct {
+	Targets      []PublishTarget `json:"targets,omitempty"`
+	PathTemplate string          `json:"path_template,omitempty"`
+	Raw          *bool           `json:"raw,omitempty"`
+	OnDemand     *bool           `json:"on_demand,omitempty"`
+	// Encoder profile name and settings on top of it
+	Profile string          `json:"profile,omitempty"`
+	Encoder *EncoderProfile `json:"encoder,omitempty"`
+}
+
+// annotatedPathSuffix is appended to the path of the annotated stream when the
+// raw stream is published at the camera's path
+const annotatedPathSuffix = "/annotated"
+
+// publishOutput is a resolved target: an ffmpeg muxer, its options and URL.
+// An embedded output is written to fd 3 and served at the embedded path.
+type publishOutput struct {
+	format   string
+	options  [][2]string
+	bsf      string
+	url      string
+	embedded string
+}
+
+// embeddedFD is the file descriptor ffmpeg writes embedded outputs to
+const embeddedFD = "pipe:3"
+
+// Redacted returns the output URL without its password, for status and logs
+func (o publishOutput) Redacted() string {
+	if o.embedded != "" {
+		return "embedded:/" + o.embedded
+	}
+	if u, err := url.Parse(o.url); err == nil && u.User != nil {
+		return u.Redacted()
+	}
+	return o.url
+}
+
+// publishPath renders the path template of a camera. {site} is the camera's
+// site, or the global one; {camera} is the camera ID.
+func (sm *StreamManager) publishPath(camera Camera) string {
+	template := sm.config.Publisher.PathTemplate
+	if camera.Publish != nil && camera.Publish.PathTemplate != "" {
+		template = camera.Publish.PathTemplate
+	}
+	if template == "" {
+		template = "{camera}"
+	}
+	site := camera.Site
+	if site == "" {
+		site = sm.config.Publisher.Site
+	}
+
+	p := strings.NewReplacer(
+		"{site}", url.PathEscape(site),
+		"{camera}", url.PathEscape(camera.ID),
+	).Replace(template)
+	// An empty site must not leave an empty path segment
+	for strings.Contains(p, "//") {
+		p = strings.ReplaceAll(p, "//", "/")
+	}
+	return strings.Trim(p, "/")
+}
+
+// publishRaw reports whether a camera's raw video is published next to the
+// annotated frames
+func (sm *StreamManager) publishRaw(camera Camera) bool {
+	if camera.Publish != nil && camera.Publish.Raw != nil {
+		return *camera.Publish.Raw
+	}
+	return sm.config.Publisher.Raw
+}
+
+// publishOnDemand reports whether a camera is only published while someone
+// is watching
+func (sm *StreamManager) publishOnDemand(camera Camera) bool {
+	if camera.Publish != nil && camera.Publish.OnDemand != nil {
+		return *camera.Publish.OnDemand
+	}
+	return sm.config.Publisher.OnDemand
+}
+
+// validatePublish checks the publish and encoder settings of a camera before
+// it starts
+func (sm *StreamManager) validatePublish(camera Camera) error {
+	encoder, err := sm.encoderProfile(camera)
+	if err != nil {
+		return err
+	}
+	annotated, err := sm.publishOutputs(camera, FrameAnnotated)
+	if err != nil {
+		return err
+	}
+	// The embedded server only packetizes H.264
+	if embeddedPath(annotated) != "" && !strings.Contains(encoder.Codec, "264") {
+		return fmt.Errorf("the embedded RTSP server needs an H.264 codec, not %s", encoder.Codec)
+	}
+	if !sm.publishRaw(camera) {
+		return nil
+	}
+	raw, err := sm.publishOutputs(camera, FrameRaw)
+	if err != nil {
+		return err
+	}
+	for i := range raw {
+		if raw[i].url == annotated[i].url && raw[i].embedded == annotated[i].embedded {
+			return fmt.Errorf("publish target %q has no {path}, so the raw and annotated streams would collide", raw[i].Redacted())
+		}
+	}
+	// The passthrough copies the camera's codec
+	if embeddedPath(raw) != "" {
+		codec, err := probeVideoCodec(camera.RTSPURL)
+		if err != nil {
+			log.Printf("Could not check the video codec of camera %s, assuming H.264: %v", camera.ID, err)
+		} else if codec != "h264" {
+			return fmt.Errorf("the embedded RTSP server needs H.264, but the camera sends %s; set publish.raw to false for it", codec)
+		}
+	}
+	return nil
+}
+
+// probeTimeout bounds the codec check of a camera
+const probeTimeout = 10 * time.Second
+
+// probeVideoCodec asks ffprobe for the codec of a camera's first video stream
+func probeVideoCodec(source string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+
+	var args []string
+	if strings.HasPrefix(source, "rtsp://") || strings.HasPrefix(source, "rtsps://") {
+		args = append(args, "-rtsp_transport", "tcp")
+	}
+	args = append(args,
+		"-v", "error",
+		"-select_streams", "v:0",
+		"-show_entries", "stream=codec_name",
+		"-of", "default=noprint_wrappers=1:nokey=1",
+		source,
+	)
+	var stderr strings.Builder
+	cmd := exec.CommandContext(ctx, "ffprobe", args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("ffprobe failed: %v: %s", err, lastLine(stderr.String()))
+	}
+	codec := strings.TrimSpace(string(out))
+	if codec == "" {
+		return "", fmt.Errorf("no video stream")
+	}
+	return codec, nil
+}
+
+// publishOutputs resolves the publish targets of a camera's raw or annotated
+// stream: its own, the global ones, or RTSP to MediaMTX when none are
+// configured. With raw publishing the annotated stream moves to
+// <path>/annotated.
+func (sm *StreamManager) publishOutputs(camera Camera, variant string) ([]publishOutput, error) {
+	targets := sm.config.Publisher.Targets
+	if camera.Publish != nil && len(camera.Publish.Targets) > 0 {
+		targets = camera.Publish.Targets
+	}
+	if len(targets) == 0 {
+		target, err := sm.defaultPublishTarget()
+		if err != nil {
+			return nil, err
+		}
+		targets = []PublishTarget{target}
+	}
+
+	path := sm.variantPath(camera, variant)
+	outputs := make([]publishOutput, 0, len(targets))
+	for _, target := range targets {
+		output, err := resolveTarget(target, path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid publish target %q: %v", target.URL, err)
+		}
+		if output.embedded != "" {
+			if sm.rtsp == nil {
+				return nil, fmt.Errorf("publish target type %s needs rtsp_server.enabled", TargetEmbedded)
+			}
+			// ffmpeg has a single pipe to the server
+			if embeddedPath(outputs) != "" {
+				return nil, fmt.Errorf("only one publish target can be of type %s", TargetEmbedded)
+			}
+		}
+		outputs = append(outputs, output)
+	}
+	return outputs, nil
+}
+
+// embeddedPath returns the embedded server path of a set of outputs, or ""
+// when none of them is embedded
+func embeddedPath(outputs []publishOutput) string {
+	for _, o := range outputs {
+		if o.embedded != "" {
+			return o.embedded
+		}
+	}
+	return ""
+}
+
+// defaultPublishTarget publishes over RTSP to the MediaMTX host on port 8554,
+// with the publish credentials of managed paths, or to the embedded RTSP
+// server when it is enabled
+func (sm *StreamManager) defaultPublishTarget() (PublishTarget, error) {
+	if sm.rtsp != nil {
+		return PublishTarget{Type: TargetEmbedded}, nil
+	}
+	u, err := url.Parse(sm.config.MediaMTXURL)
+	if err != nil {
+		return PublishTarget{}, fmt.Errorf("invalid MediaMTXURL: %w", err)
+	}
+	host := u.Hostname()
+	if host == "" {
+		host = "localhost"
+	}
+	target := url.URL{Scheme: "rtsp", Host: net.JoinHostPort(host, "8554")}
+	if m := sm.config.MediaMTX; m.Enabled && m.PublishUser != "" {
+		target.User = url.UserPassword(m.PublishUser, m.PublishPass)
+	}
+	return PublishTarget{Type: TargetRTSP, URL: target.String() + "/{path}"}, nil
+}
+
+// resolveTarget fills in the path of a target and picks the ffmpeg muxer for
+// its type, which is taken from the URL scheme when not set
+func resolveTarget(target PublishTarget, path string) (publishOutput, error) {
+	if strings.ToLower(target.Type) == TargetEmbedded {
+		// url is an optional path on the embedded server
+		name := path
+		if target.URL != "" {
+			name = strings.Trim(strings.ReplaceAll(target.URL, "{path}", path), "/")
+		}
+		unescaped, err := url.PathUnescape(name)
+		if err != nil || unescaped == "" {
+			return publishOutput{}, fmt.Errorf("invalid embedded path %q", name)
+		}
+		// Raw H.264 for the server, with the parameter sets on every keyframe
+		return publishOutput{format: "h264", bsf: "dump_extra", url: embeddedFD, embedded: unescaped}, nil
+	}
+
+	raw := strings.ReplaceAll(target.URL, "{path}", path)
+	if raw == "" {
+		return publishOutput{}, fmt.Errorf("url is required")
+	}
+	// These separate outputs of the tee muxer
+	if strings.ContainsAny(raw, "|[]") {
+		return publishOutput{}, fmt.Errorf("url must not contain '|', '[' or ']'")
+	}
+
+	kind := strings.ToLower(target.Type)
+	u, err := url.Parse(raw)
+	if kind == "" {
+		switch {
+		case err == nil && (u.Scheme == "rtsp" || u.Scheme == "rtsps"):
+			kind = TargetRTSP
+		case err == nil && (u.Scheme == "rtmp" || u.Scheme == "rtmps"):
+			kind = TargetRTMP
+		case err == nil && u.Scheme == "srt":
+			kind = TargetSRT
+		case strings.HasSuffix(raw, ".m3u8") || err != nil || u.Scheme == "":
+			kind = TargetHLS
+		default:
+			return publishOutput{}, fmt.Errorf("unsupported scheme %q", u.Scheme)
+		}
+	}
+
+	output := publishOutput{url: raw}
+	switch kind {
+	case TargetRTSP, TargetRTMP, TargetSRT:
+		if err != nil {
+			return publishOutput{}, err
+		}
+		// Publish under the camera's path when the URL names none
+		if !strings.Contains(target.URL, "{path}") && kind != TargetSRT && (u.Path == "" || u.Path == "/") {
+			// path is already escaped
+			unescaped, _ := url.PathUnescape(path)
+			u.Path, u.RawPath = "/"+unescaped, "/"+path
+			output.url = u.String()
+		}
+		switch kind {
+		case TargetRTSP:
+			output.format = "rtsp"
+			output.options = [][2]string{{"rtsp_transport", "tcp"}}
+		case TargetRTMP:
+			output.format = "flv"
+		case TargetSRT:
+			output.format = "mpegts"
+		}
+	case TargetHLS:
+		playlist := raw
+		if !strings.HasSuffix(playlist, ".m3u8") {
+			playlist = filepath.Join(playlist, "index.m3u8")
+		}
+		output.url = playlist
+		output.format = "hls"
+		output.options = [][2]string{
+			{"hls_time", "2"},
+			{"hls_list_size", "6"},
+			{"hls_flags", "delete_segments"},
+		}
+	default:
+		return publishOutput{}, fmt.Errorf("unknown type %q (expected rtsp, rtmp, srt, hls or embedded)", target.Type)
+	}
+	return output, nil
+}
+
+// prepareOutputs creates the directories of local outputs. It runs when a
+// publisher starts, not when targets are resolved for status or validation.
+func prepareOutputs(outputs []publishOutput) error {
+	for _, o := range outputs {
+		if o.format != "hls" {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(o.url), 0755); err != nil {
+			return fmt.Errorf("failed to create HLS directory: %v", err)
+		}
+	}
+	return nil
+}
+
+// outputArgs returns the ffmpeg output arguments for the outputs. Several
+// outputs share one encode through the tee muxer; a failing output is dropped
+// without stopping the others.
+func outputArgs(outputs []publishOutput) []string {
+	if len(outputs) == 1 {
+		o := outputs[0]
+		var args []string
+		if o.bsf != "" {
+			args = append(args, "-bsf:v", o.bsf)
+		}
+		args = append(args, "-f", o.format)
+		for _, opt := range o.options {
+			args = append(args, "-"+opt[0], opt[1])
+		}
+		return append(args, o.url)
+	}
+
+	slaves := make([]string, 0, len(outputs))
+	for _, o := range outputs {
+		opts := []string{"f=" + o.format}
+		if o.bsf != "" {
+			opts = append(opts, "bsfs/v="+o.bsf)
+		}
+		for _, opt := range o.options {
+			opts = append(opts, opt[0]+"="+opt[1])
+		}
+		opts = append(opts, "onfail=ignore")
+		slaves = append(slaves, "["+strings.Join(opts, ":")+"]"+o.url)
+	}
+	return []string{"-f", "tee", strings.Join(slaves, "|")}
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gocv.io/x/gocv"
+)
+
+// TimelapseConfig controls daily timelapse videos. It is set globally in
+// config.yaml; enabled and interval_seconds can be overridden per camera in
+// the start request.
+type TimelapseConfig struct {
+	Enabled         bool   `yaml:"enabled" json:"enabled"`
+	IntervalSeconds int    `yaml:"interval_seconds" json:"interval_seconds"`
+	FPS             int    `yaml:"fps" json:"-"`
+	Width           int    `yaml:"width" json:"-"`
+	ActivityPercent int    `yaml:"activity_percent" json:"-"`
+	FramesPath      string `yaml:"frames_path" json:"-"`
+}
+
+// TimelapseJob is an on-demand timelapse build running in the background
+type TimelapseJob struct {
+	ID         string     `json:"id"`
+	Status     string     `json:"status"`
+	CameraID   string     `json:"camera_id"`
+	Date       string     `json:"date"`
+	CreatedAt  time.Time  `json:"created_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	Key        string     `json:"key,omitempty"`
+	URL        string     `json:"url,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	StatusURL  string     `json:"status_url"`
+}
+
+// timelapseJobKeep is how long a finished build stays queryable
+const timelapseJobKeep = 24 * time.Hour
+
+// timelapseJobs tracks the on-demand builds of this worker run
+type timelapseJobs struct {
+	mutex sync.Mutex
+	jobs  map[string]*TimelapseJob
+}
+
+// get returns a copy of a job
+func (t *timelapseJobs) get(id string) (TimelapseJob, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	job, ok := t.jobs[id]
+	if !ok {
+		return TimelapseJob{}, false
+	}
+	return *job, true
+}
+
+// update changes a job under the lock
+func (t *timelapseJobs) update(id string, fn func(job *TimelapseJob)) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if job, ok := t.jobs[id]; ok {
+		fn(job)
+	}
+}
+
+// timelapseSampler keeps one frame every interval for a stream and tracks how
+// many frames had faces since the last sample
+type timelapseSampler struct {
+	config     TimelapseConfig
+	dir        string
+	last       time.Time
+	frames     int
+	faceFrames int
+}
+
+// Observe records a processed frame and reports whether a sample is due
+func (s *timelapseSampler) Observe(now time.Time, hasFaces bool) bool {
+	s.frames++
+	if hasFaces {
+		s.faceFrames++
+	}
+	return now.Sub(s.last) >= time.Duration(s.config.IntervalSeconds)*time.Second
+}
+
+// Sample writes the frame to <frames_path>/<camera>/<date>/<HHMMSS>.jpg. Frames
+// from periods with many detections get a red border and an activity label.
+func (s *timelapseSampler) Sample(now time.Time, img *gocv.Mat) {
+	activity := 0
+	if s.frames > 0 {
+		activity = s.faceFrames * 100 / s.frames
+	}
+	s.last = now
+	s.frames = 0
+	s.faceFrames = 0
+
+	frame := gocv.NewMat()
+	if size, ok := fitWithin(img.Cols(), img.Rows(), s.config.Width, 0); ok {
+		gocv.Resize(*img, &frame, size, 0, 0, gocv.InterpolationArea)
+	} else {
+		img.CopyTo(&frame)
+	}
+
+	if activity >= s.config.ActivityPercent && activity > 0 {
+		red := color.RGBA{255, 0, 0, 255}
+		gocv.Rectangle(&frame, image.Rect(0, 0, frame.Cols(), frame.Rows()), red, 12)
+		gocv.PutText(&frame, fmt.Sprintf("ACTIVITY %d%%", activity), image.Pt(20, frame.Rows()-24),
+			gocv.FontHersheySimplex, 0.9, red, 2)
+	}
+
+	// Encoding and writing happen off the frame loop
+	at := now.UTC()
+	go func() {
+		defer frame.Close()
+
+		buf, err := gocv.IMEncodeWithParams(gocv.JPEGFileExt, frame, []int{gocv.IMWriteJpegQuality, 85})
+		if err != nil {
+			log.Printf("Failed to encode timelapse frame in %s: %v", s.dir, err)
+			return
+		}
+		defer buf.Close()
+
+		dir := filepath.Join(s.dir, at.Format(archiveDateLayout))
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			log.Printf("Failed to create timelapse directory %s: %v", dir, err)
+			return
+		}
+		path := filepath.Join(dir, at.Format("150405")+".jpg")
+		if err := os.WriteFile(path, buf.GetBytes(), 0644); err != nil {
+			log.Printf("Failed to write timelapse frame %s: %v", path, err)
+		}
+	}()
+}
+
+// timelapseConfig returns the timelapse settings for a camera, falling back to
+// the global settings
+func (sm *StreamManager) timelapseConfig(camera Camera) TimelapseConfig {
+	config := sm.config.Timelapse
+	if camera.Timelapse != nil {
+		config.Enabled = camera.Timelapse.Enabled
+		if camera.Timelapse.IntervalSeconds > 0 {
+			config.IntervalSeconds = camera.Timelapse.IntervalSeconds
+		}
+	}
+	if config.IntervalSeconds <= 0 {
+		config.IntervalSeconds = 10
+	}
+	return config
+}
+
+// newTimelapseSampler returns a sampler for a camera, or nil when disabled
+func (sm *StreamManager) newTimelapseSampler(camera Camera) *timelapseSampler {
+	config := sm.timelapseConfig(camera)
+	if !config.Enabled {
+		return nil
+	}
+	return &timelapseSampler{
+		config: config,
+		dir:    filepath.Join(config.FramesPath, cameraDirName(camera.ID)),
+	}
+}
+
+// timelapseBuilds serializes builds so the scheduler and API don't encode the same day twice
+var timelapseBuilds sync.Mutex
+
+// buildTimelapse encodes the sampled frames of a camera and day (YYYY-MM-DD,
+// UTC) into an MP4 in the snapshot store and returns its key and URL. The
+// frame directory and the key use the same camera name, so a directory read
+// back from disk builds the same key as the camera ID. Callers hold
+// timelapseBuilds.
+func (sm *StreamManager) buildTimelapse(cameraID, date string) (string, string, error) {
+	name := cameraDirName(cameraID)
+	dir := filepath.Join(sm.config.Timelapse.FramesPath, name, date)
+	frames, err := filepath.Glob(filepath.Join(dir, "*.jpg"))
+	if err != nil {
+		return "", "", err
+	}
+	if len(frames) < 2 {
+		return "", "", fmt.Errorf("not enough timelapse frames for camera %s on %s", cameraID, date)
+	}
+
+	tmp, err := os.CreateTemp("", "timelapse-*.mp4")
+	if err != nil {
+		return "", "", fmt.Errorf("failed to create temporary timelapse file: %v", err)
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	args := []string{
+		"-y",
+		"-framerate", strconv.Itoa(sm.config.Timelapse.FPS),
+		"-pattern_type", "glob",
+		"-i", filepath.Join(dir, "*.jpg"),
+		"-c:v", "libx264",
+		"-preset", "veryfast",
+		"-pix_fmt", "yuv420p",
+		// Even dimensions for yuv420p
+		"-vf", "scale=trunc(iw/2)*2:trunc(ih/2)*2",
+		"-movflags", "+faststart",
+		tmp.Name(),
+	}
+	cmd := exec.Command("ffmpeg", args...)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", "", fmt.Errorf("ffmpeg failed: %v: %s", err, lastLine(stderr.String()))
+	}
+
+	key := fmt.Sprintf("%s/timelapse/%s.mp4", name, date)
+	url, err := sm.store.SaveFile(key, tmp.Name(), "video/mp4")
+	if err != nil {
+		return "", "", err
+	}
+	log.Printf("Built timelapse %s from %d frames", key, len(frames))
+	return key, url, nil
+}
+
+// buildScheduledTimelapse builds a finished day for the scheduler, holding timelapseBuilds
+func (sm *StreamManager) buildScheduledTimelapse(cameraID, date string) error {
+	timelapseBuilds.Lock()
+	defer timelapseBuilds.Unlock()
+	_, _, err := sm.buildTimelapse(cameraID, date)
+	return err
+}
+
+// runTimelapseScheduler builds the timelapse of every finished day and removes
+// its frames. It also catches up on days missed while the worker was down.
+func (sm *StreamManager) runTimelapseScheduler() {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Panic in timelapse scheduler: %v", r)
+		}
+	}()
+
+	for {
+		sm.buildFinishedTimelapses()
+		sm.forgetTimelapseJobs(time.Now().Add(-timelapseJobKeep))
+		time.Sleep(10 * time.Minute)
+	}
+}
+
+// forgetTimelapseJobs drops the builds that finished before cutoff
+func (sm *StreamManager) forgetTimelapseJobs(cutoff time.Time) {
+	sm.timelapseJobs.mutex.Lock()
+	defer sm.timelapseJobs.mutex.Unlock()
+	for id, job := range sm.timelapseJobs.jobs {
+		if job.FinishedAt != nil && job.FinishedAt.Before(cutoff) {
+			delete(sm.timelapseJobs.jobs, id)
+		}
+	}
+}
+
+// buildFinishedTimelapses builds the days before today that still have frames
+func (sm *StreamManager) buildFinishedTimelapses() {
+	root := sm.config.Timelapse.FramesPath
+	cameras, err := os.ReadDir(root)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Failed to list timelapse frames: %v", err)
+		}
+		return
+	}
+
+	today := time.Now().UTC().Format(archiveDateLayout)
+	for _, camera := range cameras {
+		if !camera.IsDir() {
+			continue
+		}
+		days, err := os.ReadDir(filepath.Join(root, camera.Name()))
+		if err != nil {
+			continue
+		}
+		for _, day := range days {
+			// Dates sort lexically, so anything before today is finished
+			if !day.IsDir() || day.Name() >= today {
+				continue
+			}
+			dir := filepath.Join(root, camera.Name(), day.Name())
+			if err := sm.buildScheduledTimelapse(camera.Name(), day.Name()); err != nil {
+				attempts := countTimelapseAttempt(dir)
+				if attempts < maxTimelapseAttempts {
+					log.Printf("Timelapse for camera %s on %s failed (attempt %d of %d): %v", camera.Name(), day.Name(), attempts, maxTimelapseAttempts, err)
+					continue
+				}
+				log.Printf("Timelapse for camera %s on %s failed %d times, discarding its frames: %v", camera.Name(), day.Name(), attempts, err)
+			}
+			if err := os.RemoveAll(dir); err != nil {
+				log.Printf("Failed to remove timelapse frames: %v", err)
+			}
+		}
+	}
+}
+
+// maxTimelapseAttempts is how often the scheduler tries to build a finished
+// day before its frames are discarded
+const maxTimelapseAttempts = 3
+
+// timelapseAttemptsFile counts failed builds in a day's frame directory, so
+// the count survives restarts
+const timelapseAttemptsFile = ".attempts"
+
+// countTimelapseAttempt records a failed build of the day in dir and returns
+// the number of failures so far
+func countTimelapseAttempt(dir string) int {
+	path := filepath.Join(dir, timelapseAttemptsFile)
+	attempts := 0
+	if data, err := os.ReadFile(path); err == nil {
+		attempts, _ = strconv.Atoi(strings.TrimSpace(string(data)))
+	}
+	attempts++
+	if err := os.WriteFile(path, []byte(strconv.Itoa(attempts)), 0644); err != nil {
+		log.Printf("Failed to record timelapse attempt in %s: %v", dir, err)
+	}
+	return attempts
+}
+
+// startTimelapseBuild queues the build of a camera and day and returns the
+// job. A build of the same day that hasn't finished is returned instead of
+// starting another one.
+func (sm *StreamManager) startTimelapseBuild(cameraID, date string) TimelapseJob {
+	sm.timelapseJobs.mutex.Lock()
+	defer sm.timelapseJobs.mutex.Unlock()
+
+	for _, job := range sm.timelapseJobs.jobs {
+		if job.FinishedAt == nil && job.Date == date && cameraDirName(job.CameraID) == cameraDirName(cameraID) {
+			return *job
+		}
+	}
+
+	id := newEventID()
+	job := &TimelapseJob{
+		ID:        id,
+		Status:    ExportQueued,
+		CameraID:  cameraID,
+		Date:      date,
+		CreatedAt: time.Now(),
+		StatusURL: strings.TrimSuffix(sm.config.Storage.PublicURL, "/") + "/timelapse/build/" + id,
+	}
+	if sm.timelapseJobs.jobs == nil {
+		sm.timelapseJobs.jobs = make(map[string]*TimelapseJob)
+	}
+	sm.timelapseJobs.jobs[id] = job
+
+	go sm.runTimelapseBuild(id)
+	return *job
+}
+
+// runTimelapseBuild runs a queued build once no other build is encoding and
+// records the outcome
+func (sm *StreamManager) runTimelapseBuild(id string) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Panic in timelapse build %s: %v", id, r)
+			sm.timelapseJobs.update(id, func(job *TimelapseJob) {
+				job.Status = ExportFailed
+				job.Error = fmt.Sprintf("panic: %v", r)
+				now := time.Now()
+				job.FinishedAt = &now
+			})
+		}
+	}()
+
+	timelapseBuilds.Lock()
+	defer timelapseBuilds.Unlock()
+
+	var job TimelapseJob
+	sm.timelapseJobs.update(id, func(j *TimelapseJob) {
+		j.Status = ExportRunning
+		job = *j
+	})
+
+	key, url, err := sm.buildTimelapse(job.CameraID, job.Date)
+	sm.timelapseJobs.update(id, func(j *TimelapseJob) {
+		now := time.Now()
+		j.FinishedAt = &now
+		if err != nil {
+			j.Status = ExportFailed
+			j.Error = err.Error()
+			return
+		}
+		j.Status = ExportDone
+		j.Key = key
+		j.URL = url
+	})
+	if err != nil {
+		log.Printf("Timelapse build %s for camera %s on %s failed: %v", id, job.CameraID, job.Date, err)
+	}
+}
+
+// handleBuildTimelapse queues a timelapse build, by default for today so far
+func (sm *StreamManager) handleBuildTimelapse(c *gin.Context) {
+	var req struct {
+		CameraID string `json:"camera_id" binding:"required"`
+		Date     string `json:"date"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Date == "" {
+		req.Date = time.Now().UTC().Format(archiveDateLayout)
+	}
+	if _, err := time.Parse(archiveDateLayout, req.Date); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "date must be YYYY-MM-DD"})
+		return
+	}
+
+	job := sm.startTimelapseBuild(req.CameraID, req.Date)
+	c.JSON(http.StatusAccepted, job)
+}
+
+// handleTimelapseBuildStatus reports an on-demand timelapse build
+func (sm *StreamManager) handleTimelapseBuildStatus(c *gin.Context) {
+	job, ok := sm.timelapseJobs.get(c.Param("id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "timelapse build not found"})
+		return
+	}
+	c.JSON(http.StatusOK, job)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestTimelapseFramesDir(t *testing.T) {
+	sm := &StreamManager{}
+	sm.config.Timelapse.FramesPath = t.TempDir()
+	sm.config.Timelapse.Enabled = true
+
+	// The sampler and the build agree on the directory of an odd camera ID
+	sampler := sm.newTimelapseSampler(Camera{ID: "site/cam-1"})
+	dir := filepath.Join(sampler.dir, "2024-05-01")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"000000.jpg", "000010.jpg"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("jpeg"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, id := range []string{"site/cam-1", "site_cam-1"} {
+		// The frames are found, so the build gets as far as ffmpeg
+		_, _, err := sm.buildTimelapse(id, "2024-05-01")
+		if err == nil || strings.Contains(err.Error(), "not enough timelapse frames") {
+			t.Errorf("buildTimelapse(%q) = %v, want the frames found", id, err)
+		}
+	}
+	if _, _, err := sm.buildTimelapse("site/cam-1", "2024-05-02"); err == nil || !strings.Contains(err.Error(), "not enough timelapse frames") {
+		t.Errorf("buildTimelapse() of a day without frames = %v", err)
+	}
+}
+
+func TestTimelapseBuildJob(t *testing.T) {
+	sm := &StreamManager{}
+	sm.config.Timelapse.FramesPath = t.TempDir()
+	sm.config.Storage.PublicURL = "http://worker"
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/timelapse/build", sm.handleBuildTimelapse)
+	router.GET("/timelapse/build/:id", sm.handleTimelapseBuildStatus)
+
+	request := func(method, path, body string) (int, TimelapseJob) {
+		req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		var job TimelapseJob
+		_ = json.Unmarshal(w.Body.Bytes(), &job)
+		return w.Code, job
+	}
+
+	if code, _ := request(http.MethodPost, "/timelapse/build", `{"camera_id": "cam-1", "date": "May 1"}`); code != http.StatusBadRequest {
+		t.Errorf("bad date: status %d, want 400", code)
+	}
+	if code, _ := request(http.MethodGet, "/timelapse/build/unknown", ""); code != http.StatusNotFound {
+		t.Errorf("unknown build: status %d, want 404", code)
+	}
+
+	// While another build encodes, the request returns at once and the job waits
+	timelapseBuilds.Lock()
+	code, job := request(http.MethodPost, "/timelapse/build", `{"camera_id": "cam-1", "date": "2024-05-01"}`)
+	if code != http.StatusAccepted || job.Status != ExportQueued || job.StatusURL != "http://worker/timelapse/build/"+job.ID {
+		t.Errorf("build: status %d, job %+v", code, job)
+	}
+	// The same day is not queued twice
+	if _, again := request(http.MethodPost, "/timelapse/build", `{"camera_id": "cam-1", "date": "2024-05-01"}`); again.ID != job.ID {
+		t.Errorf("second request queued build %s, want %s", again.ID, job.ID)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if _, got := request(http.MethodGet, "/timelapse/build/"+job.ID, ""); got.Status != ExportQueued {
+		t.Errorf("build ran while another one held the encoder: %+v", got)
+	}
+	timelapseBuilds.Unlock()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, got := request(http.MethodGet, "/timelapse/build/"+job.ID, "")
+		if got.Status == ExportFailed {
+			if !strings.Contains(got.Error, "not enough timelapse frames") || got.FinishedAt == nil {
+				t.Errorf("failed build = %+v", got)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("build did not finish: %+v", got)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// A finished build can be requested again
+	if _, next := request(http.MethodPost, "/timelapse/build", `{"camera_id": "cam-1", "date": "2024-05-01"}`); next.ID == job.ID {
+		t.Error("a finished build was returned instead of a new one")
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"image"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// Live event types sent over /ws
+const (
+	WSTypeDetection   = "detection"
+	WSTypeAlert       = "alert"
+	WSTypeEvent       = "event"
+	WSTypeStreamState = "stream_state"
+	WSTypeStats       = "stats"
+)
+
+// Stream states reported in stream_state messages
+const (
+	StreamStateRunning = "running"
+	StreamStateStopped = "stopped"
+	StreamStateFailed  = "failed"
+)
+
+const (
+	wsWriteWait  = 10 * time.Second
+	wsPongWait   = 60 * time.Second
+	wsPingPeriod = (wsPongWait * 9) / 10
+	wsSendBuffer = 64
+)
+
+// WSMessage is the envelope for every message sent to WebSocket subscribers
+type WSMessage struct {
+	Type     string      `json:"type"`
+	CameraID string      `json:"cameraId,omitempty"`
+	Time     time.Time   `json:"time"`
+	Data     interface{} `json:"data"`
+}
+
+// wsClient is a single WebSocket subscriber
+type wsClient struct {
+	conn    *websocket.Conn
+	send    chan []byte
+	cameras map[string]bool // empty means all cameras
+	types   map[string]bool // empty means all types
+}
+
+// EventHub fans out live events to WebSocket subscribers
+type EventHub struct {
+	clients map[*wsClient]struct{}
+	mutex   sync.RWMutex
+}
+
+// NewEventHub creates an empty hub
+func NewEventHub() *EventHub {
+	return &EventHub{clients: make(map[*wsClient]struct{})}
+}
+
+// HasClients reports whether anyone is subscribed, so callers can skip building messages
+func (h *EventHub) HasClients() bool {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	return len(h.clients) > 0
+}
+
+// Publish sends a message to every subscriber whose filters match. Subscribers
+// that can't keep up are disconnected rather than blocking the caller.
+func (h *EventHub) Publish(msgType, cameraID string, data interface{}) {
+	if !h.HasClients() {
+		return
+	}
+
+	payload, err := json.Marshal(WSMessage{
+		Type:     msgType,
+		CameraID: cameraID,
+		Time:     time.Now(),
+		Data:     data,
+	})
+	if err != nil {
+		log.Printf("Failed to encode %s message: %v", msgType, err)
+		return
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for client := range h.clients {
+		if !client.wants(msgType, cameraID) {
+			continue
+		}
+		select {
+		case client.send <- payload:
+		default:
+			log.Printf("WebSocket subscriber %s too slow, disconnecting", client.conn.RemoteAddr())
+			delete(h.clients, client)
+			close(client.send)
+		}
+	}
+}
+
+func (h *EventHub) register(client *wsClient) {
+	h.mutex.Lock()
+	h.clients[client] = struct{}{}
+	h.mutex.Unlock()
+}
+
+func (h *EventHub) unregister(client *wsClient) {
+	h.mutex.Lock()
+	if _, ok := h.clients[client]; ok {
+		delete(h.clients, client)
+		close(client.send)
+	}
+	h.mutex.Unlock()
+}
+
+// wants reports whether the client subscribed to this message
+func (c *wsClient) wants(msgType, cameraID string) bool {
+	if len(c.types) > 0 && !c.types[msgType] {
+		return false
+	}
+	if len(c.cameras) > 0 && cameraID != "" && !c.cameras[cameraID] {
+		return false
+	}
+	return true
+}
+
+// readPump consumes incoming messages so pongs and close frames are processed
+func (c *wsClient) readPump(hub *EventHub) {
+	defer func() {
+		hub.unregister(c)
+		c.conn.Close()
+	}()
+
+	c.conn.SetReadLimit(4096)
+	c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
+	for {
+		if _, _, err := c.conn.ReadMessage(); err != nil {
+			return
+		}
+	}
+}
+
+// writePump writes queued messages and pings the client to detect dead connections
+func (c *wsClient) writePump() {
+	ticker := time.NewTicker(wsPingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+
+	for {
+		select {
+		case payload, ok := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if !ok {
+				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if err := c.conn.WriteMessage(websocket.TextMessage, payload); err != nil {
+				return
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// handleWebSocket upgrades the connection and subscribes it to live events.
+// Optional query parameters: camera=<id>[,<id>...] and types=<type>[,<type>...]
+func (sm *StreamManager) handleWebSocket(c *gin.Context) {
+	conn, err := sm.upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		log.Printf("WebSocket upgrade failed: %v", err)
+		return
+	}
+
+	client := &wsClient{
+		conn:    conn,
+		send:    make(chan []byte, wsSendBuffer),
+		cameras: splitFilter(c.Query("camera")),
+		types:   splitFilter(c.Query("types")),
+	}
+	sm.hub.register(client)
+
+	go client.writePump()
+	go client.readPump(sm.hub)
+}
+
+// splitFilter turns a comma separated query value into a set
+func splitFilter(value string) map[string]bool {
+	set := make(map[string]bool)
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			set[item] = true
+		}
+	}
+	return set
+}
+
+// publishDetection sends the face boxes found in a frame
+func (sm *StreamManager) publishDetection(stream *CameraStream, faces []image.Rectangle) {
+	if !sm.hub.HasClients() {
+		return
+	}
+
+	boxes := make([]FaceBox, 0, len(faces))
+	for _, face := range faces {
+		boxes = append(boxes, faceBox(face))
+	}
+
+	sm.hub.Publish(WSTypeDetection, stream.Camera.ID, gin.H{
+		"face_count": len(faces),
+		"boxes":      boxes,
+	})
+}
+
+// publishStreamState sends a stream state transition
+func (sm *StreamManager) publishStreamState(cameraID, state, reason string) {
+	sm.hub.Publish(WSTypeStreamState, cameraID, gin.H{
+		"state":  state,
+		"reason": reason,
+	})
+}
+
+// runStatsBroadcaster publishes per-stream stats once a second while anyone is subscribed
+func (sm *StreamManager) runStatsBroadcaster() {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Panic in stats broadcaster: %v", r)
+		}
+	}()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	lastFrames := make(map[string]int64)
+	for range ticker.C {
+		if !sm.hub.HasClients() {
+			continue
+		}
+
+		sm.streamMutex.RLock()
+		for id, stream := range sm.streams {
+			stream.Mutex.RLock()
+			frames := stream.FrameCount
+			faces := stream.faceCount
+			uptime := time.Since(stream.StartTime).Seconds()
+			stream.Mutex.RUnlock()
+
+			fps := float64(0)
+			if last, ok := lastFrames[id]; ok {
+				fps = float64(frames - last)
+			}
+			lastFrames[id] = frames
+
+			sm.hub.Publish(WSTypeStats, id, gin.H{
+				"fps":         fps,
+				"frame_count": frames,
+				"face_count":  faces,
+				"uptime":      uptime,
+			})
+		}
+		for id := range lastFrames {
+			if _, ok := sm.streams[id]; !ok {
+				delete(lastFrames, id)
+			}
+		}
+		sm.streamMutex.RUnlock()
+	}
+}